@@ -109,6 +109,15 @@ var (
 	// ErrTCPRemoteAddrAlreadyExists indicates we already have the connection with same remote addr.
 	ErrTCPRemoteAddrAlreadyExists = errors.New("conn with same remote addr already exists")
 
+	// ErrWriteBufferFull indicates a packet was dropped because the write
+	// buffer of its connection is full. The connection is still usable, the
+	// write can be retried once the buffer drains.
+	ErrWriteBufferFull = errors.New("write buffer is full")
+
+	// ErrUnsupported indicates an operation isn't supported on this platform or
+	// by the connection it was called on.
+	ErrUnsupported = errors.New("operation is not supported")
+
 	// ErrUnknownCandidateTyp indicates that a candidate had a unknown type value.
 	ErrUnknownCandidateTyp = errors.New("unknown candidate typ")
 
@@ -125,7 +134,11 @@ var (
 	errGetXorMappedAddrResponse      = errors.New("failed to get XOR-MAPPED-ADDRESS response")
 	errConnectionAddrAlreadyExist    = errors.New("connection with same remote address already exists")
 	errReadingStreamingPacket        = errors.New("error reading streaming packet")
-	errWriting                       = errors.New("error writing to")
+	errStreamingPacketTooLarge       = errors.New("packet too large for streaming packet header")
+	errHandshakeFrameTooLarge        = errors.New("first packet of connection too large")
+	errInvalidFragment               = errors.New("fragment too short")
+	errFragmentedPacketTooLarge      = errors.New("fragmented packet too large")
+	errInvalidCompressedFrame        = errors.New("invalid compressed frame")
 	errClosingConnection             = errors.New("error closing connection")
 	errMissingProtocolScheme         = errors.New("missing protocol scheme")
 	errTooManyColonsAddr             = errors.New("too many colons in address")
@@ -139,4 +152,17 @@ var (
 	errSendSTUNPacket                = errors.New("failed to send STUN packet")
 	errXORMappedAddrTimeout          = errors.New("timeout while waiting for XORMappedAddr")
 	errNotImplemented                = errors.New("not implemented yet")
+	errConfigureConn                 = errors.New("failed to configure conn")
+	errDecodeSTUNMessage             = errors.New("failed to decode STUN message")
+	errNotSTUNBindingMessage         = errors.New("not a STUN binding message")
+	errMissingUsernameAttr           = errors.New("no username attribute in STUN message")
+	errNilListener                   = errors.New("listener is nil")
+	errAcceptLoopStopped             = errors.New("accept loop stopped on an accept error")
+	errFlushTimeout                  = errors.New("timeout while flushing buffered writes")
+	errSocketOptionUnsupported       = errors.New("socket option is not supported on this platform")
+	errNoDialer                      = errors.New("no dialer configured for active connections")
+	errNoRemoteAddrs                 = errors.New("no remote address to dial")
+	errEmptyUfrag                    = errors.New("empty ufrag in STUN username")
+	errInvalidUfrag                  = errors.New("invalid ufrag in STUN username")
+	errRecvQueueEmpty                = errors.New("no packet in receive queue")
 )
@@ -0,0 +1,116 @@
+// Package icemetrics exposes the statistics of ice types as Prometheus
+// metrics. It lives in its own package so that the ice package itself
+// doesn't depend on the Prometheus client.
+package icemetrics
+
+import (
+	"github.com/pion/ice/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TCPMuxStatsProvider is implemented by ice.TCPMuxDefault.
+type TCPMuxStatsProvider interface {
+	Stats() ice.TCPMuxStats
+}
+
+// TCPMuxCollector is a prometheus.Collector exporting the statistics of a
+// TCP mux.
+type TCPMuxCollector struct {
+	mux TCPMuxStatsProvider
+
+	acceptedConns      *prometheus.Desc
+	acceptErrors       *prometheus.Desc
+	liveConns          *prometheus.Desc
+	packetsRead        *prometheus.Desc
+	bytesRead          *prometheus.Desc
+	packetsWritten     *prometheus.Desc
+	bytesWritten       *prometheus.Desc
+	droppedWrites      *prometheus.Desc
+	closedByRemote     *prometheus.Desc
+	readErrors         *prometheus.Desc
+	stunDecodeFailures *prometheus.Desc
+	nonBindingMessages *prometheus.Desc
+	missingUsernames   *prometheus.Desc
+	invalidUfrags      *prometheus.Desc
+	pausedConns        *prometheus.Desc
+	recvQueueLen       *prometheus.Desc
+}
+
+// NewTCPMuxCollector creates a TCPMuxCollector reading the statistics of mux
+// each time it is collected. constLabels are attached to every metric, which
+// allows registering a collector for each of several muxes.
+func NewTCPMuxCollector(mux TCPMuxStatsProvider, constLabels prometheus.Labels) *TCPMuxCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("ice", "tcp_mux", name), help, nil, constLabels)
+	}
+
+	return &TCPMuxCollector{
+		mux: mux,
+
+		acceptedConns:      desc("accepted_conns_total", "Number of connections accepted from the listener."),
+		acceptErrors:       desc("accept_errors_total", "Number of errors accepting connections from the listener."),
+		liveConns:          desc("live_conns", "Number of connections currently routed to a ufrag."),
+		packetsRead:        desc("packets_read_total", "Number of packets read from connections."),
+		bytesRead:          desc("bytes_read_total", "Number of payload bytes read from connections."),
+		packetsWritten:     desc("packets_written_total", "Number of packets written to connections."),
+		bytesWritten:       desc("bytes_written_total", "Number of payload bytes written to connections."),
+		droppedWrites:      desc("dropped_writes_total", "Number of packets dropped because a write buffer was full."),
+		closedByRemote:     desc("closed_by_remote_total", "Number of connections cleanly closed by their remote."),
+		readErrors:         desc("read_errors_total", "Number of connections removed after a read error."),
+		stunDecodeFailures: desc("stun_decode_failures_total", "Number of connections whose first packet wasn't a valid STUN message."),
+		nonBindingMessages: desc("non_binding_messages_total", "Number of connections whose first STUN message wasn't a binding message."),
+		missingUsernames:   desc("missing_usernames_total", "Number of connections whose first STUN message had no USERNAME."),
+		invalidUfrags:      desc("invalid_ufrags_total", "Number of connections rejected because of an invalid ufrag."),
+		pausedConns:        desc("paused_conns_total", "Number of connections closed because the mux was paused."),
+		recvQueueLen:       desc("recv_queue_len", "Number of received packets waiting to be read."),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *TCPMuxCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.acceptedConns
+	ch <- c.acceptErrors
+	ch <- c.liveConns
+	ch <- c.packetsRead
+	ch <- c.bytesRead
+	ch <- c.packetsWritten
+	ch <- c.bytesWritten
+	ch <- c.droppedWrites
+	ch <- c.closedByRemote
+	ch <- c.readErrors
+	ch <- c.stunDecodeFailures
+	ch <- c.nonBindingMessages
+	ch <- c.missingUsernames
+	ch <- c.invalidUfrags
+	ch <- c.pausedConns
+	ch <- c.recvQueueLen
+}
+
+// Collect implements prometheus.Collector.
+func (c *TCPMuxCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.mux.Stats()
+
+	counter := func(desc *prometheus.Desc, v uint64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v))
+	}
+	gauge := func(desc *prometheus.Desc, v int) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(v))
+	}
+
+	counter(c.acceptedConns, stats.AcceptedConns)
+	counter(c.acceptErrors, stats.AcceptErrors)
+	gauge(c.liveConns, stats.LiveConns)
+	counter(c.packetsRead, stats.PacketsRead)
+	counter(c.bytesRead, stats.BytesRead)
+	counter(c.packetsWritten, stats.PacketsWritten)
+	counter(c.bytesWritten, stats.BytesWritten)
+	counter(c.droppedWrites, stats.DroppedWrites)
+	counter(c.closedByRemote, stats.ClosedByRemote)
+	counter(c.readErrors, stats.ReadErrors)
+	counter(c.stunDecodeFailures, stats.STUNDecodeFailures)
+	counter(c.nonBindingMessages, stats.NonBindingMessages)
+	counter(c.missingUsernames, stats.MissingUsernames)
+	counter(c.invalidUfrags, stats.InvalidUfrags)
+	counter(c.pausedConns, stats.PausedConns)
+	gauge(c.recvQueueLen, stats.RecvQueueLen)
+}
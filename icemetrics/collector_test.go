@@ -0,0 +1,48 @@
+package icemetrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pion/ice/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type staticStats ice.TCPMuxStats
+
+func (s staticStats) Stats() ice.TCPMuxStats {
+	return ice.TCPMuxStats(s)
+}
+
+func TestTCPMuxCollector(t *testing.T) {
+	collector := NewTCPMuxCollector(staticStats{
+		AcceptedConns: 3,
+		LiveConns:     2,
+		BytesRead:     100,
+		RecvQueueLen:  1,
+	}, prometheus.Labels{"mux": "test"})
+
+	expected := `
+# HELP ice_tcp_mux_accepted_conns_total Number of connections accepted from the listener.
+# TYPE ice_tcp_mux_accepted_conns_total counter
+ice_tcp_mux_accepted_conns_total{mux="test"} 3
+# HELP ice_tcp_mux_bytes_read_total Number of payload bytes read from connections.
+# TYPE ice_tcp_mux_bytes_read_total counter
+ice_tcp_mux_bytes_read_total{mux="test"} 100
+# HELP ice_tcp_mux_live_conns Number of connections currently routed to a ufrag.
+# TYPE ice_tcp_mux_live_conns gauge
+ice_tcp_mux_live_conns{mux="test"} 2
+# HELP ice_tcp_mux_recv_queue_len Number of received packets waiting to be read.
+# TYPE ice_tcp_mux_recv_queue_len gauge
+ice_tcp_mux_recv_queue_len{mux="test"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"ice_tcp_mux_accepted_conns_total",
+		"ice_tcp_mux_bytes_read_total",
+		"ice_tcp_mux_live_conns",
+		"ice_tcp_mux_recv_queue_len",
+	))
+	assert.Equal(t, 16, testutil.CollectAndCount(collector))
+}
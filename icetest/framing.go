@@ -0,0 +1,44 @@
+package icetest
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// errPacketTooLarge is returned by WritePacket for packets that don't fit the
+// 2-byte length header.
+var errPacketTooLarge = errors.New("packet is larger than 65535 bytes")
+
+// WritePacket writes pkt to w framed as on an ICE-TCP connection, prefixed by
+// its length as a 2-byte big-endian header as specified by RFC 4571. Writing
+// to a connection dialed on a PipeListener lets a test act as an ICE-TCP
+// client.
+func WritePacket(w io.Writer, pkt []byte) error {
+	if len(pkt) > math.MaxUint16 {
+		return errPacketTooLarge
+	}
+
+	frame := make([]byte, 2+len(pkt))
+	binary.BigEndian.PutUint16(frame, uint16(len(pkt)))
+	copy(frame[2:], pkt)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadPacket reads one packet framed by WritePacket from r.
+func ReadPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	pkt := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(r, pkt); err != nil {
+		return nil, err
+	}
+
+	return pkt, nil
+}
@@ -0,0 +1,178 @@
+package icetest
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// PacketConnPeer is the remote end of a net.PacketConn under test.
+type PacketConnPeer interface {
+	// Addr is the address the net.PacketConn sees the peer at.
+	Addr() net.Addr
+	// Send sends pkt to the net.PacketConn.
+	Send(pkt []byte) error
+	// Receive returns the next packet the net.PacketConn wrote to Addr.
+	Receive() ([]byte, error)
+	// Close disconnects the peer.
+	Close() error
+}
+
+// MakePacketConn creates a net.PacketConn to test and a peer connected to it.
+type MakePacketConn func() (net.PacketConn, PacketConnPeer, error)
+
+// PacketConnOptions selects the optional behaviors checked by TestPacketConn.
+type PacketConnOptions struct {
+	// ReadDeadline is set if the net.PacketConn enforces read deadlines.
+	// Otherwise the deadline methods are only expected to return nil.
+	ReadDeadline bool
+}
+
+// TestPacketConn checks that the net.PacketConns made by mp behave as
+// expected by ICE:
+//
+//   - ReadFrom returns each packet sent by a peer whole, in order, with the
+//     address of the peer.
+//   - WriteTo to the address of a peer sends it the packet whole and returns
+//     its length.
+//   - SetDeadline, SetReadDeadline and SetWriteDeadline return nil. With
+//     ReadDeadline, a ReadFrom past the read deadline fails with a net.Error
+//     whose Timeout is true, and clearing the deadline allows reading again.
+//   - Close unblocks a pending ReadFrom with an error, and ReadFrom and
+//     WriteTo fail once closed. Calling Close again doesn't panic.
+//
+// Every check runs as a subtest on a new net.PacketConn and peer, both closed
+// at its end.
+func TestPacketConn(t *testing.T, mp MakePacketConn, opts PacketConnOptions) {
+	t.Helper()
+
+	run := func(name string, check func(t *testing.T, conn net.PacketConn, peer PacketConnPeer)) {
+		t.Run(name, func(t *testing.T) {
+			conn, peer, err := mp()
+			if err != nil {
+				t.Fatalf("failed to make PacketConn: %v", err)
+			}
+			defer func() {
+				_ = peer.Close()
+				_ = conn.Close()
+			}()
+
+			check(t, conn, peer)
+		})
+	}
+
+	run("ReadFrom", func(t *testing.T, conn net.PacketConn, peer PacketConnPeer) {
+		pkts := [][]byte{[]byte("first"), []byte("second packet"), []byte("third")}
+		go func() {
+			for _, pkt := range pkts {
+				if err := peer.Send(pkt); err != nil {
+					return
+				}
+			}
+		}()
+
+		buf := make([]byte, 1500)
+		for _, pkt := range pkts {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("ReadFrom failed: %v", err)
+			}
+			if !bytes.Equal(pkt, buf[:n]) {
+				t.Errorf("ReadFrom returned %q, expected %q", buf[:n], pkt)
+			}
+			if addr == nil || addr.String() != peer.Addr().String() {
+				t.Errorf("ReadFrom returned address %v, expected %v", addr, peer.Addr())
+			}
+		}
+	})
+
+	run("WriteTo", func(t *testing.T, conn net.PacketConn, peer PacketConnPeer) {
+		pkt := []byte("hello")
+		type result struct {
+			n   int
+			err error
+		}
+		written := make(chan result, 1)
+		go func() {
+			n, err := conn.WriteTo(pkt, peer.Addr())
+			written <- result{n, err}
+		}()
+
+		received, err := peer.Receive()
+		if err != nil {
+			t.Fatalf("Receive failed: %v", err)
+		}
+		if !bytes.Equal(pkt, received) {
+			t.Errorf("peer received %q, expected %q", received, pkt)
+		}
+
+		res := <-written
+		if res.err != nil {
+			t.Fatalf("WriteTo failed: %v", res.err)
+		}
+		if res.n != len(pkt) {
+			t.Errorf("WriteTo returned %d, expected %d", res.n, len(pkt))
+		}
+	})
+
+	run("Deadlines", func(t *testing.T, conn net.PacketConn, peer PacketConnPeer) {
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			t.Errorf("SetDeadline failed: %v", err)
+		}
+		if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+			t.Errorf("SetWriteDeadline failed: %v", err)
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(-time.Second)); err != nil {
+			t.Errorf("SetReadDeadline failed: %v", err)
+		}
+		if !opts.ReadDeadline {
+			return
+		}
+
+		var netErr net.Error
+		if _, _, err := conn.ReadFrom(make([]byte, 1500)); !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatalf("ReadFrom past the deadline returned %v, expected a timeout", err)
+		}
+
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			t.Fatalf("SetReadDeadline failed: %v", err)
+		}
+		go func() {
+			_ = peer.Send([]byte("hello"))
+		}()
+		if _, _, err := conn.ReadFrom(make([]byte, 1500)); err != nil {
+			t.Errorf("ReadFrom after clearing the deadline failed: %v", err)
+		}
+	})
+
+	run("Close", func(t *testing.T, conn net.PacketConn, peer PacketConnPeer) {
+		read := make(chan error, 1)
+		go func() {
+			_, _, err := conn.ReadFrom(make([]byte, 1500))
+			read <- err
+		}()
+
+		// Give ReadFrom a chance to block before closing.
+		time.Sleep(10 * time.Millisecond)
+		_ = conn.Close()
+
+		select {
+		case err := <-read:
+			if err == nil {
+				t.Error("pending ReadFrom returned no error after Close")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Close didn't unblock a pending ReadFrom")
+		}
+
+		if _, _, err := conn.ReadFrom(make([]byte, 1500)); err == nil {
+			t.Error("ReadFrom after Close returned no error")
+		}
+		if _, err := conn.WriteTo([]byte("hello"), peer.Addr()); err == nil {
+			t.Error("WriteTo after Close returned no error")
+		}
+		_ = conn.Close()
+	})
+}
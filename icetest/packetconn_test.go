@@ -0,0 +1,50 @@
+package icetest
+
+import (
+	"net"
+	"testing"
+)
+
+// udpPeer is a PacketConnPeer over UDP.
+type udpPeer struct {
+	conn   *net.UDPConn
+	remote net.Addr
+}
+
+func (p *udpPeer) Addr() net.Addr {
+	return p.conn.LocalAddr()
+}
+
+func (p *udpPeer) Send(pkt []byte) error {
+	_, err := p.conn.WriteTo(pkt, p.remote)
+	return err
+}
+
+func (p *udpPeer) Receive() ([]byte, error) {
+	buf := make([]byte, 1500)
+	n, _, err := p.conn.ReadFrom(buf)
+	return buf[:n], err
+}
+
+func (p *udpPeer) Close() error {
+	return p.conn.Close()
+}
+
+func TestTestPacketConn(t *testing.T) {
+	loopback := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}
+
+	TestPacketConn(t, func() (net.PacketConn, PacketConnPeer, error) {
+		conn, err := net.ListenUDP("udp4", loopback)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		peer, err := net.ListenUDP("udp4", loopback)
+		if err != nil {
+			_ = conn.Close()
+			return nil, nil, err
+		}
+
+		return conn, &udpPeer{conn: peer, remote: conn.LocalAddr()}, nil
+	}, PacketConnOptions{ReadDeadline: true})
+}
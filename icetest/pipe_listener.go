@@ -0,0 +1,99 @@
+// Package icetest provides helpers for testing code built on top of ice.
+package icetest
+
+import (
+	"net"
+	"sync"
+)
+
+// PipeListener is a net.Listener whose connections are created in memory by
+// Dial with net.Pipe. It allows tests to feed crafted bytes to a listener
+// consumer such as ice.TCPMuxDefault deterministically, without binding a
+// real port. Both ends of a connection report TCP addresses so they are
+// routed like real TCP connections.
+type PipeListener struct {
+	addr *net.TCPAddr
+
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	nextPort int
+}
+
+// NewPipeListener creates a PipeListener listening on 127.0.0.1:3478.
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		addr:     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3478},
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+		nextPort: 49152,
+	}
+}
+
+// Accept waits for and returns the next connection created by Dial.
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+// Close stops the listener. Connections that were already accepted are not
+// closed.
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr returns the address of the listener.
+func (l *PipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Dial connects to the listener from a loopback address with a new port and
+// returns the client end of the connection. It blocks until the connection is
+// accepted.
+func (l *PipeListener) Dial() (net.Conn, error) {
+	l.mu.Lock()
+	port := l.nextPort
+	l.nextPort++
+	l.mu.Unlock()
+
+	return l.DialAddr(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+}
+
+// DialAddr connects to the listener as if from laddr and returns the client
+// end of the connection. It blocks until the connection is accepted.
+func (l *PipeListener) DialAddr(laddr net.Addr) (net.Conn, error) {
+	client, server := net.Pipe()
+	serverConn := &pipeConn{Conn: server, local: l.addr, remote: laddr}
+
+	select {
+	case l.conns <- serverConn:
+		return &pipeConn{Conn: client, local: laddr, remote: l.addr}, nil
+	case <-l.closed:
+		_ = client.Close()
+		_ = server.Close()
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+// pipeConn is a net.Pipe end reporting TCP addresses.
+type pipeConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,85 @@
+package icetest
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeListener(t *testing.T) {
+	l := NewPipeListener()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+
+	client, err := l.Dial()
+	require.NoError(t, err)
+	server := <-accepted
+
+	assert.Equal(t, l.Addr(), client.RemoteAddr())
+	assert.Equal(t, client.LocalAddr(), server.RemoteAddr())
+	assert.Equal(t, server.LocalAddr(), client.RemoteAddr())
+
+	go func() {
+		_, err := client.Write([]byte("hello"))
+		assert.NoError(t, err)
+	}()
+	buf := make([]byte, 5)
+	_, err = server.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), buf)
+
+	assert.NoError(t, client.Close())
+	assert.NoError(t, server.Close())
+
+	assert.NoError(t, l.Close())
+	_, err = l.Accept()
+	assert.True(t, errors.Is(err, net.ErrClosed))
+	_, err = l.Dial()
+	assert.True(t, errors.Is(err, net.ErrClosed))
+}
+
+func TestWriteReadPacket(t *testing.T) {
+	l := NewPipeListener()
+	defer func() {
+		assert.NoError(t, l.Close())
+	}()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+
+	client, err := l.Dial()
+	require.NoError(t, err)
+	server := <-accepted
+
+	go func() {
+		assert.NoError(t, WritePacket(client, []byte("hello")))
+		assert.NoError(t, WritePacket(client, []byte{}))
+	}()
+
+	pkt, err := ReadPacket(server)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), pkt)
+
+	pkt, err = ReadPacket(server)
+	require.NoError(t, err)
+	assert.Empty(t, pkt)
+
+	assert.ErrorIs(t, WritePacket(client, make([]byte, 1<<16)), errPacketTooLarge)
+
+	assert.NoError(t, client.Close())
+	_, err = ReadPacket(server)
+	assert.Error(t, err)
+	assert.NoError(t, server.Close())
+}
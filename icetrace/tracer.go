@@ -0,0 +1,55 @@
+// Package icetrace records the handshakes of ice types as OpenTelemetry
+// spans. It lives in its own package so that the ice package itself doesn't
+// depend on OpenTelemetry.
+package icetrace
+
+import (
+	"context"
+	"net"
+
+	"github.com/pion/ice/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HandshakeSpanName is the name of the spans recorded by HandshakeTracer.
+const HandshakeSpanName = "ice.TCPMux.handleConn"
+
+// HandshakeTracer is an ice.HandshakeTracer recording a span for every
+// handshake, with the remote address, the ufrag and the result as
+// attributes.
+type HandshakeTracer struct {
+	tracer trace.Tracer
+}
+
+var _ ice.HandshakeTracer = (*HandshakeTracer)(nil)
+
+// NewHandshakeTracer creates a HandshakeTracer starting its spans with
+// tracer.
+func NewHandshakeTracer(tracer trace.Tracer) *HandshakeTracer {
+	return &HandshakeTracer{tracer: tracer}
+}
+
+// StartHandshake implements ice.HandshakeTracer.
+func (t *HandshakeTracer) StartHandshake(conn net.Conn) func(ufrag string, err error) {
+	_, span := t.tracer.Start(context.Background(), HandshakeSpanName,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("net.peer.addr", conn.RemoteAddr().String())),
+	)
+
+	return func(ufrag string, err error) {
+		if ufrag != "" {
+			span.SetAttributes(attribute.String("ice.ufrag", ufrag))
+		}
+
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			span.SetStatus(codes.Ok, "")
+		}
+
+		span.End()
+	}
+}
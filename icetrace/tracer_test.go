@@ -0,0 +1,52 @@
+package icetrace
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// addrConn is a net.Conn reporting remote as its remote address.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestHandshakeTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := NewHandshakeTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("ice"))
+
+	conn := addrConn{remote: &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000}}
+
+	end := tracer.StartHandshake(conn)
+	assert.Empty(t, recorder.Ended())
+	end("myufrag", nil)
+
+	end = tracer.StartHandshake(conn)
+	end("", errors.New("not stun"))
+
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+
+	assert.Equal(t, HandshakeSpanName, spans[0].Name())
+	assert.Equal(t, codes.Ok, spans[0].Status().Code)
+	assert.Contains(t, spans[0].Attributes(), attribute.String("ice.ufrag", "myufrag"))
+	assert.Contains(t, spans[0].Attributes(), attribute.String("net.peer.addr", "10.0.0.1:5000"))
+
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+	for _, attr := range spans[1].Attributes() {
+		assert.NotEqual(t, attribute.Key("ice.ufrag"), attr.Key)
+	}
+}
@@ -0,0 +1,63 @@
+package ice
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/logging"
+)
+
+// prefixedLogger is a logging.LeveledLogger that prepends a fixed prefix to
+// every message, used to tag log lines with connection context.
+type prefixedLogger struct {
+	logging.LeveledLogger
+	prefix string
+}
+
+// withLogFields returns a logger prefixing every message with the given
+// key-value pairs as "key=value ". Connection log lines are formatted as
+//
+//	ufrag=<ufrag> remote=<addr> event=<event>: <details>
+//
+// so that a log aggregator can parse them, fields not known yet are omitted.
+func withLogFields(logger logging.LeveledLogger, keyvals ...string) logging.LeveledLogger {
+	var prefix strings.Builder
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(&prefix, "%s=%s ", keyvals[i], keyvals[i+1])
+	}
+
+	return newPrefixedLogger(logger, prefix.String())
+}
+
+func newPrefixedLogger(logger logging.LeveledLogger, prefix string) logging.LeveledLogger {
+	return &prefixedLogger{
+		LeveledLogger: logger,
+		prefix:        prefix,
+	}
+}
+
+func (l *prefixedLogger) Trace(msg string) { l.LeveledLogger.Trace(l.prefix + msg) }
+func (l *prefixedLogger) Debug(msg string) { l.LeveledLogger.Debug(l.prefix + msg) }
+func (l *prefixedLogger) Info(msg string)  { l.LeveledLogger.Info(l.prefix + msg) }
+func (l *prefixedLogger) Warn(msg string)  { l.LeveledLogger.Warn(l.prefix + msg) }
+func (l *prefixedLogger) Error(msg string) { l.LeveledLogger.Error(l.prefix + msg) }
+
+func (l *prefixedLogger) Tracef(format string, args ...interface{}) {
+	l.LeveledLogger.Trace(l.prefix + fmt.Sprintf(format, args...))
+}
+
+func (l *prefixedLogger) Debugf(format string, args ...interface{}) {
+	l.LeveledLogger.Debug(l.prefix + fmt.Sprintf(format, args...))
+}
+
+func (l *prefixedLogger) Infof(format string, args ...interface{}) {
+	l.LeveledLogger.Info(l.prefix + fmt.Sprintf(format, args...))
+}
+
+func (l *prefixedLogger) Warnf(format string, args ...interface{}) {
+	l.LeveledLogger.Warn(l.prefix + fmt.Sprintf(format, args...))
+}
+
+func (l *prefixedLogger) Errorf(format string, args ...interface{}) {
+	l.LeveledLogger.Error(l.prefix + fmt.Sprintf(format, args...))
+}
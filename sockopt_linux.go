@@ -0,0 +1,83 @@
+//go:build linux
+// +build linux
+
+package ice
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDSCP marks the packets sent on conn with the given DSCP value using
+// IP_TOS or IPV6_TCLASS depending on the address family.
+func setDSCP(conn *net.TCPConn, dscp int) error {
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, opt, dscp<<2)
+	}); err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+// setKeepAliveInterval sets the time between keepalive probes on conn.
+func setKeepAliveInterval(conn *net.TCPConn, interval time.Duration) error {
+	secs := int((interval + time.Second - 1) / time.Second)
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs)
+	}); err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+// setFastOpenConnect enables TCP Fast Open on the unconnected socket fd: the
+// connect returns right away and the data of the first write is sent in the
+// SYN. The kernel falls back to a regular handshake if the remote doesn't
+// support it. It requires Linux 4.11 or later.
+func setFastOpenConnect(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+}
+
+// tcpRTT returns the smoothed round-trip time of conn from TCP_INFO.
+func tcpRTT(conn *net.TCPConn) (time.Duration, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var info *unix.TCPInfo
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}); err != nil {
+		return 0, err
+	}
+	if sockErr != nil {
+		return 0, sockErr
+	}
+
+	return time.Duration(info.Rtt) * time.Microsecond, nil
+}
@@ -0,0 +1,246 @@
+//go:build linux
+// +build linux
+
+package ice
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// clearedNoDelayListener accepts conns with TCP_NODELAY cleared, which Go
+// sets by default, optionally hiding their *net.TCPConn type. The accepted
+// conns are sent to accepted.
+type clearedNoDelayListener struct {
+	*net.TCPListener
+	wrap     bool
+	accepted chan *net.TCPConn
+}
+
+// wrappedConn hides the type of its conn.
+type wrappedConn struct {
+	net.Conn
+}
+
+func (l *clearedNoDelayListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetNoDelay(false); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	l.accepted <- conn
+	if l.wrap {
+		return wrappedConn{conn}, nil
+	}
+	return conn, nil
+}
+
+func TestTCPMux_NoDelay(t *testing.T) {
+	enabled, disabled := true, false
+	for name, tc := range map[string]struct {
+		noDelay  *bool
+		wrap     bool
+		expected int
+	}{
+		"default":  {nil, false, 1},
+		"enabled":  {&enabled, false, 1},
+		"disabled": {&disabled, false, 0},
+		// Conns that aren't *net.TCPConn are left as accepted.
+		"not TCPConn": {nil, true, 0},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			report := test.CheckRoutines(t)
+			defer report()
+
+			listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+			require.NoError(t, err)
+
+			accepted := make(chan *net.TCPConn, 1)
+			tcpMux := NewTCPMuxDefault(TCPMuxParams{
+				Listener:       &clearedNoDelayListener{TCPListener: listener, wrap: tc.wrap, accepted: accepted},
+				Logger:         logging.NewDefaultLoggerFactory().NewLogger("ice"),
+				ReadBufferSize: 20,
+				NoDelay:        tc.noDelay,
+			})
+
+			pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+			require.NoError(t, err)
+
+			// The conn is configured before it is routed.
+			dialTestTCPMux(t, tcpMux, "myufrag")
+			_, _, err = pktConn.ReadFrom(make([]byte, receiveMTU))
+			require.NoError(t, err)
+
+			rawConn, err := (<-accepted).SyscallConn()
+			require.NoError(t, err)
+			require.NoError(t, rawConn.Control(func(fd uintptr) {
+				val, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.expected, val)
+			}))
+
+			require.NoError(t, tcpMux.Close())
+		})
+	}
+}
+
+func TestTCPMux_DSCP(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	const dscp = 46 // Expedited Forwarding
+	tos := make(chan int, 1)
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{
+		DSCP: dscp,
+		ConnControl: func(conn net.Conn) error {
+			rawConn, err := conn.(*net.TCPConn).SyscallConn()
+			require.NoError(t, err)
+
+			require.NoError(t, rawConn.Control(func(fd uintptr) {
+				val, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+				assert.NoError(t, err)
+				tos <- val
+			}))
+			return nil
+		},
+	})
+
+	dialTestTCPMux(t, tcpMux, "myufrag")
+	assert.Equal(t, dscp<<2, <-tos)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_KeepAlive(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	type keepAlive struct {
+		enabled, idle, interval int
+	}
+	opts := make(chan keepAlive, 1)
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{
+		KeepAliveIdle:     30 * time.Second,
+		KeepAliveInterval: 5 * time.Second,
+		ConnControl: func(conn net.Conn) error {
+			rawConn, err := conn.(*net.TCPConn).SyscallConn()
+			require.NoError(t, err)
+
+			require.NoError(t, rawConn.Control(func(fd uintptr) {
+				var ka keepAlive
+				var err error
+				ka.enabled, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+				assert.NoError(t, err)
+				ka.idle, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+				assert.NoError(t, err)
+				ka.interval, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+				assert.NoError(t, err)
+				opts <- ka
+			}))
+			return nil
+		},
+	})
+
+	dialTestTCPMux(t, tcpMux, "myufrag")
+	assert.Equal(t, keepAlive{enabled: 1, idle: 30, interval: 5}, <-opts)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_TCPFastOpen(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	remote, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer func() {
+		_ = remote.Close()
+	}()
+
+	controlled := make(chan struct{}, 1)
+	tcpMux := newTestTCPMux(t, TCPMuxParams{
+		TCPFastOpen: true,
+		Dialer: &net.Dialer{
+			Control: func(network, address string, c syscall.RawConn) error {
+				controlled <- struct{}{}
+				return nil
+			},
+		},
+	})
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := remote.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+
+	pktConn, raddr, err := tcpMux.DialUfrag("myufrag", []net.Addr{remote.Addr()})
+	require.NoError(t, err)
+	<-controlled
+
+	conn, ok := pktConn.(*tcpPacketConn).Conn(raddr)
+	require.True(t, ok)
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	require.NoError(t, rawConn.Control(func(fd uintptr) {
+		val, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, val)
+	}))
+
+	// The first packet makes it through whether or not it rode in the SYN.
+	_, err = pktConn.WriteTo([]byte("hello"), raddr)
+	require.NoError(t, err)
+
+	remoteConn := <-accepted
+	defer func() {
+		_ = remoteConn.Close()
+	}()
+
+	buf := make([]byte, receiveMTU)
+	n, err := readStreamingPacket(remoteConn, buf, streamingPacketHeaderLen)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), buf[:n])
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPPacketConn_RTT(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+	conn, _ := dialTestTCPMux(t, tcpMux, "myufrag")
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+
+	_, raddr, err := pktConn.ReadFrom(make([]byte, receiveMTU))
+	require.NoError(t, err)
+	assert.Equal(t, conn.LocalAddr().String(), raddr.String())
+
+	rtt, err := pktConn.(*tcpPacketConn).RTT(raddr)
+	require.NoError(t, err)
+	assert.Less(t, rtt, time.Second)
+
+	_, err = pktConn.(*tcpPacketConn).RTT(&net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000})
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	require.NoError(t, tcpMux.Close())
+}
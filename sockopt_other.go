@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package ice
+
+import (
+	"net"
+	"time"
+)
+
+func setDSCP(*net.TCPConn, int) error {
+	return errSocketOptionUnsupported
+}
+
+func setKeepAliveInterval(*net.TCPConn, time.Duration) error {
+	return errSocketOptionUnsupported
+}
+
+func setFastOpenConnect(uintptr) error {
+	return errSocketOptionUnsupported
+}
+
+func tcpRTT(*net.TCPConn) (time.Duration, error) {
+	return 0, ErrUnsupported
+}
@@ -175,3 +175,126 @@ type CandidateStats struct {
 	// Only defined for local candidates. For remote candidates, this property is not applicable.
 	Deleted bool
 }
+
+// TCPMuxStats contains counters describing the activity of a TCPMuxDefault.
+type TCPMuxStats struct {
+	// AcceptedConns is the number of connections accepted from the listener.
+	AcceptedConns uint64
+
+	// AcceptErrors is the number of errors returned by the Accept of the
+	// listeners, other than those closed by Close or SwapListener, and
+	// LastAcceptError the last of them, returned at LastAcceptErrorAt. An
+	// error, such as running out of file descriptors, stops accepting
+	// connections on its listener, see TCPMuxDefault.Healthy, so more than
+	// one is only counted across listeners swapped in after a failure.
+	AcceptErrors      uint64
+	LastAcceptError   error
+	LastAcceptErrorAt time.Time
+
+	// RateLimitedConns is the number of accepted connections that were
+	// closed because MaxAcceptsPerSecond was exceeded.
+	RateLimitedConns uint64
+
+	// STUNDecodeFailures is the number of connections rejected because their
+	// first packet couldn't be decoded as a STUN message.
+	STUNDecodeFailures uint64
+
+	// NonBindingMessages is the number of connections rejected because their
+	// first packet was a STUN message of another method than binding, unless
+	// TCPMuxParams.RouteAnySTUNMessage is set.
+	NonBindingMessages uint64
+
+	// MissingUsernames is the number of connections rejected because their
+	// first STUN message had no USERNAME to route them with.
+	MissingUsernames uint64
+
+	// InvalidUfrags is the number of connections rejected because their ufrag
+	// was empty or, with TCPMuxParams.StrictUfrag, malformed.
+	InvalidUfrags uint64
+
+	// PausedConns is the number of accepted connections that were closed
+	// because the mux was paused.
+	PausedConns uint64
+
+	// LiveConns is the number of connections currently routed to a ufrag.
+	LiveConns int
+
+	// PacketsRead and BytesRead count the packets read from connections and
+	// their payload size, excluding framing.
+	PacketsRead uint64
+	BytesRead   uint64
+
+	// PacketsWritten and BytesWritten count the packets written to
+	// connections, or queued in their write buffer, and their payload size,
+	// excluding framing.
+	PacketsWritten uint64
+	BytesWritten   uint64
+
+	// DroppedWrites is the number of packets dropped because the write buffer
+	// of their connection was full.
+	DroppedWrites uint64
+
+	// ClosedByRemote is the number of connections the remote closed cleanly,
+	// between packets, and ReadErrors the number of connections removed
+	// after any other read error, such as a reset or a truncated packet.
+	// Connections closed by the mux count in neither.
+	ClosedByRemote uint64
+	ReadErrors     uint64
+
+	// RecvQueueLen is the number of received packets currently waiting to be
+	// read with ReadFrom, across all ufrags.
+	RecvQueueLen int
+
+	// ConnsByServerName is the number of connections routed per TLS server
+	// name, for *tls.Conn connections whose client sent one. It is nil if
+	// there were none.
+	ConnsByServerName map[string]uint64
+}
+
+// TCPMuxRuntimeStats contains the handshake timings and goroutine counts of
+// a TCPMuxDefault. The handshake of a connection lasts from its accept until
+// it is routed to its ufrag, including reading and decoding its first packet.
+type TCPMuxRuntimeStats struct {
+	// Handshakes is the number of connections routed, and HandshakeTotal,
+	// HandshakeMin and HandshakeMax the total, shortest and longest time
+	// their handshake took. Rejected connections aren't counted.
+	Handshakes     uint64
+	HandshakeTotal time.Duration
+	HandshakeMin   time.Duration
+	HandshakeMax   time.Duration
+
+	// ActiveHandshakes is the number of connections currently in their
+	// handshake, each handled by a goroutine.
+	ActiveHandshakes int
+
+	// ReaderGoroutines is the number of goroutines currently reading routed
+	// connections, one per connection.
+	ReaderGoroutines int
+}
+
+// HandshakeAvg returns the average time of a handshake, or 0 if none was
+// recorded.
+func (s TCPMuxRuntimeStats) HandshakeAvg() time.Duration {
+	if s.Handshakes == 0 {
+		return 0
+	}
+	return s.HandshakeTotal / time.Duration(s.Handshakes)
+}
+
+// TCPMuxUfragStats contains statistics about the connections of a ufrag in a
+// TCPMuxDefault.
+type TCPMuxUfragStats struct {
+	// WriteBufferedBytes is the number of bytes currently queued in the write
+	// buffers of the connections.
+	WriteBufferedBytes int
+
+	// WriteBufferHighWatermark is the largest number of bytes ever queued at
+	// once in the write buffer of any of the connections.
+	WriteBufferHighWatermark int
+
+	// RecvQueueLen is the number of received packets waiting to be read, and
+	// RecvQueueCap the number of packets that can be queued before the
+	// connections stop being read.
+	RecvQueueLen int
+	RecvQueueCap int
+}
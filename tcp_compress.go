@@ -0,0 +1,147 @@
+package ice
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Frames are compressed when CompressFrames is set. The payload of each frame
+// starts with a byte telling how the packet that follows is encoded:
+// compressedFrameDeflate for a packet compressed with DEFLATE,
+// compressedFrameStored for a packet that doesn't shrink and is sent as is.
+// Neither byte starts a packet demultiplexed by RFC 7983, nor a fragment, so
+// a peer without compression drops the frames as unknown packets, and a peer
+// with it rejects the frames of a peer without.
+const (
+	compressedFrameDeflate   = 0xFE
+	compressedFrameStored    = 0xFD
+	compressedFrameHeaderLen = 1
+)
+
+var (
+	// Packets are compressed with BestSpeed, most of the gain on the
+	// redundant packets worth compressing is had at the lowest CPU cost.
+	flateWriterPool = sync.Pool{ //nolint:gochecknoglobals
+		New: func() interface{} {
+			w, _ := flate.NewWriter(io.Discard, flate.BestSpeed)
+			return w
+		},
+	}
+	flateReaderPool = sync.Pool{ //nolint:gochecknoglobals
+		New: func() interface{} {
+			return flate.NewReader(bytes.NewReader(nil))
+		},
+	}
+	compressedFramePool = sync.Pool{ //nolint:gochecknoglobals
+		New: func() interface{} {
+			buf := make([]byte, compressedFrameHeaderLen+receiveMTU)
+			return &buf
+		},
+	}
+)
+
+// compressedFrameCodec compresses the packets framed by codec. Each packet is
+// compressed on its own, so that frames can be read independently and a
+// packet never waits for the next one to be sent.
+type compressedFrameCodec struct {
+	codec FrameCodec
+}
+
+func (c compressedFrameCodec) ReadFrame(conn net.Conn, buf []byte) (int, error) {
+	// A frame is at most a header larger than the packet it carries.
+	pooled := compressedFramePool.Get().(*[]byte) //nolint:forcetypeassert
+	defer compressedFramePool.Put(pooled)
+	frame := *pooled
+	if cap(frame) < compressedFrameHeaderLen+len(buf) {
+		frame = make([]byte, compressedFrameHeaderLen+len(buf))
+	}
+	frame = frame[:compressedFrameHeaderLen+len(buf)]
+
+	n, err := c.codec.ReadFrame(conn, frame)
+	if err != nil {
+		return 0, err
+	}
+	if n < compressedFrameHeaderLen {
+		return 0, errInvalidCompressedFrame
+	}
+
+	payload := frame[compressedFrameHeaderLen:n]
+	switch frame[0] {
+	case compressedFrameStored:
+		return copy(buf, payload), nil
+	case compressedFrameDeflate:
+		return inflate(buf, payload)
+	default:
+		return 0, fmt.Errorf("%w: unknown encoding %#x", errInvalidCompressedFrame, frame[0])
+	}
+}
+
+func (c compressedFrameCodec) WriteFrame(conn net.Conn, buf []byte) (int, error) {
+	var frame bytes.Buffer
+	frame.Grow(compressedFrameHeaderLen + len(buf))
+	frame.WriteByte(compressedFrameDeflate)
+
+	w := flateWriterPool.Get().(*flate.Writer) //nolint:forcetypeassert
+	w.Reset(&frame)
+	_, err := w.Write(buf)
+	if err == nil {
+		err = w.Close()
+	}
+	w.Reset(io.Discard)
+	flateWriterPool.Put(w)
+	if err != nil {
+		return 0, err
+	}
+
+	// Packets that don't shrink are stored, so that a frame is never more
+	// than a header larger than its packet.
+	if frame.Len() >= compressedFrameHeaderLen+len(buf) {
+		frame.Reset()
+		frame.WriteByte(compressedFrameStored)
+		frame.Write(buf)
+	}
+
+	if _, err := c.codec.WriteFrame(conn, frame.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return len(buf), nil
+}
+
+// inflate decompresses src into buf and returns the length of the packet,
+// failing with io.ErrShortBuffer if it doesn't fit.
+func inflate(buf, src []byte) (int, error) {
+	r := flateReaderPool.Get().(io.ReadCloser) //nolint:forcetypeassert
+	defer flateReaderPool.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil { //nolint:forcetypeassert
+		return 0, err
+	}
+
+	var n int
+	for {
+		// Once buf is full, the packet must end there.
+		dst := buf[n:]
+		if len(dst) == 0 {
+			var extra [1]byte
+			dst = extra[:]
+		}
+
+		m, err := r.Read(dst)
+		if m > 0 && n == len(buf) {
+			return n, io.ErrShortBuffer
+		}
+		n += m
+
+		switch {
+		case errors.Is(err, io.EOF):
+			return n, nil
+		case err != nil:
+			return 0, wrapError(errInvalidCompressedFrame, err)
+		}
+	}
+}
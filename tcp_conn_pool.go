@@ -0,0 +1,326 @@
+package ice
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// connPool shares the connections dialed by the tcpPacketConns of a mux
+// between all the ufrags writing to the same remote, with
+// TCPMuxParams.ShareDialedConns. A shared connection is read by a single
+// goroutine of the pool, which has the ufrag that has held the connection the
+// longest read each packet through its usual read path, and is closed once
+// the last ufrag releases it.
+type connPool struct {
+	mu     sync.Mutex
+	conns  map[string]*sharedConn
+	closed bool
+
+	// changed is broadcast whenever a member is attached to or leaves a
+	// shared connection, or a shared connection is closed.
+	changed *sync.Cond
+
+	// wg tracks the readers of the shared connections.
+	wg trackedWaitGroup
+}
+
+// sharedConn is a connection of a connPool.
+type sharedConn struct {
+	conn net.Conn
+	key  string
+
+	// members are the handles of the ufrags holding conn, in the order they
+	// acquired it.
+	members []*pooledConn
+
+	// err is the error that stopped the reader, closed whether conn was
+	// closed.
+	err    error
+	closed bool
+
+	closeOnce sync.Once
+	closeErr  error
+
+	// writeMu serializes the writes of the members, along with their write
+	// deadlines.
+	writeMu sync.Mutex
+}
+
+// pooledConn is the handle of a ufrag on a sharedConn. Writes go to the
+// shared connection, and closing it releases the connection.
+type pooledConn struct {
+	net.Conn
+
+	pool   *connPool
+	shared *sharedConn
+
+	// read and fail are set by attach, the first reads and handles the next
+	// packet of the shared connection while this handle is the oldest
+	// member, the second receives the error that stopped the reader.
+	read func(conn net.Conn) error
+	fail func(err error)
+
+	// writeDeadline is the write deadline of this handle, applied to the
+	// shared connection for its writes only. Guarded by shared.writeMu.
+	writeDeadline time.Time
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newConnPool() *connPool {
+	p := &connPool{
+		conns: map[string]*sharedConn{},
+	}
+	p.changed = sync.NewCond(&p.mu)
+
+	return p
+}
+
+// acquire returns a new handle on the connection to key, or nil if there is
+// none. It fails with io.ErrClosedPipe once the pool is closed.
+func (p *connPool) acquire(key string) (*pooledConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, io.ErrClosedPipe
+	}
+
+	sc, ok := p.conns[key]
+	if !ok {
+		return nil, nil
+	}
+	return sc.newMember(p), nil
+}
+
+// share adds conn, freshly dialed, as the connection to key and returns a
+// handle on it. If a connection to key was added concurrently, conn is
+// closed and a handle on the existing connection is returned instead.
+func (p *connPool) share(key string, conn net.Conn) (*pooledConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		_ = conn.Close()
+		return nil, io.ErrClosedPipe
+	}
+
+	if sc, ok := p.conns[key]; ok {
+		_ = conn.Close()
+		return sc.newMember(p), nil
+	}
+
+	sc := &sharedConn{conn: conn, key: key}
+	p.conns[key] = sc
+	pc := sc.newMember(p)
+
+	p.wg.Add(1)
+	go p.readLoop(sc)
+
+	return pc, nil
+}
+
+// close makes acquire and share fail from now on. The shared connections are
+// closed as their ufrags release them, wg is then waited for.
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+}
+
+// readLoop has the oldest member of sc read its packets until reading fails,
+// then reports the error to the members left. The member is picked once the
+// next packet starts arriving, so that it isn't read by a member that left
+// meanwhile. Reading waits while the oldest member isn't attached, as when it
+// migrates to another ufrag, so that its packets aren't handed to another
+// ufrag.
+func (p *connPool) readLoop(sc *sharedConn) {
+	defer p.wg.Done()
+
+	src := newPeekedConn(sc.conn, receiveMTU)
+
+	for {
+		if _, err := src.peek(); err != nil {
+			p.failed(sc, err)
+			return
+		}
+
+		p.mu.Lock()
+		for !sc.closed && (len(sc.members) == 0 || sc.members[0].read == nil) {
+			p.changed.Wait()
+		}
+		if sc.closed {
+			p.mu.Unlock()
+			return
+		}
+		read := sc.members[0].read
+		p.mu.Unlock()
+
+		if err := read(src); err != nil {
+			p.failed(sc, err)
+			return
+		}
+	}
+}
+
+// failed closes sc, whose stream is unusable after err, and reports err to
+// its attached members.
+func (p *connPool) failed(sc *sharedConn, err error) {
+	p.mu.Lock()
+	if p.conns[sc.key] == sc {
+		delete(p.conns, sc.key)
+	}
+	sc.err, sc.closed = err, true
+	var fails []func(error)
+	for _, member := range sc.members {
+		if member.fail != nil {
+			fails = append(fails, member.fail)
+		}
+	}
+	p.changed.Broadcast()
+	p.mu.Unlock()
+
+	_ = sc.closeConn()
+	for _, fail := range fails {
+		fail(err)
+	}
+}
+
+// newMember adds a handle to sc. Must be called with p.mu held.
+func (sc *sharedConn) newMember(p *connPool) *pooledConn {
+	pc := &pooledConn{Conn: sc.conn, pool: p, shared: sc}
+	sc.members = append(sc.members, pc)
+	return pc
+}
+
+// closeConn closes the connection once.
+func (sc *sharedConn) closeConn() error {
+	sc.closeOnce.Do(func() {
+		sc.closeErr = sc.conn.Close()
+	})
+	return sc.closeErr
+}
+
+// attach sets the callbacks of pc, making it eligible to read packets, or
+// detaches it if read is nil. If the reader already failed, fail is called
+// with its error in the background.
+func (pc *pooledConn) attach(read func(conn net.Conn) error, fail func(err error)) {
+	p := pc.pool
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc.read, pc.fail = read, fail
+	p.changed.Broadcast()
+
+	if err := pc.shared.err; err != nil && fail != nil {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			fail(err)
+		}()
+	}
+}
+
+// Write writes b to the shared connection, bounded by the write deadline of
+// pc, without interleaving with the writes of the other members. A write cut
+// short leaves a partial packet in the stream, so the shared connection is
+// then closed for all members.
+func (pc *pooledConn) Write(b []byte) (int, error) {
+	sc := pc.shared
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	if err := sc.conn.SetWriteDeadline(pc.writeDeadline); err != nil {
+		return 0, err
+	}
+
+	n, err := sc.conn.Write(b)
+	if err != nil && n > 0 && n < len(b) {
+		_ = sc.closeConn()
+	}
+
+	return n, err
+}
+
+// SetWriteDeadline sets the deadline of the writes of pc only.
+func (pc *pooledConn) SetWriteDeadline(t time.Time) error {
+	pc.shared.writeMu.Lock()
+	defer pc.shared.writeMu.Unlock()
+
+	pc.writeDeadline = t
+	return nil
+}
+
+// SetDeadline sets the write deadline of pc. The reads of the shared
+// connection are done by its pool, a read deadline doesn't apply to them.
+func (pc *pooledConn) SetDeadline(t time.Time) error {
+	return pc.SetWriteDeadline(t)
+}
+
+// SetReadDeadline is a no-op, see SetDeadline.
+func (pc *pooledConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// Close releases pc, closing the shared connection if it was its last
+// member.
+func (pc *pooledConn) Close() error {
+	pc.closeOnce.Do(func() {
+		p, sc := pc.pool, pc.shared
+
+		p.mu.Lock()
+		for i, member := range sc.members {
+			if member == pc {
+				sc.members = append(sc.members[:i], sc.members[i+1:]...)
+				break
+			}
+		}
+		last := len(sc.members) == 0
+		if last {
+			if p.conns[sc.key] == sc {
+				delete(p.conns, sc.key)
+			}
+			sc.closed = true
+		}
+		p.changed.Broadcast()
+		p.mu.Unlock()
+
+		if last {
+			pc.closeErr = sc.closeConn()
+		}
+	})
+
+	return pc.closeErr
+}
+
+// peekedConn is a conn whose first bytes can be peeked, its reads return them
+// before reading from the conn.
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// newPeekedConn wraps conn to peek up to about frameSize bytes, room is left
+// for the framing header.
+func newPeekedConn(conn net.Conn, frameSize int) *peekedConn {
+	return &peekedConn{Conn: conn, reader: bufio.NewReaderSize(conn, frameSize+streamingPacketHeaderLenExtended)}
+}
+
+// peek waits for the first bytes of the conn and returns those received.
+func (c *peekedConn) peek() ([]byte, error) {
+	if _, err := c.reader.Peek(1); err != nil {
+		return nil, err
+	}
+	return c.reader.Peek(c.reader.Buffered())
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
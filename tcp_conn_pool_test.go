@@ -0,0 +1,105 @@
+package ice
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnPool_ReadPath(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	pool := newConnPool()
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer:         20,
+		Logger:             logging.NewDefaultLoggerFactory().NewLogger("ice"),
+		ReceiveMTU:         2 * receiveMTU,
+		AllowFragmentation: true,
+		ConnPool:           pool,
+	})
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	raddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000}
+	pooled, err := pool.share("tcp4 "+raddr.String(), &addrConn{Conn: local, remote: raddr})
+	require.NoError(t, err)
+	_, err = packetConn.addDialedConn(pooled, raddr)
+	require.NoError(t, err)
+
+	buf := make([]byte, 4*receiveMTU)
+
+	// The receive MTU of the ufrag applies to the shared conn.
+	large := make([]byte, receiveMTU+1000)
+	_, err = writeStreamingPacket(remote, large, streamingPacketHeaderLen)
+	require.NoError(t, err)
+	n, _, err := packetConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, len(large), n)
+
+	// Fragments are reassembled.
+	fragmented := make([]byte, 3*receiveMTU)
+	for i := range fragmented {
+		fragmented[i] = byte(i)
+	}
+	frags, err := fragment(fragmented)
+	require.NoError(t, err)
+	go func() {
+		for _, frag := range frags {
+			_, err := writeStreamingPacket(remote, frag, streamingPacketHeaderLen)
+			assert.NoError(t, err)
+		}
+	}()
+	n, _, err = packetConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, fragmented, buf[:n])
+
+	// No new ufrag can join once the pool is closed.
+	pool.close()
+	_, err = pool.acquire("tcp4 " + raddr.String())
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	assert.NoError(t, packetConn.Close())
+	pool.wg.Wait()
+}
+
+func TestConnPool_WriteDeadlines(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	pool := newConnPool()
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(io.Discard, remote)
+	}()
+
+	pooledA, err := pool.share("key", local)
+	require.NoError(t, err)
+	pooledB, err := pool.acquire("key")
+	require.NoError(t, err)
+
+	// The deadline of a member only bounds its own writes.
+	require.NoError(t, pooledA.SetWriteDeadline(time.Now().Add(-time.Second)))
+	_, err = pooledA.Write([]byte("expired"))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	_, err = pooledB.Write([]byte("not expired"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, pooledA.Close())
+	assert.NoError(t, pooledB.Close())
+	pool.wg.Wait()
+}
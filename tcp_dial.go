@@ -0,0 +1,184 @@
+package ice
+
+import (
+	"context"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pion/logging"
+)
+
+// defaultDialFallbackDelay is the Connection Attempt Delay recommended by
+// RFC 8305.
+const defaultDialFallbackDelay = 250 * time.Millisecond
+
+// fastOpenDialer returns a copy of dialer that enables TCP Fast Open on the
+// sockets it dials, after running the Control or ControlContext function of
+// dialer if any. Where Fast Open is unsupported the sockets are connected as
+// usual and the failure is only logged.
+func fastOpenDialer(dialer *net.Dialer, logger logging.LeveledLogger) *net.Dialer {
+	enable := func(c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			if err := setFastOpenConnect(fd); err != nil {
+				logger.Debugf("event=fast_open_unsupported: %s", err)
+			}
+		})
+	}
+
+	d := *dialer
+	if wrapControlContext(&d, enable) {
+		return &d
+	}
+
+	control := dialer.Control
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return enable(c)
+	}
+
+	return &d
+}
+
+// dialResult is the outcome of one connection attempt of dialHappyEyeballs.
+type dialResult struct {
+	conn  net.Conn
+	index int
+	err   error
+}
+
+// dialHappyEyeballs connects to the first reachable of raddrs following the
+// Happy Eyeballs algorithm of RFC 8305: addresses are tried in an order
+// alternating between address families, starting with the family of the
+// first one, and a new attempt is started every fallbackDelay, or as soon as
+// the previous one fails, while earlier attempts are still running. The first
+// conn established is returned with the index of its address in raddrs, the
+// other attempts are cancelled and their conns closed. If all attempts fail,
+// the error of the first one is returned.
+func dialHappyEyeballs(dialer *net.Dialer, raddrs []net.Addr, fallbackDelay time.Duration) (net.Conn, int, error) {
+	order := interleaveAddrFamilies(raddrs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan dialResult, len(order))
+	next, pending := 0, 0
+
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	start := func() {
+		i := order[next]
+		next++
+		pending++
+
+		network := NetworkTypeTCP4.String()
+		if isIPv6Addr(raddrs[i]) {
+			network = NetworkTypeTCP6.String()
+		}
+
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, raddrs[i].String())
+			results <- dialResult{conn, i, err}
+		}()
+
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.NewTimer(fallbackDelay)
+	}
+
+	var firstErr error
+	for start(); pending > 0; {
+		var fallback <-chan time.Time
+		if next < len(order) {
+			fallback = timer.C
+		}
+
+		select {
+		case <-fallback:
+			start()
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Cancel the losing attempts and wait for them so that none
+				// of their conns is left open.
+				cancel()
+				for ; pending > 0; pending-- {
+					if loser := <-results; loser.conn != nil {
+						_ = loser.conn.Close()
+					}
+				}
+				return res.conn, res.index, nil
+			}
+
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(order) {
+				start()
+			}
+		}
+	}
+
+	return nil, -1, firstErr
+}
+
+// interleaveAddrFamilies returns the indexes of addrs ordered so that
+// address families alternate, starting with the family of addrs[0] and
+// otherwise keeping the order of addrs.
+func interleaveAddrFamilies(addrs []net.Addr) []int {
+	var primary, secondary []int
+	for i, addr := range addrs {
+		if isIPv6Addr(addr) == isIPv6Addr(addrs[0]) {
+			primary = append(primary, i)
+		} else {
+			secondary = append(secondary, i)
+		}
+	}
+
+	order := make([]int, 0, len(addrs))
+	for len(primary) > 0 || len(secondary) > 0 {
+		if len(primary) > 0 {
+			order = append(order, primary[0])
+			primary = primary[1:]
+		}
+		if len(secondary) > 0 {
+			order = append(order, secondary[0])
+			secondary = secondary[1:]
+		}
+	}
+
+	return order
+}
+
+// isIPv6Addr reports whether addr is an IPv6 address. Addresses whose host
+// isn't an IP are considered IPv4.
+func isIPv6Addr(addr net.Addr) bool {
+	ip, err := hostIP(addr)
+	return err == nil && ip != nil && ip.To4() == nil
+}
+
+// hostIP returns the IP of the host of addr, nil if the host isn't an IP. The
+// zone of link-local IPv6 addresses, as in fe80::1%eth0, is ignored.
+func hostIP(addr net.Addr) (net.IP, error) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+
+	return net.ParseIP(host), nil
+}
@@ -0,0 +1,15 @@
+//go:build !go1.20
+// +build !go1.20
+
+package ice
+
+import (
+	"net"
+	"syscall"
+)
+
+// wrapControlContext reports false, net.Dialer has no ControlContext before
+// Go 1.20.
+func wrapControlContext(*net.Dialer, func(syscall.RawConn) error) bool {
+	return false
+}
@@ -0,0 +1,28 @@
+//go:build go1.20
+// +build go1.20
+
+package ice
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// wrapControlContext makes the ControlContext function of d, if set, call
+// enable after it, and reports whether it did. ControlContext takes
+// precedence over Control, so the latter can't be used then.
+func wrapControlContext(d *net.Dialer, enable func(syscall.RawConn) error) bool {
+	control := d.ControlContext
+	if control == nil {
+		return false
+	}
+
+	d.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		if err := control(ctx, network, address, c); err != nil {
+			return err
+		}
+		return enable(c)
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package ice
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterleaveAddrFamilies(t *testing.T) {
+	v4a := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 1}
+	v4b := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 1}
+	v6a := &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 1}
+	v6b := &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 1}
+
+	assert.Equal(t, []int{0, 2, 1, 3}, interleaveAddrFamilies([]net.Addr{v6a, v6b, v4a, v4b}))
+	assert.Equal(t, []int{0, 1, 2, 3}, interleaveAddrFamilies([]net.Addr{v4a, v6a, v4b, v6b}))
+	assert.Equal(t, []int{0, 1}, interleaveAddrFamilies([]net.Addr{v4a, v4b}))
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	// A port nothing listens on anymore, refusing connections.
+	closed, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	closedAddr := closed.Addr()
+	require.NoError(t, closed.Close())
+
+	t.Run("falls back after a failure", func(t *testing.T) {
+		// The failure of the first attempt starts the next one without
+		// waiting for the fallback delay.
+		start := time.Now()
+		conn, i, err := dialHappyEyeballs(&net.Dialer{}, []net.Addr{closedAddr, listener.Addr()}, time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, 1, i)
+		assert.Less(t, time.Since(start), time.Minute)
+		require.NoError(t, conn.Close())
+	})
+
+	t.Run("all attempts fail", func(t *testing.T) {
+		_, i, err := dialHappyEyeballs(&net.Dialer{}, []net.Addr{closedAddr, closedAddr}, time.Millisecond)
+		assert.Error(t, err)
+		assert.Equal(t, -1, i)
+	})
+}
+
+func TestIsIPv6Addr(t *testing.T) {
+	for _, tc := range []struct {
+		addr   net.Addr
+		isIPv6 bool
+	}{
+		{&net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 1}, false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 1, Zone: "eth0"}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 1}, false},
+	} {
+		assert.Equal(t, tc.isIPv6, isIPv6Addr(tc.addr), tc.addr.String())
+	}
+}
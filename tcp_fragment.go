@@ -0,0 +1,105 @@
+package ice
+
+import "fmt"
+
+// Packets larger than a frame can carry are split when AllowFragmentation is
+// set. Each fragment is sent in its own frame, prefixed with a two byte
+// header: fragmentMarker, which no packet demultiplexed by RFC 7983 starts
+// with, and a flags byte with fragmentFirst set on the first fragment and
+// fragmentMore on all fragments but the last. A write failing midway, as on a
+// full write buffer, leaves a packet without its last fragments, which the
+// next first fragment discards. Peers that don't reassemble fragments see
+// them as separate packets, which they drop as unknown.
+const (
+	fragmentMarker    = 0xFF
+	fragmentMore      = 0x01
+	fragmentFirst     = 0x02
+	fragmentHeaderLen = 2
+
+	// maxFragmentPayloadLen keeps each fragment within the receive buffer
+	// of the reader, maxFragmentedPacketLen bounds the reassembled packet.
+	maxFragmentPayloadLen  = receiveMTU - fragmentHeaderLen
+	maxFragmentedPacketLen = 1 << 20
+)
+
+// needsFragmenting returns whether pkt must be sent as fragments: it doesn't
+// fit in a single read, or it starts with fragmentMarker and would be taken
+// for a fragment otherwise.
+func needsFragmenting(pkt []byte) bool {
+	return len(pkt) > receiveMTU || (len(pkt) > 0 && pkt[0] == fragmentMarker)
+}
+
+// fragment splits pkt into fragments with their header.
+func fragment(pkt []byte) ([][]byte, error) {
+	if len(pkt) > maxFragmentedPacketLen {
+		return nil, fmt.Errorf("%w: %d bytes", errStreamingPacketTooLarge, len(pkt))
+	}
+
+	var frags [][]byte
+	for len(frags) == 0 || len(pkt) > 0 {
+		chunk := pkt
+		if len(chunk) > maxFragmentPayloadLen {
+			chunk = chunk[:maxFragmentPayloadLen]
+		}
+		pkt = pkt[len(chunk):]
+
+		frag := make([]byte, fragmentHeaderLen+len(chunk))
+		frag[0] = fragmentMarker
+		if len(frags) == 0 {
+			frag[1] |= fragmentFirst
+		}
+		if len(pkt) > 0 {
+			frag[1] |= fragmentMore
+		}
+		copy(frag[fragmentHeaderLen:], chunk)
+		frags = append(frags, frag)
+	}
+
+	return frags, nil
+}
+
+// isFragment returns whether data was received as a fragment.
+func isFragment(data []byte) bool {
+	return len(data) > 0 && data[0] == fragmentMarker
+}
+
+// fragmentReassembler rebuilds the packets fragmented by a single conn.
+type fragmentReassembler struct {
+	pkt []byte
+
+	// started is set between the first fragment of a packet and its last.
+	started bool
+}
+
+// add appends the payload of frag, copying it, and returns the reassembled
+// packet once frag is the last fragment. A first fragment drops the packet
+// being reassembled, which lost its last fragments.
+func (r *fragmentReassembler) add(frag []byte) (pkt []byte, complete bool, err error) {
+	if len(frag) < fragmentHeaderLen {
+		r.pkt, r.started = nil, false
+		return nil, false, errInvalidFragment
+	}
+
+	if frag[1]&fragmentFirst != 0 {
+		r.pkt, r.started = nil, true
+	} else if !r.started {
+		return nil, false, fmt.Errorf("%w: not preceded by a first fragment", errInvalidFragment)
+	}
+
+	if len(r.pkt)+len(frag)-fragmentHeaderLen > maxFragmentedPacketLen {
+		r.pkt, r.started = nil, false
+		return nil, false, fmt.Errorf("%w: over %d bytes", errFragmentedPacketTooLarge, maxFragmentedPacketLen)
+	}
+
+	r.pkt = append(r.pkt, frag[fragmentHeaderLen:]...)
+	if frag[1]&fragmentMore != 0 {
+		return nil, false, nil
+	}
+
+	pkt = r.pkt
+	if pkt == nil {
+		pkt = []byte{}
+	}
+	r.pkt, r.started = nil, false
+	return pkt, true, nil
+}
@@ -1,14 +1,23 @@
 package ice
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pion/logging"
 	"github.com/pion/stun"
+	"github.com/pion/transport/packetio"
+	"github.com/pion/transport/vnet"
 )
 
 // TCPMux is allows grouping multiple TCP net.Conns and using them like UDP
@@ -49,13 +58,128 @@ type TCPMuxDefault struct {
 	params *TCPMuxParams
 	closed bool
 
+	// closedChan is closed by Close.
+	closedChan chan struct{}
+
+	// doneChan is closed once Close has shut everything down.
+	doneChan chan struct{}
+	doneOnce sync.Once
+
+	// closeErr is the error returned by the first Close, set before doneChan
+	// is closed.
+	closeErr error
+
+	// uninitialized is set when the mux was created without a Listener. It
+	// never starts and its methods fail with ErrTCPMuxNotInitialized.
+	uninitialized bool
+
+	stats         *tcpMuxStats
+	acceptLimiter *tokenBucket
+
+	// paused is non-zero while new connections are rejected, accessed
+	// atomically.
+	paused int32
+
+	// acceptDone is closed when the accept loop of the current listener exits.
+	acceptDone chan struct{}
+
 	// connsIPv4 and connsIPv6 are maps of all tcpPacketConns indexed by ufrag
 	connsIPv4, connsIPv6 map[string]*tcpPacketConn
 
+	// migrations receives the conns moving to another ufrag, nil unless
+	// MigrateOnICERestart is set.
+	migrations chan connMigration
+
+	// connPool shares the dialed connections between ufrags, nil unless
+	// ShareDialedConns is set.
+	connPool *connPool
+
+	// readBufferPool holds the buffers packets are read into, shared by the
+	// conns of all ufrags.
+	readBufferPool *sync.Pool
+
+	// readBufferSizes and writeBufferSizes override ReadBufferSize and
+	// WriteBufferSize per ufrag
+	readBufferSizes, writeBufferSizes map[string]int
+
+	// receiveMTUs overrides the receive MTU per ufrag, see
+	// GetConnByUfragWithReceiveMTU
+	receiveMTUs map[string]int
+
+	// userData is the value set by SetUserData per ufrag
+	userData map[string]interface{}
+
+	// serverNameConns counts the connections routed per TLS server name
+	serverNameConns map[string]uint64
+
+	// events is returned by Events, it is closed with doneChan under
+	// eventsMu.
+	events       chan MuxEvent
+	eventsMu     sync.RWMutex
+	eventsClosed bool
+
 	mu sync.Mutex
-	wg sync.WaitGroup
+	wg trackedWaitGroup
+
+	onCloseOnce sync.Once
+}
+
+// MuxEventType is the kind of a MuxEvent.
+type MuxEventType int
+
+const (
+	// MuxEventConnAdded is sent when a connection is added to a ufrag.
+	MuxEventConnAdded MuxEventType = iota + 1
+	// MuxEventConnRemoved is sent when a connection is removed from a ufrag,
+	// whether it was closed or moved to another ufrag.
+	MuxEventConnRemoved
+)
+
+func (t MuxEventType) String() string {
+	switch t {
+	case MuxEventConnAdded:
+		return "conn_added"
+	case MuxEventConnRemoved:
+		return "conn_removed"
+	default:
+		return "unknown"
+	}
+}
+
+// MuxEvent is a change of the connections of a TCPMuxDefault, see
+// TCPMuxDefault.Events.
+type MuxEvent struct {
+	Type   MuxEventType
+	Ufrag  string
+	Remote net.Addr
 }
 
+// muxEventsBufferSize is the number of events Events holds for a slow
+// consumer before dropping new ones.
+const muxEventsBufferSize = 128
+
+// DuplicateConnPolicy decides what happens to a connection from a remote that
+// already has one on the same ufrag, as when both peers of a simultaneous-open
+// ICE-TCP candidate pair connect at once.
+type DuplicateConnPolicy int
+
+const (
+	// DuplicateConnKeepExisting rejects and closes the new connection.
+	DuplicateConnKeepExisting DuplicateConnPolicy = iota
+	// DuplicateConnPreferNew closes the existing connection and uses the new
+	// one in its place. The read error of the closed connection isn't
+	// returned by ReadFrom.
+	DuplicateConnPreferNew
+	// DuplicateConnKeepBoth keeps both connections if their local addresses
+	// differ, otherwise it rejects the new one. Packets are read from both
+	// and written to the existing one, the new one takes over once the
+	// existing one is removed. A third connection is always rejected.
+	// Connections accepted from TCPMuxParams.Listener all have its address,
+	// so this only differs from DuplicateConnKeepExisting for connections
+	// routed with HandleConn or dialed by the mux.
+	DuplicateConnKeepBoth
+)
+
 // TCPMuxParams are parameters for TCPMux.
 type TCPMuxParams struct {
 	Listener       net.Listener
@@ -63,114 +187,1437 @@ type TCPMuxParams struct {
 	ReadBufferSize int
 
 	// max buffer size for write op. 0 means no write buffer, the write op will block until the whole packet is written
-	// if the write buffer is full, the subsequent write packet will be dropped until it has enough space.
+	// if the write buffer is full, the subsequent write packet will be dropped with ErrWriteBufferFull until it has enough space.
 	// a default 4MB is recommended.
 	WriteBufferSize int
+
+	// WriteTimeout, if non-zero, bounds each write to a connection: the
+	// writes of the write buffer to the socket, or WriteTo when there is no
+	// write buffer. A peer that doesn't read for longer makes the write fail
+	// with a timeout, which closes and removes its connection instead of
+	// blocking the writer or letting the buffer back up indefinitely.
+	WriteTimeout time.Duration
+
+	// WriteBufferNearFull, if non-zero, is the fraction of WriteBufferSize,
+	// between 0 and 1, from which OnWriteBufferNearFull signals that the
+	// write buffer of a connection is filling up. Senders can then lower
+	// their bitrate before packets start being dropped with
+	// ErrWriteBufferFull. It only applies when WriteBufferSize is set.
+	WriteBufferNearFull float64
+
+	// OnWriteBufferNearFull, if set, is called when a packet queued by
+	// WriteTo fills the write buffer of a connection up to
+	// WriteBufferNearFull, with the bytes queued and the size of the buffer.
+	// The packet was queued and will be sent, WriteTo succeeds. It is called
+	// once until the buffer drains below WriteBufferNearFull again. It runs
+	// on the goroutine calling WriteTo, so it must not block nor call methods
+	// of the mux.
+	OnWriteBufferNearFull func(ufrag string, remote net.Addr, queued, limit int)
+
+	// WriteBatchBytes, if non-zero, lets the write buffer coalesce the packets
+	// queued on a connection into a single socket write of up to about that
+	// many bytes, each packet keeping its own framing. It cuts the number of
+	// syscalls when many small packets, such as RTCP, are queued in bursts,
+	// and only applies when WriteBufferSize is set. Packets are never held
+	// back waiting for more.
+	WriteBatchBytes int
+
+	// WriteBufferLowWatermark, if non-zero, is the number of bytes queued in
+	// the write buffer of a connection from which a warning is logged, as an
+	// early sign of a peer not keeping up. It is logged again only after the
+	// buffer drained below it. It only applies when WriteBufferSize is set.
+	WriteBufferLowWatermark int
+
+	// WriteBufferBlocking makes WriteTo wait for room in a full write buffer
+	// instead of dropping the packet with ErrWriteBufferFull, applying
+	// backpressure to the sender. The wait lasts until the peer reads enough
+	// or the connection fails: with WriteTimeout, a peer that doesn't read
+	// within it has its connection closed, which fails the waiting writes.
+	// Packets larger than WriteBufferSize still fail. It only applies when
+	// WriteBufferSize is set.
+	WriteBufferBlocking bool
+
+	// StreamingPacketHeaderLen is the size in bytes of the big-endian length
+	// header that prepends each packet on the stream. 0 defaults to the 2-byte
+	// header of RFC 4571 used by ICE-TCP, 4 may be used for non-standard peers
+	// that need packets larger than 65535 bytes. Such packets are only read
+	// by the ufrags with a larger receive MTU, see
+	// GetConnByUfragWithReceiveMTU, and can't go through a write buffer, see
+	// WriteBufferSize, whose frames are limited to 65535 bytes header
+	// included.
+	StreamingPacketHeaderLen int
+
+	// MaxHandshakeFrameSize bounds the size of the first packet of a
+	// connection, the STUN message it is routed with. A larger first packet
+	// is rejected from its length header, before its payload is read or a
+	// buffer is allocated for it. 0 defaults to the receive MTU of 8192
+	// bytes, much larger than needed for STUN: a few hundred bytes are
+	// enough for typical binding requests.
+	MaxHandshakeFrameSize int
+
+	// StrictUfrag makes the mux only route connections whose ufrag is 4 to
+	// 256 ice-chars long, as required by RFC 5245. Connections with an empty
+	// ufrag are rejected regardless. Rejected connections are closed and
+	// counted in TCPMuxStats.InvalidUfrags.
+	StrictUfrag bool
+
+	// FrameCodec, if set, delimits the packets on the stream instead of the
+	// RFC 4571 length header, in which case StreamingPacketHeaderLen is
+	// ignored. It is used both for the first packet of accepted connections
+	// and for the packets exchanged afterwards.
+	FrameCodec FrameCodec
+
+	// OnBindingRequest, if set, is called after a new connection has been
+	// routed to a ufrag with the STUN message that was used to route it. The
+	// message is owned by the mux and must not be modified or retained after
+	// the callback returns.
+	OnBindingRequest func(ufrag string, msg *stun.Message, remote net.Addr)
+
+	// OnConn, if set, is called after a new connection has been routed to a
+	// ufrag, after OnBindingRequest, with the TLS server name (SNI) the
+	// client requested. The server name is only known for *tls.Conn
+	// connections, as accepted from a listener made by tls.NewListener, and
+	// is empty otherwise or if the client sent none. It is also added to the
+	// log fields of the connection as "sni" and counted in
+	// TCPMuxStats.ConnsByServerName.
+	OnConn func(ufrag string, remote net.Addr, serverName string)
+
+	// DuplicateConnPolicy decides what happens to a connection from a remote
+	// already connected to its ufrag. Defaults to DuplicateConnKeepExisting.
+	DuplicateConnPolicy DuplicateConnPolicy
+
+	// MigrateOnICERestart makes a connection that receives a STUN binding
+	// request for another ufrag move to that ufrag, as happens when the
+	// remote restarts ICE over the same connection. The socket is kept open
+	// and the request is delivered to the new ufrag like the first packet of
+	// a new connection, OnBindingRequest included. The previous ufrag keeps
+	// its other connections and is removed as usual by RemoveConnByUfrag.
+	// Without it the request is delivered to the previous ufrag.
+	MigrateOnICERestart bool
+
+	// RouteAnySTUNMessage makes the mux route a new connection on the
+	// USERNAME of its first STUN message whatever its method, such as an
+	// indication sent by stacks that don't lead with a binding request. By
+	// default only binding messages are accepted.
+	RouteAnySTUNMessage bool
+
+	// QuietRejections logs at Debug rather than Warn the connections
+	// rejected for what they sent, as the scanners of an exposed listener
+	// do: a first frame that can't be read or is too large, that isn't a
+	// STUN binding request, or whose USERNAME is missing or has an invalid
+	// ufrag. The other rejections, such as duplicate connections, are still
+	// logged at Warn. Rejected connections are counted either way.
+	QuietRejections bool
+
+	// DeliverFirstPacket controls whether the STUN message used to route a new
+	// connection is also returned from ReadFrom. Defaults to true when nil.
+	DeliverFirstPacket *bool
+
+	// ClassifyConn, if set, lets other protocols share the port. It is called
+	// with each new connection before its first frame is read, peek holding
+	// the first bytes received on it as sent, framing header included, to
+	// tell the protocol apart. peek holds at least one byte and usually the
+	// whole first frame, but may be cut short if it arrived in several
+	// segments, and is only valid during the call. The peeked bytes aren't
+	// consumed: if ClassifyConn returns true it takes over conn, which reads
+	// them first, and the mux forgets it. Otherwise conn is handled as
+	// ICE-TCP, its first frame routed and delivered as usual.
+	ClassifyConn func(conn net.Conn, peek []byte) (claimed bool)
+
+	// NoDelay controls TCP_NODELAY on accepted *net.TCPConn connections,
+	// disabling Nagle's algorithm for small ICE and RTCP packets. Defaults to
+	// true when nil. Other connection types are left untouched.
+	NoDelay *bool
+
+	// MaxAcceptsPerSecond limits the rate at which new connections are
+	// handled. Connections accepted above the rate are closed immediately and
+	// counted in TCPMuxStats.RateLimitedConns. Up to one second worth of
+	// connections may arrive in a burst. 0 means no limit.
+	MaxAcceptsPerSecond int
+
+	// MaxReadBytesPerSecond limits the rate at which packets are read from
+	// each connection. A connection exceeding it isn't read from until it is
+	// back under the rate, which applies TCP backpressure to the sender
+	// rather than dropping packets. Up to one second worth of bytes may be
+	// read in a burst. 0 means no limit.
+	MaxReadBytesPerSecond int
+
+	// ConnControl, if set, is called with every accepted connection after the
+	// built-in socket options have been applied and before the first packet is
+	// read. It receives the raw conn, before any framing, and can be used to
+	// apply further socket tuning such as SO_RCVBUF. Returning an error
+	// rejects the connection.
+	ConnControl func(conn net.Conn) error
+
+	// DSCP, if non-zero, is the Differentiated Services Code Point (0-63) used
+	// to mark packets sent on accepted *net.TCPConn connections, set through
+	// IP_TOS or IPV6_TCLASS. It is currently only supported on Linux and is
+	// ignored elsewhere.
+	DSCP int
+
+	// KeepAliveIdle and KeepAliveInterval enable TCP keepalive on accepted
+	// *net.TCPConn connections when either is non-zero, so that the OS reaps
+	// peers that vanished without closing the connection. KeepAliveIdle is
+	// the idle time before the first probe and KeepAliveInterval the time
+	// between probes, 0 leaves the OS default for that value.
+	// KeepAliveInterval is only supported on Linux.
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+
+	// PoolReadBuffers makes ReadFrom copy the packets out of the buffers they
+	// were read into, taken from a pool shared by all the connections, and
+	// recycle them, instead of allocating a copy of every packet received.
+	// In either case an idle connection holds no read buffer.
+	PoolReadBuffers bool
+
+	// RemoteKeyFunc, if set, maps the remote address of a connection to the
+	// key identifying its remote within a ufrag, instead of the full address.
+	// For example keying by IP only makes a reconnection from another source
+	// port replace the connection of the same client once the previous one
+	// is removed; until then, the new connection is rejected as a duplicate.
+	// WriteTo to any address with the same key uses that connection.
+	RemoteKeyFunc func(net.Addr) string
+
+	// AllowFragmentation makes WriteTo split packets larger than a peer can
+	// read in one frame, up to 1 MiB, over several frames that ReadFrom
+	// reassembles into the original packet. It must be enabled on both
+	// peers: the fragments start with a byte, 0xFF, that no protocol
+	// multiplexed over ICE uses, so a peer without it drops them as unknown
+	// packets. Packets starting with 0xFF are always sent as a fragment.
+	// Without it, packets are sent as they are and the peer fails to read
+	// oversized ones.
+	AllowFragmentation bool
+
+	// CompressFrames compresses each packet with DEFLATE, packets that don't
+	// shrink being sent as they are. It trades CPU for bandwidth on links
+	// carrying redundant packets, such as signaling, encrypted media doesn't
+	// shrink. It must be enabled on both peers: the packets are sent after a
+	// byte, 0xFD or 0xFE, that no protocol multiplexed over ICE uses, so a
+	// peer without it drops them as unknown packets and a peer with it closes
+	// the connections of a peer without. It applies over FrameCodec.
+	CompressFrames bool
+
+	// StrictBoundaries guarantees that each packet written is read by the
+	// peer as exactly one packet. Writing a packet larger than the 8192
+	// bytes a peer reads in one frame fails instead of being sent, unless
+	// AllowFragmentation is set. Whatever the setting, a frame too large to
+	// be read closes its connection rather than being read in pieces, and
+	// ReadFrom never returns part of a packet: a packet larger than its
+	// buffer fails with io.ErrShortBuffer.
+	StrictBoundaries bool
+
+	// ConnKey, if set, returns the key identifying a connection within a
+	// ufrag, for connections whose remote address isn't stable or unique,
+	// such as tunneled ones. It takes precedence over RemoteKeyFunc. The
+	// remote addresses returned by ReadFrom then wrap the address of their
+	// connection with its key, so that WriteTo to them uses that
+	// connection. Connections whose remote address has no IP are routed by
+	// the address family of their local address.
+	ConnKey func(net.Conn) string
+
+	// NonIPRemoteIPv6 routes the connections whose remote address isn't an
+	// IP, such as those accepted by a Unix socket or pipe listener, to the
+	// IPv6 conn of their ufrag. They go to the IPv4 conn by default. With
+	// the default RemoteKeyFunc such remotes may all share the same address,
+	// set ConnKey to accept more than one connection per ufrag from them.
+	NonIPRemoteIPv6 bool
+
+	// Dialer, if set, enables active ICE-TCP connections: writing to a remote
+	// address without a connection dials it with the network of the conn's
+	// address family, "tcp4" or "tcp6". Dialed connections are only routed
+	// to the conn that dialed them. The dial is bounded by the write deadline
+	// of the conn, past which WriteTo fails with a timeout net.Error, and by
+	// the Timeout of the Dialer.
+	Dialer *net.Dialer
+
+	// ShareDialedConns makes the ufrags writing to the same remote address
+	// share the connection dialed by the first one, instead of each dialing
+	// its own, as bundled transports do. The connection is reference
+	// counted: it is closed once every ufrag using it removed it, or when
+	// it fails for all of them. The remote routes the connection by the
+	// first packet written to it, usually the binding request of the ufrag
+	// that dialed it, so sharing only works with remotes that route each
+	// packet rather than each connection. All the packets read from it are
+	// delivered to the ufrag that has used it the longest, as the ufrag of a
+	// packet can't be told in general. Connections dialed by DialUfrag
+	// aren't shared.
+	ShareDialedConns bool
+
+	// TCPFastOpen makes Dialer use TCP Fast Open, sending the first packet
+	// written to a dialed connection, usually a STUN binding request, in the
+	// SYN to save a round trip. It is supported on Linux 4.11 and later, with
+	// net.ipv4.tcp_fastopen allowing client use, which is the default. On
+	// other platforms, or if the remote doesn't support it, connections are
+	// established with a regular handshake before the first write.
+	TCPFastOpen bool
+
+	// DialFallbackDelay is the delay after which DialUfrag tries the next
+	// remote address while previous attempts are still pending, as the
+	// Connection Attempt Delay of RFC 8305. 0 defaults to 250ms.
+	DialFallbackDelay time.Duration
+
+	// OnClose, if set, is called once the mux has shut down. After Close it
+	// is called once all goroutines have exited, with the error returned by
+	// Close. If the accept loop stops on an error before Close is
+	// called, it is called with that error once the loop has exited instead;
+	// connections already routed keep working until Close. It is called at
+	// most once.
+	OnClose func(err error)
+
+	// OnConnClose, if set, is called when a connection routed to a ufrag
+	// stops being read, with the error that stopped it, or nil if the remote
+	// closed the connection cleanly. The error is also returned by ReadFrom,
+	// wrapping io.EOF for a clean close. Connections closed by the mux, or
+	// replaced under DuplicateConnPreferNew, report the error of reading a
+	// closed connection. It runs on the goroutine reading the connection, so
+	// it must not block nor call methods of the mux.
+	OnConnClose func(ufrag string, remote net.Addr, err error)
+
+	// Tracer, if set, is notified of the handshake of every connection, from
+	// its accept until it is added to its ufrag. Packets exchanged afterwards
+	// aren't traced. The icetrace package records the handshakes as
+	// OpenTelemetry spans.
+	Tracer HandshakeTracer
+}
+
+// HandshakeTracer observes the handshakes of the connections of a
+// TCPMuxDefault.
+type HandshakeTracer interface {
+	// StartHandshake is called when the handshake of conn starts. The
+	// returned function is called once it ends, with the ufrag of conn, or
+	// an empty string if none was read, and the error that failed the
+	// handshake, nil on success.
+	StartHandshake(conn net.Conn) func(ufrag string, err error)
+}
+
+// maxDSCP is the largest value of the 6-bit DSCP field.
+const maxDSCP = 63
+
+// minUfragLen and maxUfragLen bound the length of a ufrag per RFC 5245.
+const (
+	minUfragLen = 4
+	maxUfragLen = 256
+)
+
+// closeReason is why a connection was closed by the mux or removed from its
+// ufrag.
+type closeReason int
+
+const (
+	// closeReasonExplicit is a close requested through the API, such as
+	// Close or RemoveConnByUfrag.
+	closeReasonExplicit closeReason = iota
+	// closeReasonRemoteClosed is a clean close by the remote, between
+	// packets.
+	closeReasonRemoteClosed
+	// closeReasonReadError is any other read error, such as a reset, a
+	// truncated packet or an invalid fragment.
+	closeReasonReadError
+	// closeReasonWriteTimeout is a write that didn't complete within
+	// WriteTimeout.
+	closeReasonWriteTimeout
+	// closeReasonReplaced is a connection replaced by a new one from the
+	// same remote under DuplicateConnPreferNew.
+	closeReasonReplaced
+	// closeReasonRateLimited is a connection closed on accept because
+	// MaxAcceptsPerSecond was exceeded.
+	closeReasonRateLimited
+	// closeReasonPaused is a connection closed on accept because the mux
+	// was paused.
+	closeReasonPaused
+	// closeReasonRejected is a connection whose handshake failed, for
+	// example because its first packet wasn't a valid binding request.
+	closeReasonRejected
+
+	numCloseReasons
+)
+
+func (r closeReason) String() string {
+	switch r {
+	case closeReasonExplicit:
+		return "explicit"
+	case closeReasonRemoteClosed:
+		return "remote_closed"
+	case closeReasonReadError:
+		return "read_error"
+	case closeReasonWriteTimeout:
+		return "write_timeout"
+	case closeReasonReplaced:
+		return "replaced"
+	case closeReasonRateLimited:
+		return "rate_limited"
+	case closeReasonPaused:
+		return "paused"
+	case closeReasonRejected:
+		return "rejected"
+	default:
+		return "unknown"
+	}
+}
+
+// readCloseReason returns the closeReason of a conn whose reader stopped on
+// err.
+func readCloseReason(err error) closeReason {
+	switch {
+	case errors.Is(err, io.EOF):
+		return closeReasonRemoteClosed
+	case errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe):
+		return closeReasonExplicit
+	default:
+		return closeReasonReadError
+	}
+}
+
+// tcpMuxStats holds the counters reported by TCPMuxDefault.Stats. All fields
+// are accessed atomically, but for those guarded by acceptErrMu.
+type tcpMuxStats struct {
+	acceptedConns      uint64
+	acceptErrors       uint64
+	stunDecodeFailures uint64
+	nonBindingMessages uint64
+	missingUsernames   uint64
+	invalidUfrags      uint64
+
+	packetsRead    uint64
+	bytesRead      uint64
+	packetsWritten uint64
+	bytesWritten   uint64
+	droppedWrites  uint64
+
+	// closes counts the connections closed per closeReason.
+	closes [numCloseReasons]uint64
+
+	// liveConns is the number of connections currently added to a ufrag.
+	liveConns int64
+
+	// handshakes counts the connections routed by handleConn, and the
+	// handshake* fields their total, shortest and longest handshake time in
+	// nanoseconds.
+	handshakes     uint64
+	handshakeTotal int64
+	handshakeMin   int64
+	handshakeMax   int64
+
+	// activeHandshakes and readerGoroutines count the goroutines currently
+	// running handleConn and reading routed connections.
+	activeHandshakes int64
+	readerGoroutines int64
+
+	// lastAcceptErr is the last error of the accept loop, at lastAcceptErrAt.
+	acceptErrMu     sync.Mutex
+	lastAcceptErr   error
+	lastAcceptErrAt time.Time
 }
 
-// NewTCPMuxDefault creates a new instance of TCPMuxDefault.
+// addAcceptError records err, which stopped an accept loop.
+func (s *tcpMuxStats) addAcceptError(err error) {
+	atomic.AddUint64(&s.acceptErrors, 1)
+
+	s.acceptErrMu.Lock()
+	defer s.acceptErrMu.Unlock()
+
+	s.lastAcceptErr, s.lastAcceptErrAt = err, time.Now()
+}
+
+// The methods below may be called on a nil *tcpMuxStats, for tcpPacketConns
+// used without a mux.
+
+func (s *tcpMuxStats) addLiveConns(delta int64) {
+	if s != nil {
+		atomic.AddInt64(&s.liveConns, delta)
+	}
+}
+
+// addHandshake records the time a connection took from its accept until it
+// was routed.
+func (s *tcpMuxStats) addHandshake(d time.Duration) {
+	atomic.AddUint64(&s.handshakes, 1)
+	atomic.AddInt64(&s.handshakeTotal, int64(d))
+
+	for {
+		shortest := atomic.LoadInt64(&s.handshakeMin)
+		if shortest != 0 && shortest <= int64(d) || atomic.CompareAndSwapInt64(&s.handshakeMin, shortest, int64(d)) {
+			break
+		}
+	}
+	for {
+		longest := atomic.LoadInt64(&s.handshakeMax)
+		if longest >= int64(d) || atomic.CompareAndSwapInt64(&s.handshakeMax, longest, int64(d)) {
+			break
+		}
+	}
+}
+
+func (s *tcpMuxStats) addReaderGoroutines(delta int64) {
+	if s != nil {
+		atomic.AddInt64(&s.readerGoroutines, delta)
+	}
+}
+
+func (s *tcpMuxStats) addClose(reason closeReason) {
+	if s != nil {
+		atomic.AddUint64(&s.closes[reason], 1)
+	}
+}
+
+func (s *tcpMuxStats) loadCloses(reason closeReason) uint64 {
+	return atomic.LoadUint64(&s.closes[reason])
+}
+
+func (s *tcpMuxStats) addRead(n int) {
+	if s != nil {
+		atomic.AddUint64(&s.packetsRead, 1)
+		atomic.AddUint64(&s.bytesRead, uint64(n))
+	}
+}
+
+// addWrite counts a write of an n bytes packet that returned err.
+func (s *tcpMuxStats) addWrite(n int, err error) {
+	if s == nil {
+		return
+	}
+
+	switch {
+	case err == nil:
+		atomic.AddUint64(&s.packetsWritten, 1)
+		atomic.AddUint64(&s.bytesWritten, uint64(n))
+	case errors.Is(err, packetio.ErrFull):
+		atomic.AddUint64(&s.droppedWrites, 1)
+	}
+}
+
+// NewTCPMuxDefault creates a new instance of TCPMuxDefault. If
+// params.Listener is nil, the returned mux doesn't accept connections and its
+// methods return ErrTCPMuxNotInitialized, like an uninitialized TCPMux.
 func NewTCPMuxDefault(params TCPMuxParams) *TCPMuxDefault {
 	if params.Logger == nil {
 		params.Logger = logging.NewDefaultLoggerFactory().NewLogger("ice")
 	}
 
+	switch params.StreamingPacketHeaderLen {
+	case 0:
+		params.StreamingPacketHeaderLen = streamingPacketHeaderLen
+	case streamingPacketHeaderLen, streamingPacketHeaderLenExtended:
+	default:
+		params.Logger.Warnf("Unsupported streaming packet header length %d, using %d", params.StreamingPacketHeaderLen, streamingPacketHeaderLen)
+		params.StreamingPacketHeaderLen = streamingPacketHeaderLen
+	}
+	if params.StreamingPacketHeaderLen == streamingPacketHeaderLenExtended && params.WriteBufferSize > 0 {
+		params.Logger.Warnf("Write buffers limit packets to %d bytes despite the %d-byte streaming packet header",
+			maxBufferedFrameLen-streamingPacketHeaderLenExtended, streamingPacketHeaderLenExtended)
+	}
+
+	if params.DialFallbackDelay <= 0 {
+		params.DialFallbackDelay = defaultDialFallbackDelay
+	}
+
+	if params.TCPFastOpen && params.Dialer != nil {
+		params.Dialer = fastOpenDialer(params.Dialer, params.Logger)
+	}
+
+	if params.MaxHandshakeFrameSize <= 0 {
+		params.MaxHandshakeFrameSize = receiveMTU
+	}
+
+	if params.FrameCodec == nil {
+		params.FrameCodec = streamingPacketCodec{headerLen: params.StreamingPacketHeaderLen}
+	}
+	if params.CompressFrames {
+		params.FrameCodec = compressedFrameCodec{codec: params.FrameCodec}
+	}
+
 	m := &TCPMuxDefault{
-		params: &params,
+		params:     &params,
+		stats:      &tcpMuxStats{},
+		closedChan: make(chan struct{}),
+		doneChan:   make(chan struct{}),
+		events:     make(chan MuxEvent, muxEventsBufferSize),
+
+		readBufferPool: newReadBufferPool(),
 
 		connsIPv4: map[string]*tcpPacketConn{},
 		connsIPv6: map[string]*tcpPacketConn{},
+
+		readBufferSizes:  map[string]int{},
+		writeBufferSizes: map[string]int{},
+		receiveMTUs:      map[string]int{},
+		userData:         map[string]interface{}{},
+	}
+
+	if params.DSCP < 0 || params.DSCP > maxDSCP {
+		params.Logger.Warnf("Invalid DSCP value %d, packets will not be marked", params.DSCP)
+		params.DSCP = 0
+	}
+
+	if params.Listener == nil {
+		params.Logger.Errorf("TCPMuxParams.Listener is nil, TCP connections will not be accepted")
+		m.closed = true
+		m.uninitialized = true
+		m.doneOnce.Do(m.shutDown)
+		return m
+	}
+
+	if params.MaxAcceptsPerSecond > 0 {
+		rate := float64(params.MaxAcceptsPerSecond)
+		m.acceptLimiter = newTokenBucket(rate, rate)
+	}
+
+	if params.ShareDialedConns && params.Dialer != nil {
+		m.connPool = newConnPool()
+	}
+
+	if params.MigrateOnICERestart {
+		m.migrations = make(chan connMigration)
+		m.wg.Add(1)
+		go m.migrateConns()
+	}
+
+	m.acceptDone = make(chan struct{})
+	m.wg.Add(1)
+	go m.serve(params.Listener, m.acceptDone)
+
+	return m
+}
+
+// NewTCPMuxDefaultContext is like NewTCPMuxDefault, but the returned mux is
+// closed once ctx is done.
+func NewTCPMuxDefaultContext(ctx context.Context, params TCPMuxParams) *TCPMuxDefault {
+	m := NewTCPMuxDefault(params)
+	if m.uninitialized {
+		return m
 	}
 
 	m.wg.Add(1)
 	go func() {
-		defer m.wg.Done()
-		m.start()
+		select {
+		case <-ctx.Done():
+			// Done before Close, which waits for wg. Close is idempotent,
+			// the check only keeps the error of an earlier Close from
+			// being logged.
+			m.wg.Done()
+			if m.Closed() {
+				return
+			}
+			if err := m.Close(); err != nil {
+				m.params.Logger.Warnf("Failed to close mux on context cancellation: %s", err)
+			}
+		case <-m.closedChan:
+			m.wg.Done()
+		}
 	}()
 
 	return m
 }
 
-func (m *TCPMuxDefault) start() {
-	m.params.Logger.Infof("Listening TCP on %s", m.params.Listener.Addr())
+// serve runs the accept loop of listener, for which wg.Add must have been
+// called, and reports an unexpected accept error to OnClose.
+func (m *TCPMuxDefault) serve(listener net.Listener, done chan struct{}) {
+	err := m.start(listener, done)
+
+	// Done before OnClose, which may call Close.
+	m.wg.Done()
+
+	if err != nil {
+		m.notifyClose(err)
+	}
+}
+
+// start accepts connections from listener until it fails, then closes done.
+// It returns the accept error, or nil if listener was closed by Close or
+// SwapListener.
+func (m *TCPMuxDefault) start(listener net.Listener, done chan struct{}) error {
+	defer close(done)
+
+	m.params.Logger.Infof("Listening TCP on %s", listener.Addr())
 	for {
-		conn, err := m.params.Listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			m.params.Logger.Infof("Error accepting connection: %s", err)
-			return
+			m.mu.Lock()
+			stopped := m.closed || m.params.Listener != listener
+			m.mu.Unlock()
+
+			// The listener is expected to fail once Close or SwapListener
+			// closed it.
+			if stopped {
+				m.params.Logger.Debugf("Stopped listening TCP on %s", listener.Addr())
+				return nil
+			}
+
+			m.stats.addAcceptError(err)
+			if errors.Is(err, net.ErrClosed) {
+				m.params.Logger.Infof("Listener on %s was closed, no longer accepting connections", listener.Addr())
+			} else {
+				m.params.Logger.Warnf("Error accepting connection: %s", err)
+			}
+			return err
+		}
+
+		atomic.AddUint64(&m.stats.acceptedConns, 1)
+		log := m.connLogger(conn)
+
+		if atomic.LoadInt32(&m.paused) != 0 {
+			m.stats.addClose(closeReasonPaused)
+			m.closeAndLogError(conn)
+			log.Debugf("event=%s: closed connection to %s", closeReasonPaused, conn.LocalAddr())
+			continue
 		}
 
-		m.params.Logger.Debugf("Accepted connection from: %s to %s", conn.RemoteAddr(), conn.LocalAddr())
+		if m.acceptLimiter != nil && !m.acceptLimiter.allow(1) {
+			m.stats.addClose(closeReasonRateLimited)
+			m.closeAndLogError(conn)
+			log.Debugf("event=%s: closed connection to %s", closeReasonRateLimited, conn.LocalAddr())
+			continue
+		}
+
+		log.Debugf("event=accepted: connection to %s", conn.LocalAddr())
+
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			// Failures are logged by handleConn.
+			_ = m.handleConn(conn)
+		}()
+	}
+}
+
+// LocalAddr returns the listening address of this TCPMuxDefault.
+func (m *TCPMuxDefault) LocalAddr() net.Addr {
+	if m.uninitialized {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.params.Listener.Addr()
+}
+
+// GatherCandidateInfo returns the network, "tcp4" or "tcp6", and the address
+// of the listener, to build host candidates from. If the listener is bound to
+// the unspecified address, the first address of the same family found on the
+// local interfaces is returned instead, or the unspecified address if there is
+// none. It returns a nil addr if the listener isn't a TCP listener.
+func (m *TCPMuxDefault) GatherCandidateInfo() (network string, addr *net.TCPAddr) {
+	tcpAddr, ok := m.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return "", nil
+	}
+
+	addr = &net.TCPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port, Zone: tcpAddr.Zone}
+
+	networkType := NetworkTypeTCP4
+	if addr.IP.To4() == nil {
+		networkType = NetworkTypeTCP6
+	}
+
+	if addr.IP.IsUnspecified() {
+		ips, err := localInterfaces(vnet.NewNet(nil), nil, []NetworkType{networkType})
+		if err != nil {
+			m.params.Logger.Warnf("Failed to list the local interfaces: %v", err)
+		} else if len(ips) > 0 {
+			addr.IP = ips[0]
+		}
+	}
+
+	return networkType.String(), addr
+}
+
+// SwapListener replaces the listener of this TCPMuxDefault. The current
+// listener is closed and new connections are accepted from listener once its
+// accept loop has stopped, while existing connections keep working. It fails,
+// leaving listener untouched, if the mux is closed or its accept loop already
+// stopped on an accept error, which was reported to OnClose.
+func (m *TCPMuxDefault) SwapListener(listener net.Listener) error {
+	if listener == nil {
+		return errNilListener
+	}
+	if m.uninitialized {
+		return ErrTCPMuxNotInitialized
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return io.ErrClosedPipe
+	}
+
+	select {
+	case <-m.acceptDone:
+		m.mu.Unlock()
+		return errAcceptLoopStopped
+	default:
+	}
+
+	oldListener, oldDone := m.params.Listener, m.acceptDone
+	m.params.Listener = listener
+	done := make(chan struct{})
+	m.acceptDone = done
+
+	// Added under the lock so that a concurrent Close waits for the new loop.
+	m.wg.Add(1)
+	m.mu.Unlock()
+
+	err := oldListener.Close()
+	<-oldDone
+
+	go m.serve(listener, done)
+
+	return err
+}
+
+// Pause makes the mux reject new connections until Resume is called, for
+// example during a maintenance window. Connections already routed and the
+// conns returned by GetConnByUfrag keep working.
+//
+// While paused, connections are still accepted but closed right away and
+// counted in TCPMuxStats.PausedConns, rather than left unaccepted: this fails
+// peers fast so they can move on to other candidates instead of waiting for
+// a connection timeout in the listen backlog, and keeps Close and
+// SwapListener, which rely on Accept returning, working as usual.
+func (m *TCPMuxDefault) Pause() {
+	atomic.StoreInt32(&m.paused, 1)
+}
+
+// Resume makes the mux accept new connections again after Pause.
+func (m *TCPMuxDefault) Resume() {
+	atomic.StoreInt32(&m.paused, 0)
+}
+
+// Paused reports whether new connections are rejected because of Pause.
+func (m *TCPMuxDefault) Paused() bool {
+	return atomic.LoadInt32(&m.paused) != 0
+}
+
+// Done returns a channel that is closed once the mux has shut down: Close
+// has been called, the accept loop has stopped and all connections are
+// closed. It doesn't close the mux itself. For a mux created without a
+// listener it is already closed.
+func (m *TCPMuxDefault) Done() <-chan struct{} {
+	return m.doneChan
+}
+
+// Closed reports whether this TCPMuxDefault has been closed. A mux created
+// without a listener is always closed.
+func (m *TCPMuxDefault) Closed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.closed
+}
+
+// Healthy reports whether this TCPMuxDefault is accepting connections: it
+// isn't closed and the accept loop of its listener hasn't stopped on an
+// error. It stays true while paused, and during SwapListener.
+func (m *TCPMuxDefault) Healthy() bool {
+	if m.uninitialized {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return false
+	}
+
+	select {
+	case <-m.acceptDone:
+		return false
+	default:
+		return true
+	}
+}
+
+// Stats returns a snapshot of the counters of this TCPMuxDefault.
+func (m *TCPMuxDefault) Stats() TCPMuxStats {
+	m.mu.Lock()
+	var recvQueueLen int
+	for _, conns := range []map[string]*tcpPacketConn{m.connsIPv4, m.connsIPv6} {
+		for _, conn := range conns {
+			length, _ := conn.RecvQueueStats()
+			recvQueueLen += length
+		}
+	}
+
+	var connsByServerName map[string]uint64
+	if len(m.serverNameConns) > 0 {
+		connsByServerName = make(map[string]uint64, len(m.serverNameConns))
+		for serverName, n := range m.serverNameConns {
+			connsByServerName[serverName] = n
+		}
+	}
+	m.mu.Unlock()
+
+	m.stats.acceptErrMu.Lock()
+	lastAcceptErr, lastAcceptErrAt := m.stats.lastAcceptErr, m.stats.lastAcceptErrAt
+	m.stats.acceptErrMu.Unlock()
+
+	return TCPMuxStats{
+		AcceptedConns:      atomic.LoadUint64(&m.stats.acceptedConns),
+		AcceptErrors:       atomic.LoadUint64(&m.stats.acceptErrors),
+		LastAcceptError:    lastAcceptErr,
+		LastAcceptErrorAt:  lastAcceptErrAt,
+		RateLimitedConns:   m.stats.loadCloses(closeReasonRateLimited),
+		STUNDecodeFailures: atomic.LoadUint64(&m.stats.stunDecodeFailures),
+		NonBindingMessages: atomic.LoadUint64(&m.stats.nonBindingMessages),
+		MissingUsernames:   atomic.LoadUint64(&m.stats.missingUsernames),
+		InvalidUfrags:      atomic.LoadUint64(&m.stats.invalidUfrags),
+		PausedConns:        m.stats.loadCloses(closeReasonPaused),
+		LiveConns:          int(atomic.LoadInt64(&m.stats.liveConns)),
+		PacketsRead:        atomic.LoadUint64(&m.stats.packetsRead),
+		BytesRead:          atomic.LoadUint64(&m.stats.bytesRead),
+		PacketsWritten:     atomic.LoadUint64(&m.stats.packetsWritten),
+		BytesWritten:       atomic.LoadUint64(&m.stats.bytesWritten),
+		DroppedWrites:      atomic.LoadUint64(&m.stats.droppedWrites),
+		ClosedByRemote:     m.stats.loadCloses(closeReasonRemoteClosed),
+		ReadErrors:         m.stats.loadCloses(closeReasonReadError),
+		RecvQueueLen:       recvQueueLen,
+		ConnsByServerName:  connsByServerName,
+	}
+}
+
+// MuxRuntimeStats returns a snapshot of the handshake timings and goroutines
+// of this TCPMuxDefault.
+func (m *TCPMuxDefault) MuxRuntimeStats() TCPMuxRuntimeStats {
+	return TCPMuxRuntimeStats{
+		Handshakes:       atomic.LoadUint64(&m.stats.handshakes),
+		HandshakeTotal:   time.Duration(atomic.LoadInt64(&m.stats.handshakeTotal)),
+		HandshakeMin:     time.Duration(atomic.LoadInt64(&m.stats.handshakeMin)),
+		HandshakeMax:     time.Duration(atomic.LoadInt64(&m.stats.handshakeMax)),
+		ActiveHandshakes: int(atomic.LoadInt64(&m.stats.activeHandshakes)),
+		ReaderGoroutines: int(atomic.LoadInt64(&m.stats.readerGoroutines)),
+	}
+}
+
+// TotalConns returns the number of connections currently open across all
+// ufrags and both address families.
+func (m *TCPMuxDefault) TotalConns() int {
+	return int(atomic.LoadInt64(&m.stats.liveConns))
+}
+
+// NumGoroutines returns the number of goroutines currently run by the mux:
+// its accept loop, the handshakes, the readers of the connections and those
+// watching the ufrags. It is 0 once Close has returned, tests can check it to
+// catch goroutines that are never waited for.
+func (m *TCPMuxDefault) NumGoroutines() int {
+	n := m.wg.count() + int(atomic.LoadInt64(&m.stats.readerGoroutines))
+	if m.connPool != nil {
+		n += m.connPool.wg.count()
+	}
+	return n
+}
+
+// trackedWaitGroup is a sync.WaitGroup that counts the goroutines it waits
+// for.
+type trackedWaitGroup struct {
+	wg sync.WaitGroup
+	n  int64
+}
+
+func (g *trackedWaitGroup) Add(delta int) {
+	atomic.AddInt64(&g.n, int64(delta))
+	g.wg.Add(delta)
+}
+
+func (g *trackedWaitGroup) Done() {
+	atomic.AddInt64(&g.n, -1)
+	g.wg.Done()
+}
+
+func (g *trackedWaitGroup) Wait() {
+	g.wg.Wait()
+}
+
+// count returns the number of goroutines not done yet.
+func (g *trackedWaitGroup) count() int {
+	return int(atomic.LoadInt64(&g.n))
+}
+
+// RemoteAddrs returns a snapshot of the addresses of the remotes connected
+// to ufrag, or nil if there is no connection for ufrag.
+func (m *TCPMuxDefault) RemoteAddrs(ufrag string, isIPv6 bool) []net.Addr {
+	m.mu.Lock()
+	conn, ok := m.getConn(ufrag, isIPv6)
+	m.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return conn.RemoteAddrs()
+}
+
+// RemoteConnAge is the age of the connection of a remote, as returned by
+// ConnAges.
+type RemoteConnAge struct {
+	Remote net.Addr
+	Age    time.Duration
+}
+
+// ConnAges returns a snapshot of how long ago the connections of the remotes
+// connected to ufrag were added, or nil if there is no connection for ufrag.
+// Older connections are proven paths, which may be preferred.
+func (m *TCPMuxDefault) ConnAges(ufrag string, isIPv6 bool) []RemoteConnAge {
+	m.mu.Lock()
+	conn, ok := m.getConn(ufrag, isIPv6)
+	m.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return conn.ConnAges()
+}
+
+// UfragStats returns statistics about the connections of every ufrag,
+// aggregated over both address families.
+func (m *TCPMuxDefault) UfragStats() map[string]TCPMuxUfragStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := map[string]TCPMuxUfragStats{}
+	for _, conns := range []map[string]*tcpPacketConn{m.connsIPv4, m.connsIPv6} {
+		for ufrag, conn := range conns {
+			s := stats[ufrag]
+			queued, highWatermark := conn.WriteBufferStats()
+			s.WriteBufferedBytes += queued
+			if highWatermark > s.WriteBufferHighWatermark {
+				s.WriteBufferHighWatermark = highWatermark
+			}
+			recvLen, recvCap := conn.RecvQueueStats()
+			s.RecvQueueLen += recvLen
+			s.RecvQueueCap += recvCap
+			stats[ufrag] = s
+		}
+	}
+
+	return stats
+}
+
+// GetConnByUfrag retrieves an existing or creates a new net.PacketConn.
+//
+// A net.PacketConn stays registered while its connections come and go: when
+// all of them drop, a connection for the same ufrag is added to it again.
+// Once it is closed, explicitly or by RemoveConnByUfrag, it is removed and
+// never reused; the next connection or call for the ufrag gets a new one.
+func (m *TCPMuxDefault) GetConnByUfrag(ufrag string, isIPv6 bool) (net.PacketConn, error) {
+	if m.uninitialized {
+		return nil, ErrTCPMuxNotInitialized
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, io.ErrClosedPipe
+	}
+
+	if conn, ok := m.getConn(ufrag, isIPv6); ok {
+		return conn, nil
+	}
+
+	return m.createConn(ufrag, m.params.Listener.Addr(), isIPv6), nil
+}
+
+// GetConnByUfragWithReceiveMTU is like GetConnByUfrag but sets the size of
+// the largest packet read for ufrag to mtu instead of 8192 bytes, so that a
+// session can take larger packets than the others on the mux. A connection
+// receiving a larger packet is closed. The size applies to both address
+// families of ufrag, including the net.PacketConns that already exist, from
+// the next packet read on each connection, and to those created for ufrag
+// until RemoveConnByUfrag. A mtu of 0 restores the default.
+func (m *TCPMuxDefault) GetConnByUfragWithReceiveMTU(ufrag string, isIPv6 bool, mtu int) (net.PacketConn, error) {
+	if m.uninitialized {
+		return nil, ErrTCPMuxNotInitialized
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, io.ErrClosedPipe
+	}
+
+	if mtu > 0 {
+		m.receiveMTUs[ufrag] = mtu
+	} else {
+		delete(m.receiveMTUs, ufrag)
+	}
+
+	if conn, ok := m.connsIPv4[ufrag]; ok {
+		conn.SetReceiveMTU(mtu)
+	}
+	if conn, ok := m.connsIPv6[ufrag]; ok {
+		conn.SetReceiveMTU(mtu)
+	}
+
+	if conn, ok := m.getConn(ufrag, isIPv6); ok {
+		return conn, nil
+	}
+
+	return m.createConn(ufrag, m.params.Listener.Addr(), isIPv6), nil
+}
+
+// DialUfrag actively connects ufrag to the first reachable of raddrs, which
+// are the addresses of a remote in order of preference, possibly of both
+// address families. Attempts are raced with the Happy Eyeballs algorithm of
+// RFC 8305, staggered by DialFallbackDelay, and the losing ones are
+// cancelled. It returns the conn of ufrag for the address family of the
+// remote reached, and the address reached. It requires TCPMuxParams.Dialer.
+func (m *TCPMuxDefault) DialUfrag(ufrag string, raddrs []net.Addr) (net.PacketConn, net.Addr, error) {
+	if m.uninitialized {
+		return nil, nil, ErrTCPMuxNotInitialized
+	}
+	if m.params.Dialer == nil {
+		return nil, nil, errNoDialer
+	}
+	if len(raddrs) == 0 {
+		return nil, nil, errNoRemoteAddrs
+	}
+
+	conn, i, err := dialHappyEyeballs(m.params.Dialer, raddrs, m.params.DialFallbackDelay)
+	if err != nil {
+		return nil, nil, err
+	}
+	raddr := raddrs[i]
+	isIPv6 := isIPv6Addr(raddr)
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		m.closeAndLogError(conn)
+		return nil, nil, io.ErrClosedPipe
+	}
+
+	packetConn, ok := m.getConn(ufrag, isIPv6)
+	if !ok {
+		packetConn = m.createConn(ufrag, m.params.Listener.Addr(), isIPv6)
+	}
+	m.mu.Unlock()
+
+	if _, err := packetConn.addDialedConn(conn, raddr); err != nil {
+		return nil, nil, err
+	}
+
+	return packetConn, raddr, nil
+}
+
+func (m *TCPMuxDefault) createConn(ufrag string, localAddr net.Addr, isIPv6 bool) *tcpPacketConn {
+	network := NetworkTypeTCP4.String()
+	if isIPv6 {
+		network = NetworkTypeTCP6.String()
+	}
+
+	readBuffer, ok := m.readBufferSizes[ufrag]
+	if !ok {
+		readBuffer = m.params.ReadBufferSize
+	}
+	writeBuffer, ok := m.writeBufferSizes[ufrag]
+	if !ok {
+		writeBuffer = m.params.WriteBufferSize
+	}
+
+	var onConnClose func(net.Addr, error)
+	if m.params.OnConnClose != nil {
+		onConnClose = func(raddr net.Addr, err error) {
+			m.params.OnConnClose(ufrag, raddr, err)
+		}
+	}
+	var onNearFull func(net.Addr, int, int)
+	if m.params.OnWriteBufferNearFull != nil {
+		onNearFull = func(raddr net.Addr, queued, limit int) {
+			m.params.OnWriteBufferNearFull(ufrag, raddr, queued, limit)
+		}
+	}
+
+	conn := newTCPPacketConn(tcpPacketParams{
+		Ufrag:       ufrag,
+		ReadBuffer:  readBuffer,
+		WriteBuffer: writeBuffer,
+		LocalAddr:   localAddr,
+		Logger:      m.params.Logger,
+
+		WriteTimeout:        m.params.WriteTimeout,
+		WriteBatchBytes:     m.params.WriteBatchBytes,
+		WriteBufferNearFull: m.params.WriteBufferNearFull,
+		ReadRate:            m.params.MaxReadBytesPerSecond,
+		Stats:               m.stats,
+
+		WriteBufferLowWatermark: m.params.WriteBufferLowWatermark,
+		WriteBufferBlocking:     m.params.WriteBufferBlocking,
+		OnWriteBufferNearFull:   onNearFull,
+
+		FrameCodec:      m.params.FrameCodec,
+		PoolReadBuffers: m.params.PoolReadBuffers,
+		ReadBufferPool:  m.readBufferPool,
+		ReceiveMTU:      m.receiveMTUs[ufrag],
+		KeyFunc:         m.params.RemoteKeyFunc,
+		ConnKey:         m.params.ConnKey,
+		DuplicatePolicy: m.params.DuplicateConnPolicy,
+
+		AllowFragmentation: m.params.AllowFragmentation,
+		StrictBoundaries:   m.params.StrictBoundaries,
+		OnConnClose:        onConnClose,
+		OnConnChange: func(raddr net.Addr, added bool) {
+			typ := MuxEventConnRemoved
+			if added {
+				typ = MuxEventConnAdded
+			}
+			m.emit(typ, ufrag, raddr)
+		},
+
+		Dialer:   m.params.Dialer,
+		Network:  network,
+		ConnPool: m.connPool,
+
+		Migrations: m.migrations,
+	})
+
+	if isIPv6 {
+		m.connsIPv6[ufrag] = conn
+	} else {
+		m.connsIPv4[ufrag] = conn
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		<-conn.CloseChannel()
+
+		// Unless conn was already removed, and maybe replaced by a new conn
+		// for the same ufrag that must be left alone.
+		var removed []*tcpPacketConn
+		m.mu.Lock()
+		if current, ok := m.getRegisteredConn(ufrag, isIPv6); ok && current == conn {
+			removed = m.takeConnsByUfrag(ufrag)
+		}
+		m.mu.Unlock()
+
+		m.closeConns(removed)
+	}()
+
+	return conn
+}
+
+// connLogger returns the logger for the messages about conn, before its ufrag
+// is known.
+func (m *TCPMuxDefault) connLogger(conn net.Conn) logging.LeveledLogger {
+	return withLogFields(m.params.Logger, "remote", conn.RemoteAddr().String())
+}
+
+// ufragLogger returns the logger for the messages about conn once its ufrag
+// is known.
+func (m *TCPMuxDefault) ufragLogger(conn net.Conn, ufrag string) logging.LeveledLogger {
+	if serverName := tlsServerName(conn); serverName != "" {
+		return withLogFields(m.params.Logger, "ufrag", ufrag, "remote", conn.RemoteAddr().String(), "sni", serverName)
+	}
+	return withLogFields(m.params.Logger, "ufrag", ufrag, "remote", conn.RemoteAddr().String())
+}
+
+// tlsServerName returns the server name requested by the client of conn if
+// it is a *tls.Conn, once its handshake is done.
+func tlsServerName(conn net.Conn) string {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState().ServerName
+	}
+	return ""
+}
+
+func (m *TCPMuxDefault) closeAndLogError(closer io.Closer) {
+	err := closer.Close()
+	if err != nil {
+		m.params.Logger.Warnf("Error closing connection: %s", err)
+	}
+}
+
+// closeConns closes conns concurrently and returns the errors of those that
+// failed, which are logged. As closing a tcpPacketConn waits for its queued
+// packets to be written, it must be called without holding mu.
+func (m *TCPMuxDefault) closeConns(conns []*tcpPacketConn) []error {
+	closers := make([]io.Closer, len(conns))
+	for i, conn := range conns {
+		closers[i] = conn
+	}
+
+	errs := closeConcurrently(closers)
+	for _, err := range errs {
+		m.params.Logger.Warnf("Error closing connection: %s", err)
+	}
+	return errs
+}
+
+// configureConn applies the socket options from TCPMuxParams to conn.
+func (m *TCPMuxDefault) configureConn(conn net.Conn) error {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		noDelay := m.params.NoDelay == nil || *m.params.NoDelay
+		if err := tcpConn.SetNoDelay(noDelay); err != nil {
+			return err
+		}
+
+		if err := m.configureKeepAlive(tcpConn); err != nil {
+			return err
+		}
+
+		if m.params.DSCP != 0 {
+			// Marking is best effort, failing to set it doesn't reject the conn.
+			if err := setDSCP(tcpConn, m.params.DSCP); errors.Is(err, errSocketOptionUnsupported) {
+				m.connLogger(conn).Debugf("event=dscp_unsupported: DSCP marking is not supported")
+			} else if err != nil {
+				m.connLogger(conn).Warnf("event=dscp_failed: %s", err)
+			}
+		}
+	} else if m.params.DSCP != 0 {
+		m.connLogger(conn).Debugf("event=dscp_unsupported: DSCP marking is not supported for %T", conn)
+	}
+
+	if m.params.ConnControl != nil {
+		return m.params.ConnControl(conn)
+	}
+
+	return nil
+}
+
+func (m *TCPMuxDefault) configureKeepAlive(conn *net.TCPConn) error {
+	if m.params.KeepAliveIdle == 0 && m.params.KeepAliveInterval == 0 {
+		return nil
+	}
+
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+
+	// SetKeepAlivePeriod sets the probe interval too on some platforms, so
+	// it must be applied before the interval.
+	if m.params.KeepAliveIdle != 0 {
+		if err := conn.SetKeepAlivePeriod(m.params.KeepAliveIdle); err != nil {
+			return err
+		}
+	}
 
-		m.wg.Add(1)
-		go func() {
-			defer m.wg.Done()
-			m.handleConn(conn)
-		}()
+	if m.params.KeepAliveInterval != 0 {
+		if err := setKeepAliveInterval(conn, m.params.KeepAliveInterval); errors.Is(err, errSocketOptionUnsupported) {
+			m.connLogger(conn).Debugf("event=keepalive_unsupported: keepalive interval is not supported")
+		} else if err != nil {
+			return err
+		}
 	}
-}
 
-// LocalAddr returns the listening address of this TCPMuxDefault.
-func (m *TCPMuxDefault) LocalAddr() net.Addr {
-	return m.params.Listener.Addr()
+	return nil
 }
 
-// GetConnByUfrag retrieves an existing or creates a new net.PacketConn.
-func (m *TCPMuxDefault) GetConnByUfrag(ufrag string, isIPv6 bool) (net.PacketConn, error) {
+// HandleConn routes a connection that was accepted outside of the mux, for
+// example from a listener shared with another protocol, as if it had been
+// accepted from the mux's listener. It blocks until the first packet has been
+// read and the connection added to its ufrag. The connection is closed if it
+// can't be routed or if the mux is closed.
+func (m *TCPMuxDefault) HandleConn(conn net.Conn) error {
+	if m.uninitialized {
+		m.closeAndLogError(conn)
+		return ErrTCPMuxNotInitialized
+	}
+
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	closed := m.closed
+	m.mu.Unlock()
 
-	if m.closed {
-		return nil, io.ErrClosedPipe
+	if closed {
+		m.closeAndLogError(conn)
+		return io.ErrClosedPipe
 	}
 
-	if conn, ok := m.getConn(ufrag, isIPv6); ok {
-		return conn, nil
+	return m.handleConn(conn)
+}
+
+// handleConn reads the first packet from conn and adds conn to the
+// tcpPacketConn of the ufrag found in it. conn is closed on error.
+func (m *TCPMuxDefault) handleConn(conn net.Conn) (err error) {
+	var (
+		ufrag   string
+		claimed bool
+	)
+	start := time.Now()
+	var endHandshake func(string, error)
+	if m.params.Tracer != nil {
+		endHandshake = m.params.Tracer.StartHandshake(conn)
 	}
+	log := m.connLogger(conn)
 
-	return m.createConn(ufrag, m.LocalAddr(), isIPv6), nil
-}
+	atomic.AddInt64(&m.stats.activeHandshakes, 1)
+	defer atomic.AddInt64(&m.stats.activeHandshakes, -1)
 
-func (m *TCPMuxDefault) createConn(ufrag string, localAddr net.Addr, isIPv6 bool) *tcpPacketConn {
-	conn := newTCPPacketConn(tcpPacketParams{
-		ReadBuffer:  m.params.ReadBufferSize,
-		WriteBuffer: m.params.WriteBufferSize,
-		LocalAddr:   localAddr,
-		Logger:      m.params.Logger,
-	})
+	defer func() {
+		if err == nil && !claimed {
+			m.stats.addHandshake(time.Since(start))
+		}
+		if err != nil {
+			m.closeAndLogError(conn)
+			if errors.Is(err, io.ErrClosedPipe) {
+				m.stats.addClose(closeReasonExplicit)
+			} else {
+				m.stats.addClose(closeReasonRejected)
+				if m.params.QuietRejections && isRoutineRejection(err) {
+					log.Debugf("event=%s: %s", closeReasonRejected, err)
+				} else {
+					log.Warnf("event=%s: %s", closeReasonRejected, err)
+				}
+			}
+		}
+		if endHandshake != nil {
+			endHandshake(ufrag, err)
+		}
+	}()
 
-	if isIPv6 {
-		m.connsIPv6[ufrag] = conn
-	} else {
-		m.connsIPv4[ufrag] = conn
+	if err := m.configureConn(conn); err != nil {
+		return fmt.Errorf("%w: %v", errConfigureConn, err)
 	}
 
-	m.wg.Add(1)
-	go func() {
-		defer m.wg.Done()
-		<-conn.CloseChannel()
-		m.RemoveConnByUfrag(ufrag)
-	}()
+	var peeked *peekedConn
+	if m.params.ClassifyConn != nil {
+		peeked = newPeekedConn(conn, m.params.MaxHandshakeFrameSize)
+		peek, peekErr := peeked.peek()
+		if peekErr != nil {
+			return fmt.Errorf("%w: %v", errReadingStreamingPacket, peekErr)
+		}
 
-	return conn
-}
+		if m.params.ClassifyConn(peeked, peek) {
+			claimed = true
+			log.Debugf("event=claimed: by ClassifyConn")
+			return nil
+		}
+		conn = peeked
+	}
 
-func (m *TCPMuxDefault) closeAndLogError(closer io.Closer) {
-	err := closer.Close()
-	if err != nil {
-		m.params.Logger.Warnf("Error closing connection: %s", err)
+	// The first packet is copied out of buf, which can come from the pool
+	// unless it must be larger than the pooled buffers.
+	var buf []byte
+	if m.params.MaxHandshakeFrameSize <= receiveMTU {
+		pooled := m.readBufferPool.Get().(*[]byte) //nolint:forcetypeassert
+		defer m.readBufferPool.Put(pooled)
+		buf = (*pooled)[:m.params.MaxHandshakeFrameSize]
+	} else {
+		buf = make([]byte, m.params.MaxHandshakeFrameSize)
 	}
-}
 
-func (m *TCPMuxDefault) handleConn(conn net.Conn) {
-	buf := make([]byte, receiveMTU)
+	n, err := m.params.FrameCodec.ReadFrame(conn, buf)
+	if errors.Is(err, io.ErrShortBuffer) {
+		return fmt.Errorf("%w: %d bytes", errHandshakeFrameTooLarge, n)
+	} else if err != nil {
+		return fmt.Errorf("%w: %v", errReadingStreamingPacket, err)
+	}
 
-	n, err := readStreamingPacket(conn, buf)
-	if err != nil {
-		m.params.Logger.Warnf("Error reading first packet from %s: %s", conn.RemoteAddr().String(), err)
-		return
+	// The conn is used directly again, the bytes peeked past the first frame
+	// are read before it.
+	var leftover []byte
+	if peeked != nil {
+		if buffered := peeked.reader.Buffered(); buffered > 0 {
+			leftover = make([]byte, buffered)
+			_, _ = io.ReadFull(peeked.reader, leftover)
+		}
+		conn = peeked.Conn
 	}
 
 	buf = buf[:n]
+	m.stats.addRead(n)
 
 	msg := &stun.Message{
 		Raw: make([]byte, len(buf)),
@@ -178,95 +1625,408 @@ func (m *TCPMuxDefault) handleConn(conn net.Conn) {
 	// Explicitly copy raw buffer so Message can own the memory.
 	copy(msg.Raw, buf)
 	if err = msg.Decode(); err != nil {
-		m.closeAndLogError(conn)
-		m.params.Logger.Warnf("Failed to handle decode ICE from %s to %s: %v", conn.RemoteAddr(), conn.LocalAddr(), err)
-		return
+		atomic.AddUint64(&m.stats.stunDecodeFailures, 1)
+		return fmt.Errorf("%w: %v", errDecodeSTUNMessage, err)
 	}
 
-	if m == nil || msg.Type.Method != stun.MethodBinding { // not a stun
-		m.closeAndLogError(conn)
-		m.params.Logger.Warnf("Not a STUN message from %s to %s", conn.RemoteAddr(), conn.LocalAddr())
-		return
+	if msg.Type.Method != stun.MethodBinding && !m.params.RouteAnySTUNMessage { // not a stun
+		atomic.AddUint64(&m.stats.nonBindingMessages, 1)
+		return errNotSTUNBindingMessage
 	}
 
 	for _, attr := range msg.Attributes {
-		m.params.Logger.Debugf("msg attr: %s", attr.String())
+		log.Debugf("event=stun_attr: %s", attr.String())
 	}
 
 	attr, err := msg.Get(stun.AttrUsername)
 	if err != nil {
-		m.closeAndLogError(conn)
-		m.params.Logger.Warnf("No Username attribute in STUN message from %s to %s", conn.RemoteAddr(), conn.LocalAddr())
-		return
+		atomic.AddUint64(&m.stats.missingUsernames, 1)
+		return errMissingUsernameAttr
 	}
 
-	ufrag := strings.Split(string(attr), ":")[0]
-	m.params.Logger.Debugf("Ufrag: %s", ufrag)
+	// The username is "ufrag:remoteufrag", only the local part is routed on.
+	ufrag = strings.SplitN(string(attr), ":", 2)[0]
+	log = m.ufragLogger(conn, ufrag)
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	return m.routeConn(conn, ufrag, msg, leftover)
+}
 
-	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
-	if err != nil {
-		m.closeAndLogError(conn)
-		m.params.Logger.Warnf("Failed to get host in STUN message from %s to %s", conn.RemoteAddr(), conn.LocalAddr())
-		return
+// routineRejections are the errors of handleConn caused by what the remote
+// sent rather than by the mux, see QuietRejections.
+var routineRejections = []error{ //nolint:gochecknoglobals
+	errReadingStreamingPacket,
+	errHandshakeFrameTooLarge,
+	errDecodeSTUNMessage,
+	errNotSTUNBindingMessage,
+	errMissingUsernameAttr,
+	errEmptyUfrag,
+	errInvalidUfrag,
+}
+
+// isRoutineRejection returns whether err is one of routineRejections.
+func isRoutineRejection(err error) bool {
+	for _, routine := range routineRejections {
+		if errors.Is(err, routine) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIPv6Conn returns whether conn belongs to the IPv6 conns of the ufrags.
+// Connections whose remote address has no IP, as on Unix sockets, fall back to
+// the family of their local address with ConnKey, and to NonIPRemoteIPv6.
+func (m *TCPMuxDefault) isIPv6Conn(conn net.Conn) bool {
+	addrs := []net.Addr{conn.RemoteAddr()}
+	if m.params.ConnKey != nil {
+		addrs = append(addrs, conn.LocalAddr())
+	}
+
+	for _, addr := range addrs {
+		if addr == nil {
+			continue
+		}
+		if ip, err := hostIP(addr); err == nil && ip != nil {
+			return ip.To4() == nil
+		}
+	}
+
+	return m.params.NonIPRemoteIPv6
+}
+
+// routeConn adds conn to the tcpPacketConn of ufrag, creating it if needed,
+// with msg as the binding request that was used to route it and leftover as
+// the bytes already read past it.
+func (m *TCPMuxDefault) routeConn(conn net.Conn, ufrag string, msg *stun.Message, leftover []byte) error {
+	if err := validateUfrag(ufrag, m.params.StrictUfrag); err != nil {
+		atomic.AddUint64(&m.stats.invalidUfrags, 1)
+		return err
+	}
+
+	isIPv6 := m.isIPv6Conn(conn)
+
+	var firstPacketData []byte
+	if m.params.DeliverFirstPacket == nil || *m.params.DeliverFirstPacket {
+		firstPacketData = msg.Raw
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return io.ErrClosedPipe
 	}
 
-	isIPv6 := net.ParseIP(host).To4() == nil
 	packetConn, ok := m.getConn(ufrag, isIPv6)
 	if !ok {
 		packetConn = m.createConn(ufrag, conn.LocalAddr(), isIPv6)
 	}
 
-	if err := packetConn.AddConn(conn, buf); err != nil {
-		m.closeAndLogError(conn)
-		m.params.Logger.Warnf("Error adding conn to tcpPacketConn from %s to %s: %s", conn.RemoteAddr(), conn.LocalAddr(), err)
-		return
+	if err := packetConn.AddConnWithLeftover(conn, firstPacketData, leftover); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+
+	serverName := tlsServerName(conn)
+	if serverName != "" {
+		if m.serverNameConns == nil {
+			m.serverNameConns = map[string]uint64{}
+		}
+		m.serverNameConns[serverName]++
+	}
+	m.mu.Unlock()
+
+	m.ufragLogger(conn, ufrag).Debugf("event=routed: connection to %s", conn.LocalAddr())
+
+	// The callbacks run outside of the lock so they may call back into the
+	// mux.
+	if m.params.OnBindingRequest != nil {
+		m.params.OnBindingRequest(ufrag, msg, conn.RemoteAddr())
+	}
+	if m.params.OnConn != nil {
+		m.params.OnConn(ufrag, conn.RemoteAddr(), serverName)
+	}
+
+	return nil
+}
+
+// migrateConns routes the conns handed over by the tcpPacketConns on an ICE
+// restart to their new ufrag until the mux is closed.
+func (m *TCPMuxDefault) migrateConns() {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case migration := <-m.migrations:
+			err := m.routeConn(migration.Conn, migration.Ufrag, migration.Msg, migration.Leftover)
+			if err != nil {
+				m.closeAndLogError(migration.Conn)
+				if !errors.Is(err, io.ErrClosedPipe) {
+					m.ufragLogger(migration.Conn, migration.Ufrag).Warnf("event=migration_failed: %s", err)
+				}
+			}
+		case <-m.closedChan:
+			return
+		}
+	}
+}
+
+// validateUfrag checks that ufrag isn't empty and, if strict, that it is a
+// valid ICE ufrag: https://tools.ietf.org/html/rfc5245#section-15.4
+//
+//	ufrag    = 4*256ice-char
+//	ice-char = ALPHA / DIGIT / "+" / "/"
+func validateUfrag(ufrag string, strict bool) error {
+	if ufrag == "" {
+		return errEmptyUfrag
+	}
+	if !strict {
+		return nil
+	}
+
+	if len(ufrag) < minUfragLen || len(ufrag) > maxUfragLen {
+		return fmt.Errorf("%w: length %d", errInvalidUfrag, len(ufrag))
+	}
+	for _, r := range ufrag {
+		if !strings.ContainsRune(runesCandidateIDFoundation, r) {
+			return fmt.Errorf("%w: character %q", errInvalidUfrag, r)
+		}
 	}
+
+	return nil
 }
 
-// Close closes the listener and waits for all goroutines to exit.
+// Close closes the listener and the connections and waits for all goroutines
+// to exit. It returns the errors from closing them joined together. Later
+// calls wait for the first one to finish and return the same error.
 func (m *TCPMuxDefault) Close() error {
+	if m.uninitialized {
+		m.notifyClose(ErrTCPMuxNotInitialized)
+		return ErrTCPMuxNotInitialized
+	}
+
 	m.mu.Lock()
-	m.closed = true
+	if m.closed {
+		m.mu.Unlock()
 
-	for _, conn := range m.connsIPv4 {
-		m.closeAndLogError(conn)
+		// The first Close may still be shutting down.
+		<-m.doneChan
+		return m.closeErr
 	}
-	for _, conn := range m.connsIPv6 {
-		m.closeAndLogError(conn)
+	close(m.closedChan)
+	m.closed = true
+
+	var conns []*tcpPacketConn
+	for _, byUfrag := range []map[string]*tcpPacketConn{m.connsIPv4, m.connsIPv6} {
+		for _, conn := range byUfrag {
+			conns = append(conns, conn)
+		}
 	}
 
 	m.connsIPv4 = map[string]*tcpPacketConn{}
 	m.connsIPv6 = map[string]*tcpPacketConn{}
+	m.userData = map[string]interface{}{}
+
+	if m.connPool != nil {
+		m.connPool.close()
+	}
 
-	err := m.params.Listener.Close()
+	listenerErr := m.params.Listener.Close()
 
 	m.mu.Unlock()
 
+	err := joinErrors(append(m.closeConns(conns), listenerErr)...)
+
 	m.wg.Wait()
+	if m.connPool != nil {
+		m.connPool.wg.Wait()
+	}
+
+	m.closeErr = err
+	m.doneOnce.Do(m.shutDown)
+
+	m.notifyClose(err)
 
 	return err
 }
 
+// shutDown closes doneChan and events, once nothing can emit events anymore.
+func (m *TCPMuxDefault) shutDown() {
+	m.eventsMu.Lock()
+	m.eventsClosed = true
+	close(m.events)
+	m.eventsMu.Unlock()
+
+	close(m.doneChan)
+}
+
+// Events returns a channel receiving an event whenever a connection is added
+// to or removed from any ufrag. Events are dropped rather than delivered late
+// if the consumer falls behind, so as not to stall the connections. The
+// channel is closed once the mux has shut down, see Done.
+func (m *TCPMuxDefault) Events() <-chan MuxEvent {
+	return m.events
+}
+
+// emit sends an event of typ to Events, unless its buffer is full.
+func (m *TCPMuxDefault) emit(typ MuxEventType, ufrag string, remote net.Addr) {
+	m.eventsMu.RLock()
+	defer m.eventsMu.RUnlock()
+
+	if m.eventsClosed {
+		return
+	}
+
+	select {
+	case m.events <- MuxEvent{Type: typ, Ufrag: ufrag, Remote: remote}:
+	default:
+		m.params.Logger.Debugf("event=event_dropped: %s for ufrag %s", typ, ufrag)
+	}
+}
+
+func (m *TCPMuxDefault) notifyClose(err error) {
+	if m.params.OnClose == nil {
+		return
+	}
+
+	m.onCloseOnce.Do(func() {
+		m.params.OnClose(err)
+	})
+}
+
+// SetWriteBufferForUfrag overrides WriteBufferSize for the connections of
+// ufrag. Connections added after the call get a buffer of size, existing
+// buffered ones have their limit changed without losing queued packets, and
+// existing unbuffered ones stay unbuffered. The override is dropped by
+// RemoveConnByUfrag.
+func (m *TCPMuxDefault) SetWriteBufferForUfrag(ufrag string, size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.writeBufferSizes[ufrag] = size
+
+	if conn, ok := m.connsIPv4[ufrag]; ok {
+		conn.SetWriteBufferSize(size)
+	}
+	if conn, ok := m.connsIPv6[ufrag]; ok {
+		conn.SetWriteBufferSize(size)
+	}
+}
+
+// SetReadBufferForUfrag overrides ReadBufferSize for ufrag, resizing the
+// receive queues of its net.PacketConns without losing queued packets. The
+// override is dropped by RemoveConnByUfrag.
+func (m *TCPMuxDefault) SetReadBufferForUfrag(ufrag string, size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.readBufferSizes[ufrag] = size
+
+	if conn, ok := m.connsIPv4[ufrag]; ok {
+		conn.SetReadBufferSize(size)
+	}
+	if conn, ok := m.connsIPv6[ufrag]; ok {
+		conn.SetReadBufferSize(size)
+	}
+}
+
+// SetUserData associates v with ufrag, replacing any previous value, so that
+// it can be retrieved with UserData. The value is dropped by
+// RemoveConnByUfrag, which also runs when the net.PacketConns of ufrag are
+// closed, and by Close. A nil v removes the value.
+func (m *TCPMuxDefault) SetUserData(ufrag string, v interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if v == nil {
+		delete(m.userData, ufrag)
+		return
+	}
+	m.userData[ufrag] = v
+}
+
+// UserData returns the value set by SetUserData for ufrag, or nil if there is
+// none.
+func (m *TCPMuxDefault) UserData(ufrag string) interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.userData[ufrag]
+}
+
 // RemoveConnByUfrag closes and removes a net.PacketConn by Ufrag.
 func (m *TCPMuxDefault) RemoveConnByUfrag(ufrag string) {
+	m.RemoveConnByUfragCount(ufrag)
+}
+
+// RemoveConnByUfragCount is like RemoveConnByUfrag but returns the number of
+// net.PacketConns removed across both address families, 0 if ufrag had none.
+func (m *TCPMuxDefault) RemoveConnByUfragCount(ufrag string) int {
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	conns := m.takeConnsByUfrag(ufrag)
+	m.mu.Unlock()
+
+	m.closeConns(conns)
+
+	return len(conns)
+}
 
+// takeConnsByUfrag removes the net.PacketConns of ufrag, along with its
+// overrides and user data, and returns them for the caller to close once mu
+// is released. Must be called with mu held.
+func (m *TCPMuxDefault) takeConnsByUfrag(ufrag string) []*tcpPacketConn {
+	delete(m.readBufferSizes, ufrag)
+	delete(m.writeBufferSizes, ufrag)
+	delete(m.receiveMTUs, ufrag)
+	delete(m.userData, ufrag)
+
+	var conns []*tcpPacketConn
 	if conn, ok := m.connsIPv4[ufrag]; ok {
-		m.closeAndLogError(conn)
+		conns = append(conns, conn)
 		delete(m.connsIPv4, ufrag)
 	}
-
 	if conn, ok := m.connsIPv6[ufrag]; ok {
-		m.closeAndLogError(conn)
+		conns = append(conns, conn)
 		delete(m.connsIPv6, ufrag)
 	}
+
+	return conns
+}
+
+// DrainConnByUfrag removes the net.PacketConns of ufrag like
+// RemoveConnByUfrag, but first waits for their buffered writes to be flushed
+// so the last packets of a session aren't dropped. It returns once all conns
+// are drained and closed, or errFlushTimeout if timeout elapsed first.
+func (m *TCPMuxDefault) DrainConnByUfrag(ufrag string, timeout time.Duration) error {
+	m.mu.Lock()
+	conns := m.takeConnsByUfrag(ufrag)
+	m.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+
+	var drainErr error
+	for _, conn := range conns {
+		if err := conn.Drain(time.Until(deadline)); err != nil && drainErr == nil {
+			drainErr = err
+		}
+	}
+
+	return drainErr
+}
+
+// getConn returns the conn of ufrag for the address family. A conn that was
+// closed but not removed yet is not returned, so that it is replaced by a new
+// one: closed conns are never reused.
+func (m *TCPMuxDefault) getConn(ufrag string, isIPv6 bool) (*tcpPacketConn, bool) {
+	conn, ok := m.getRegisteredConn(ufrag, isIPv6)
+	if !ok || conn.isClosed() {
+		return nil, false
+	}
+
+	return conn, true
 }
 
-func (m *TCPMuxDefault) getConn(ufrag string, isIPv6 bool) (val *tcpPacketConn, ok bool) {
+// getRegisteredConn returns the conn stored for ufrag, even if closed.
+func (m *TCPMuxDefault) getRegisteredConn(ufrag string, isIPv6 bool) (val *tcpPacketConn, ok bool) {
 	if isIPv6 {
 		val, ok = m.connsIPv6[ufrag]
 	} else {
@@ -276,7 +2036,53 @@ func (m *TCPMuxDefault) getConn(ufrag string, isIPv6 bool) (val *tcpPacketConn,
 	return
 }
 
-const streamingPacketHeaderLen = 2
+const (
+	// streamingPacketHeaderLen is the RFC 4571 length header size.
+	streamingPacketHeaderLen = 2
+	// streamingPacketHeaderLenExtended is a non-standard 4-byte length header.
+	streamingPacketHeaderLenExtended = 4
+)
+
+// FrameCodec delimits the packets sent over a stream connection.
+type FrameCodec interface {
+	// ReadFrame reads the next packet from conn into buf and returns its
+	// length.
+	ReadFrame(conn net.Conn, buf []byte) (int, error)
+
+	// WriteFrame writes buf to conn as a single packet and returns the number
+	// of bytes of buf written. The framed packet must be written with a
+	// single Write call, adding at most maxFrameOverhead bytes, so that it
+	// keeps its boundaries in a write buffer.
+	WriteFrame(conn net.Conn, buf []byte) (int, error)
+}
+
+// maxFrameOverhead is the most bytes a FrameCodec may add to a packet.
+const maxFrameOverhead = 16
+
+// streamingPacketCodec is the default FrameCodec, framing packets with the
+// length header of RFC 4571.
+type streamingPacketCodec struct {
+	headerLen int
+}
+
+func (c streamingPacketCodec) ReadFrame(conn net.Conn, buf []byte) (int, error) {
+	return readStreamingPacket(conn, buf, c.headerLen)
+}
+
+func (c streamingPacketCodec) WriteFrame(conn net.Conn, buf []byte) (int, error) {
+	return writeStreamingPacket(conn, buf, c.headerLen)
+}
+
+// maxStreamingPacketLen returns the largest payload a length header of
+// headerLen bytes can describe. With the extended header the conns bound it
+// further: a bufferedConn holds frames of up to maxBufferedFrameLen bytes and
+// the reader only accepts packets up to its receive MTU.
+func maxStreamingPacketLen(headerLen int) int {
+	if headerLen == streamingPacketHeaderLenExtended {
+		return math.MaxInt32
+	}
+	return math.MaxUint16
+}
 
 // readStreamingPacket reads 1 packet from stream
 // read packet  bytes https://tools.ietf.org/html/rfc4571#section-2
@@ -286,27 +2092,53 @@ const streamingPacketHeaderLen = 2
 //    -----------------------------------------------------------------
 //    |             LENGTH            |  RTP or RTCP packet ...       |
 //    -----------------------------------------------------------------
-func readStreamingPacket(conn net.Conn, buf []byte) (int, error) {
-	header := make([]byte, streamingPacketHeaderLen)
+// headerLen selects the width of the LENGTH field, either 2 or 4 bytes.
+func readStreamingPacket(conn net.Conn, buf []byte, headerLen int) (int, error) {
+	length, err := readStreamingPacketHeader(conn, make([]byte, headerLen))
+	if err != nil {
+		return 0, err
+	}
+
+	if length > len(buf) {
+		return length, io.ErrShortBuffer
+	}
+
+	return readStreamingPacketPayload(conn, buf[:length])
+}
+
+// readStreamingPacketHeader reads a length header of len(header) bytes into
+// header and returns the length of the packet that follows.
+func readStreamingPacketHeader(conn net.Conn, header []byte) (int, error) {
 	var bytesRead, n int
 	var err error
 
-	for bytesRead < streamingPacketHeaderLen {
-		if n, err = conn.Read(header[bytesRead:streamingPacketHeaderLen]); err != nil {
+	for bytesRead < len(header) {
+		if n, err = conn.Read(header[bytesRead:]); err != nil {
+			if bytesRead > 0 && errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
 			return 0, err
 		}
 		bytesRead += n
 	}
 
-	length := int(binary.BigEndian.Uint16(header))
-
-	if length > cap(buf) {
-		return length, io.ErrShortBuffer
+	if len(header) == streamingPacketHeaderLenExtended {
+		return int(binary.BigEndian.Uint32(header)), nil
 	}
+	return int(binary.BigEndian.Uint16(header)), nil
+}
 
-	bytesRead = 0
-	for bytesRead < length {
-		if n, err = conn.Read(buf[bytesRead:length]); err != nil {
+// readStreamingPacketPayload fills buf with the payload of a packet whose
+// header was read.
+func readStreamingPacketPayload(conn net.Conn, buf []byte) (int, error) {
+	// The stream only ends cleanly between packets.
+	var bytesRead, n int
+	var err error
+	for bytesRead < len(buf) {
+		if n, err = conn.Read(buf[bytesRead:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
 			return 0, err
 		}
 		bytesRead += n
@@ -315,15 +2147,58 @@ func readStreamingPacket(conn net.Conn, buf []byte) (int, error) {
 	return bytesRead, nil
 }
 
-func writeStreamingPacket(conn net.Conn, buf []byte) (int, error) {
-	bufferCopy := make([]byte, streamingPacketHeaderLen+len(buf))
-	binary.BigEndian.PutUint16(bufferCopy, uint16(len(buf)))
-	copy(bufferCopy[2:], buf)
+// putStreamingPacketHeader writes the length header for a packet of length
+// bytes to the start of buf.
+func putStreamingPacketHeader(buf []byte, length, headerLen int) {
+	if headerLen == streamingPacketHeaderLenExtended {
+		binary.BigEndian.PutUint32(buf, uint32(length))
+	} else {
+		binary.BigEndian.PutUint16(buf, uint16(length))
+	}
+}
+
+func writeStreamingPacket(conn net.Conn, buf []byte, headerLen int) (int, error) {
+	if len(buf) > maxStreamingPacketLen(headerLen) {
+		return 0, fmt.Errorf("%w: %d bytes", errStreamingPacketTooLarge, len(buf))
+	}
+
+	bufferCopy := make([]byte, headerLen+len(buf))
+	putStreamingPacketHeader(bufferCopy, len(buf), headerLen)
+	copy(bufferCopy[headerLen:], buf)
 
-	n, err := conn.Write(bufferCopy)
-	if err != nil {
+	if err := writeFull(conn, bufferCopy); err != nil {
 		return 0, err
 	}
 
-	return n - streamingPacketHeaderLen, nil
+	return len(buf), nil
+}
+
+// writeFull writes all of b to conn, retrying after short writes so that a
+// frame is never left half written. A write that makes no progress without an
+// error fails with io.ErrShortWrite instead of being retried forever.
+func writeFull(conn net.Conn, b []byte) error {
+	_, err := fullWriter{conn}.Write(b)
+	return err
+}
+
+// fullWriter is a net.Conn whose writes are retried after short writes, see
+// writeFull.
+type fullWriter struct {
+	net.Conn
+}
+
+func (w fullWriter) Write(b []byte) (int, error) {
+	var written int
+	for written < len(b) {
+		n, err := w.Conn.Write(b[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+
+	return written, nil
 }
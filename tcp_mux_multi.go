@@ -0,0 +1,186 @@
+package ice
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// TCPMuxSelectionPolicy decides which child of a TCPMuxMulti serves a ufrag.
+type TCPMuxSelectionPolicy int
+
+const (
+	// TCPMuxSelectRoundRobin assigns the ufrags to the children in turn.
+	TCPMuxSelectRoundRobin TCPMuxSelectionPolicy = iota
+	// TCPMuxSelectLeastConns assigns a ufrag to the child with the fewest
+	// live connections, see TCPMuxStats.LiveConns, and among those to the
+	// one serving the fewest ufrags.
+	TCPMuxSelectLeastConns
+	// TCPMuxSelectWeighted assigns the ufrags to the children in proportion
+	// to their Weight, interleaving them rather than in bursts.
+	TCPMuxSelectWeighted
+)
+
+func (p TCPMuxSelectionPolicy) String() string {
+	switch p {
+	case TCPMuxSelectRoundRobin:
+		return "round_robin"
+	case TCPMuxSelectLeastConns:
+		return "least_conns"
+	case TCPMuxSelectWeighted:
+		return "weighted"
+	default:
+		return "unknown"
+	}
+}
+
+// TCPMuxMultiChild is a mux served by a TCPMuxMulti.
+type TCPMuxMultiChild struct {
+	Mux *TCPMuxDefault
+
+	// Weight is the share of the ufrags the child gets under
+	// TCPMuxSelectWeighted, relative to the other children, such as the
+	// capacity of the NIC its listener is on. 0 counts as 1.
+	Weight int
+}
+
+// TCPMuxMultiParams are the parameters of a TCPMuxMulti.
+type TCPMuxMultiParams struct {
+	// Children are the muxes the ufrags are distributed to, usually with
+	// listeners on different interfaces.
+	Children []TCPMuxMultiChild
+
+	// Policy picks the child serving each new ufrag. Defaults to
+	// TCPMuxSelectRoundRobin.
+	Policy TCPMuxSelectionPolicy
+}
+
+// TCPMuxMulti is a TCPMux spreading the ufrags over several TCPMuxDefault,
+// as when several listeners can serve them. Each ufrag is served by a single
+// child, picked by the Policy on its first GetConnByUfrag, until
+// RemoveConnByUfrag. Its host candidate then has the address of the listener
+// of that child.
+type TCPMuxMulti struct {
+	params TCPMuxMultiParams
+
+	mu     sync.Mutex
+	closed bool
+
+	// ufrags is the child serving each ufrag.
+	ufrags map[string]*TCPMuxDefault
+
+	// next is the next child under TCPMuxSelectRoundRobin, current the
+	// current weights of the children under TCPMuxSelectWeighted.
+	next    int
+	current []int
+}
+
+// NewTCPMuxMulti creates a TCPMuxMulti over the children of params. The
+// children are owned by the TCPMuxMulti from then on, closing it closes
+// them.
+func NewTCPMuxMulti(params TCPMuxMultiParams) *TCPMuxMulti {
+	return &TCPMuxMulti{
+		params:  params,
+		ufrags:  map[string]*TCPMuxDefault{},
+		current: make([]int, len(params.Children)),
+	}
+}
+
+// GetConnByUfrag returns the net.PacketConn of ufrag from the child serving
+// it, picking one if ufrag has none yet.
+func (m *TCPMuxMulti) GetConnByUfrag(ufrag string, isIPv6 bool) (net.PacketConn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, io.ErrClosedPipe
+	}
+	if len(m.params.Children) == 0 {
+		return nil, ErrTCPMuxNotInitialized
+	}
+
+	mux, ok := m.ufrags[ufrag]
+	if !ok {
+		mux = m.params.Children[m.pick()].Mux
+	}
+
+	conn, err := mux.GetConnByUfrag(ufrag, isIPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	m.ufrags[ufrag] = mux
+	return conn, nil
+}
+
+// pick returns the index of the child to serve a new ufrag. Must be called
+// with mu held.
+func (m *TCPMuxMulti) pick() int {
+	children := m.params.Children
+
+	switch m.params.Policy {
+	case TCPMuxSelectLeastConns:
+		served := make(map[*TCPMuxDefault]int, len(children))
+		for _, mux := range m.ufrags {
+			served[mux]++
+		}
+
+		best, bestConns := 0, 0
+		for i, child := range children {
+			conns := child.Mux.Stats().LiveConns
+			if i == 0 || conns < bestConns || (conns == bestConns && served[child.Mux] < served[children[best].Mux]) {
+				best, bestConns = i, conns
+			}
+		}
+		return best
+	case TCPMuxSelectWeighted:
+		// Smooth weighted round-robin: every child gains its weight, the
+		// richest is picked and pays back the total.
+		best, total := 0, 0
+		for i, child := range children {
+			weight := child.Weight
+			if weight <= 0 {
+				weight = 1
+			}
+			total += weight
+			m.current[i] += weight
+			if m.current[i] > m.current[best] {
+				best = i
+			}
+		}
+		m.current[best] -= total
+		return best
+	default:
+		i := m.next
+		m.next = (m.next + 1) % len(children)
+		return i
+	}
+}
+
+// RemoveConnByUfrag removes the conns of ufrag from the child serving it, a
+// later GetConnByUfrag picks a child again.
+func (m *TCPMuxMulti) RemoveConnByUfrag(ufrag string) {
+	m.mu.Lock()
+	mux, ok := m.ufrags[ufrag]
+	delete(m.ufrags, ufrag)
+	m.mu.Unlock()
+
+	if ok {
+		mux.RemoveConnByUfrag(ufrag)
+	}
+}
+
+// Close closes the children. It returns their errors joined together, or
+// nil if all closed cleanly.
+func (m *TCPMuxMulti) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	m.ufrags = map[string]*TCPMuxDefault{}
+	m.mu.Unlock()
+
+	var errs []error
+	for _, child := range m.params.Children {
+		errs = append(errs, child.Mux.Close())
+	}
+	return joinErrors(errs...)
+}
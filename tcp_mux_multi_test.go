@@ -0,0 +1,161 @@
+package ice
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTCPMuxMulti returns a TCPMuxMulti over a TCPMuxDefault per weight.
+func newTestTCPMuxMulti(t *testing.T, policy TCPMuxSelectionPolicy, weights ...int) (*TCPMuxMulti, []*TCPMuxDefault) {
+	t.Helper()
+
+	children := make([]TCPMuxMultiChild, len(weights))
+	muxes := make([]*TCPMuxDefault, len(weights))
+	for i, weight := range weights {
+		muxes[i] = newTestTCPMux(t, TCPMuxParams{})
+		children[i] = TCPMuxMultiChild{Mux: muxes[i], Weight: weight}
+	}
+
+	return NewTCPMuxMulti(TCPMuxMultiParams{Children: children, Policy: policy}), muxes
+}
+
+// servingMux returns the index of the mux whose listener conn is on.
+func servingMux(t *testing.T, muxes []*TCPMuxDefault, conn net.PacketConn) int {
+	t.Helper()
+
+	for i, mux := range muxes {
+		if mux.LocalAddr().String() == conn.LocalAddr().String() {
+			return i
+		}
+	}
+	require.Fail(t, "conn of no child", conn.LocalAddr().String())
+	return -1
+}
+
+func TestTCPMuxMulti_Policies(t *testing.T) {
+	for _, tc := range []struct {
+		policy   TCPMuxSelectionPolicy
+		weights  []int
+		expected []int
+	}{
+		{TCPMuxSelectRoundRobin, []int{0, 0, 0}, []int{0, 1, 2, 0, 1, 2}},
+		{TCPMuxSelectWeighted, []int{1, 2, 3}, []int{2, 1, 0, 2, 1, 2}},
+		// Without conns, the ufrags are spread evenly.
+		{TCPMuxSelectLeastConns, []int{0, 0, 0}, []int{0, 1, 2, 0, 1, 2}},
+	} {
+		tc := tc
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			report := test.CheckRoutines(t)
+			defer report()
+
+			multi, muxes := newTestTCPMuxMulti(t, tc.policy, tc.weights...)
+
+			var picked []int
+			for i := range tc.expected {
+				conn, err := multi.GetConnByUfrag(fmt.Sprintf("ufrag%d", i), false)
+				require.NoError(t, err)
+				picked = append(picked, servingMux(t, muxes, conn))
+			}
+			assert.Equal(t, tc.expected, picked)
+
+			require.NoError(t, multi.Close())
+		})
+	}
+}
+
+func TestTCPMuxMulti_WeightedDistribution(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	multi, muxes := newTestTCPMuxMulti(t, TCPMuxSelectWeighted, 1, 3, 0)
+
+	served := make([]int, len(muxes))
+	for i := 0; i < 50; i++ {
+		conn, err := multi.GetConnByUfrag(fmt.Sprintf("ufrag%d", i), false)
+		require.NoError(t, err)
+		served[servingMux(t, muxes, conn)]++
+	}
+	assert.Equal(t, []int{10, 30, 10}, served)
+
+	require.NoError(t, multi.Close())
+}
+
+func TestTCPMuxMulti_LeastConns(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	multi, muxes := newTestTCPMuxMulti(t, TCPMuxSelectLeastConns, 0, 0)
+
+	// The first child is busy with a connection, the new ufrags go to the
+	// second until it is as busy.
+	dialTestTCPMux(t, muxes[0], "busy")
+	assert.Eventually(t, func() bool {
+		return muxes[0].Stats().LiveConns == 1
+	}, time.Second, time.Millisecond)
+
+	for _, ufrag := range []string{"a", "b"} {
+		conn, err := multi.GetConnByUfrag(ufrag, false)
+		require.NoError(t, err)
+		assert.Equal(t, 1, servingMux(t, muxes, conn))
+	}
+
+	dialTestTCPMux(t, muxes[1], "a")
+	dialTestTCPMux(t, muxes[1], "b")
+	assert.Eventually(t, func() bool {
+		return muxes[1].Stats().LiveConns == 2
+	}, time.Second, time.Millisecond)
+
+	conn, err := multi.GetConnByUfrag("c", false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, servingMux(t, muxes, conn))
+
+	require.NoError(t, multi.Close())
+}
+
+func TestTCPMuxMulti_UfragStaysOnChild(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	multi, muxes := newTestTCPMuxMulti(t, TCPMuxSelectRoundRobin, 0, 0)
+
+	first, err := multi.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+	again, err := multi.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+	assert.Equal(t, first, again)
+
+	// Both families of a ufrag are served by the same child.
+	ipv6, err := multi.GetConnByUfrag("myufrag", true)
+	require.NoError(t, err)
+	assert.Equal(t, servingMux(t, muxes, first), servingMux(t, muxes, ipv6))
+
+	// Once removed, the ufrag is assigned a child again.
+	multi.RemoveConnByUfrag("myufrag")
+	_, _, err = first.ReadFrom(make([]byte, receiveMTU))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	next, err := multi.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+	assert.NotEqual(t, servingMux(t, muxes, first), servingMux(t, muxes, next))
+
+	require.NoError(t, multi.Close())
+	_, err = multi.GetConnByUfrag("myufrag", false)
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	assert.True(t, muxes[0].Closed())
+	assert.True(t, muxes[1].Closed())
+}
+
+func TestTCPMuxMulti_NoChildren(t *testing.T) {
+	multi := NewTCPMuxMulti(TCPMuxMultiParams{})
+
+	_, err := multi.GetConnByUfrag("myufrag", false)
+	assert.ErrorIs(t, err, ErrTCPMuxNotInitialized)
+	assert.NoError(t, multi.Close())
+}
@@ -1,10 +1,25 @@
 package ice
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+	"github.com/pion/ice/v2/icetest"
 	"github.com/pion/logging"
 	"github.com/pion/stun"
 	"github.com/pion/transport/test"
@@ -59,7 +74,7 @@ func TestTCPMux_Recv(t *testing.T) {
 			msg.Add(stun.AttrUsername, []byte("myufrag:otherufrag"))
 			msg.Encode()
 
-			n, err := writeStreamingPacket(conn, msg.Raw)
+			n, err := writeStreamingPacket(conn, msg.Raw, streamingPacketHeaderLen)
 			require.NoError(t, err, "error writing tcp stun packet")
 
 			pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
@@ -79,7 +94,7 @@ func TestTCPMux_Recv(t *testing.T) {
 			n, err = pktConn.WriteTo(recv, conn.LocalAddr())
 			require.NoError(t, err, "error writing echo stun packet")
 			recvEcho := make([]byte, n)
-			n3, err := readStreamingPacket(conn, recvEcho)
+			n3, err := readStreamingPacket(conn, recvEcho, streamingPacketHeaderLen)
 			require.NoError(t, err, "error receiving echo data")
 			assert.Equal(t, n2, n3, "received byte size mismatch")
 			assert.Equal(t, msg.Raw, recvEcho, "received bytes mismatch")
@@ -117,3 +132,2886 @@ func TestTCPMux_NoDeadlockWhenClosingUnusedPacketConn(t *testing.T) {
 	assert.Nil(t, conn, "should receive nil because mux is closed")
 	assert.Equal(t, io.ErrClosedPipe, err, "should receive error because mux is closed")
 }
+
+func TestStreamingPacketHeaderLen(t *testing.T) {
+	for _, headerLen := range []int{streamingPacketHeaderLen, streamingPacketHeaderLenExtended} {
+		headerLen := headerLen
+		t.Run(fmt.Sprintf("%d bytes", headerLen), func(t *testing.T) {
+			report := test.CheckRoutines(t)
+			defer report()
+
+			ca, cb := net.Pipe()
+			defer func() {
+				_ = ca.Close()
+				_ = cb.Close()
+			}()
+
+			payload := make([]byte, math.MaxUint16+1)
+			if headerLen == streamingPacketHeaderLen {
+				payload = payload[:1000]
+			}
+
+			go func() {
+				n, err := writeStreamingPacket(ca, payload, headerLen)
+				assert.NoError(t, err)
+				assert.Equal(t, len(payload), n)
+			}()
+
+			recv := make([]byte, len(payload))
+			n, err := readStreamingPacket(cb, recv, headerLen)
+			require.NoError(t, err)
+			assert.Equal(t, len(payload), n)
+		})
+	}
+
+	t.Run("short writes", func(t *testing.T) {
+		report := test.CheckRoutines(t)
+		defer report()
+
+		ca, cb := net.Pipe()
+		defer func() {
+			_ = ca.Close()
+			_ = cb.Close()
+		}()
+
+		payload := []byte("hello world")
+		go func() {
+			n, err := writeStreamingPacket(&shortWriteConn{Conn: ca, max: 3}, payload, streamingPacketHeaderLen)
+			assert.NoError(t, err)
+			assert.Equal(t, len(payload), n)
+		}()
+
+		recv := make([]byte, receiveMTU)
+		n, err := readStreamingPacket(cb, recv, streamingPacketHeaderLen)
+		require.NoError(t, err)
+		assert.Equal(t, payload, recv[:n])
+
+		// A write making no progress fails rather than spinning.
+		_, err = writeStreamingPacket(&shortWriteConn{Conn: ca}, payload, streamingPacketHeaderLen)
+		assert.ErrorIs(t, err, io.ErrShortWrite)
+	})
+
+	t.Run("oversize payload", func(t *testing.T) {
+		ca, cb := net.Pipe()
+		defer func() {
+			_ = ca.Close()
+			_ = cb.Close()
+		}()
+
+		_, err := writeStreamingPacket(ca, make([]byte, math.MaxUint16+1), streamingPacketHeaderLen)
+		assert.ErrorIs(t, err, errStreamingPacketTooLarge)
+	})
+}
+
+func TestTCPMux_ExtendedHeaderLargePackets(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	const size = 100000
+	tcpMux := newTestTCPMux(t, TCPMuxParams{StreamingPacketHeaderLen: streamingPacketHeaderLenExtended})
+
+	pktConn, err := tcpMux.GetConnByUfragWithReceiveMTU("myufrag", false, 2*size)
+	require.NoError(t, err)
+
+	conn, err := net.DialTCP("tcp", nil, tcpMux.LocalAddr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	msg, err := stun.Build(stun.BindingRequest, stun.NewUsername("myufrag:otherufrag"))
+	require.NoError(t, err)
+	_, err = writeStreamingPacket(conn, msg.Raw, streamingPacketHeaderLenExtended)
+	require.NoError(t, err)
+
+	payload := bytes.Repeat([]byte{0xAB}, size)
+	_, err = writeStreamingPacket(conn, payload, streamingPacketHeaderLenExtended)
+	require.NoError(t, err)
+
+	buf := make([]byte, 2*size)
+	n, raddr, err := pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Raw, buf[:n])
+
+	n, _, err = pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, payload, buf[:n])
+
+	n, err = pktConn.WriteTo(payload, raddr)
+	require.NoError(t, err)
+	assert.Equal(t, size, n)
+
+	n, err = readStreamingPacket(conn, buf, streamingPacketHeaderLenExtended)
+	require.NoError(t, err)
+	assert.Equal(t, payload, buf[:n])
+
+	require.NoError(t, tcpMux.Close())
+}
+
+// shortWriteConn writes at most max bytes of each Write to the wrapped conn,
+// without returning an error.
+type shortWriteConn struct {
+	net.Conn
+	max int
+}
+
+func (c *shortWriteConn) Write(b []byte) (int, error) {
+	if len(b) > c.max {
+		b = b[:c.max]
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return c.Conn.Write(b)
+}
+
+func TestTCPMux_OnBindingRequest(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{
+		IP:   net.IP{127, 0, 0, 1},
+		Port: 0,
+	})
+	require.NoError(t, err, "error starting listener")
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	type bindingRequest struct {
+		ufrag    string
+		priority uint32
+		remote   net.Addr
+	}
+	requests := make(chan bindingRequest, 1)
+
+	tcpMux := NewTCPMuxDefault(TCPMuxParams{
+		Listener:       listener,
+		Logger:         loggerFactory.NewLogger("ice"),
+		ReadBufferSize: 20,
+		OnBindingRequest: func(ufrag string, msg *stun.Message, remote net.Addr) {
+			var priority PriorityAttr
+			assert.NoError(t, priority.GetFrom(msg))
+			requests <- bindingRequest{ufrag, uint32(priority), remote}
+		},
+	})
+	defer func() {
+		_ = tcpMux.Close()
+	}()
+
+	conn, err := net.DialTCP("tcp", nil, tcpMux.LocalAddr().(*net.TCPAddr))
+	require.NoError(t, err, "error dialing test tcp connection")
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	msg, err := stun.Build(
+		stun.BindingRequest,
+		stun.NewUsername("myufrag:otherufrag"),
+		PriorityAttr(1234),
+	)
+	require.NoError(t, err)
+
+	_, err = writeStreamingPacket(conn, msg.Raw, streamingPacketHeaderLen)
+	require.NoError(t, err, "error writing tcp stun packet")
+
+	req := <-requests
+	assert.Equal(t, "myufrag", req.ufrag)
+	assert.Equal(t, uint32(1234), req.priority)
+	assert.Equal(t, conn.LocalAddr().String(), req.remote.String())
+}
+
+// newTestTCPMux creates a TCPMuxDefault listening on a random loopback port.
+// The mux and its listener are closed when the test finishes.
+func newTestTCPMux(t *testing.T, params TCPMuxParams) *TCPMuxDefault {
+	t.Helper()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{
+		IP:   net.IP{127, 0, 0, 1},
+		Port: 0,
+	})
+	require.NoError(t, err, "error starting listener")
+
+	params.Listener = listener
+	if params.Logger == nil {
+		params.Logger = logging.NewDefaultLoggerFactory().NewLogger("ice")
+	}
+	if params.ReadBufferSize == 0 {
+		params.ReadBufferSize = 20
+	}
+
+	tcpMux := NewTCPMuxDefault(params)
+	t.Cleanup(func() {
+		_ = tcpMux.Close()
+		_ = listener.Close()
+	})
+
+	return tcpMux
+}
+
+// dialTestTCPMux connects to tcpMux and sends a STUN binding request with
+// the given ufrag, returning the client side conn and the request.
+func dialTestTCPMux(t *testing.T, tcpMux *TCPMuxDefault, ufrag string) (*net.TCPConn, *stun.Message) {
+	t.Helper()
+
+	conn, err := net.DialTCP("tcp", nil, tcpMux.LocalAddr().(*net.TCPAddr))
+	require.NoError(t, err, "error dialing test tcp connection")
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	msg, err := stun.Build(stun.BindingRequest, stun.NewUsername(ufrag+":otherufrag"))
+	require.NoError(t, err)
+
+	_, err = writeStreamingPacket(conn, msg.Raw, streamingPacketHeaderLen)
+	require.NoError(t, err, "error writing tcp stun packet")
+
+	return conn, msg
+}
+
+func TestTCPMux_DeliverFirstPacket(t *testing.T) {
+	for name, deliver := range map[string]bool{
+		"deliver": true,
+		"drop":    false,
+	} {
+		deliver := deliver
+		t.Run(name, func(t *testing.T) {
+			report := test.CheckRoutines(t)
+			defer report()
+
+			tcpMux := newTestTCPMux(t, TCPMuxParams{DeliverFirstPacket: &deliver})
+
+			conn, msg := dialTestTCPMux(t, tcpMux, "myufrag")
+			data := []byte("media")
+			_, err := writeStreamingPacket(conn, data, streamingPacketHeaderLen)
+			require.NoError(t, err)
+
+			pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+			require.NoError(t, err)
+
+			buf := make([]byte, receiveMTU)
+			if deliver {
+				n, _, err := pktConn.ReadFrom(buf)
+				require.NoError(t, err)
+				assert.Equal(t, msg.Raw, buf[:n])
+			}
+
+			n, _, err := pktConn.ReadFrom(buf)
+			require.NoError(t, err)
+			assert.Equal(t, data, buf[:n])
+
+			require.NoError(t, tcpMux.Close())
+		})
+	}
+}
+
+func TestTCPMux_MaxAcceptsPerSecond(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{MaxAcceptsPerSecond: 2})
+
+	// The first two connections fit in the burst, the rest are shed.
+	const numConns = 5
+	for i := 0; i < numConns; i++ {
+		dialTestTCPMux(t, tcpMux, fmt.Sprintf("ufrag%d", i))
+	}
+
+	assert.Eventually(t, func() bool {
+		return tcpMux.Stats().RateLimitedConns == numConns-2
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_ConnControl(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	errRejected := errors.New("rejected by ConnControl")
+	controlled := make(chan net.Conn, 1)
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{
+		ConnControl: func(conn net.Conn) error {
+			controlled <- conn
+			return errRejected
+		},
+	})
+
+	conn, _ := dialTestTCPMux(t, tcpMux, "myufrag")
+
+	accepted := <-controlled
+	_, isTCPConn := accepted.(*net.TCPConn)
+	assert.True(t, isTCPConn, "ConnControl should receive the raw conn")
+
+	// The rejected conn is closed by the mux.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err := conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_Dial(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{Dialer: &net.Dialer{}})
+
+	remote, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer func() {
+		_ = remote.Close()
+	}()
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+
+	t.Run("dials remote", func(t *testing.T) {
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := remote.Accept()
+			assert.NoError(t, err)
+			accepted <- conn
+		}()
+
+		_, err := pktConn.WriteTo([]byte("hello"), remote.Addr())
+		require.NoError(t, err)
+
+		conn := <-accepted
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		buf := make([]byte, receiveMTU)
+		n, err := readStreamingPacket(conn, buf, streamingPacketHeaderLen)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("hello"), buf[:n])
+
+		_, err = writeStreamingPacket(conn, []byte("world"), streamingPacketHeaderLen)
+		require.NoError(t, err)
+
+		n, raddr, err := pktConn.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("world"), buf[:n])
+		assert.Equal(t, remote.Addr().String(), raddr.String())
+	})
+
+	t.Run("keeps address family", func(t *testing.T) {
+		_, err := pktConn.WriteTo([]byte("hello"), &net.TCPAddr{IP: net.IPv6loopback, Port: 9})
+		assert.Error(t, err, "IPv4 conn should not dial an IPv6 remote")
+	})
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_DialWriteDeadline(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	// Resolving the remote hangs, so that dials only end with their deadline.
+	dialer := &net.Dialer{
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+		},
+	}
+	tcpMux := newTestTCPMux(t, TCPMuxParams{Dialer: dialer})
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+
+	require.NoError(t, pktConn.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = pktConn.WriteTo([]byte("hello"), hostAddr("remote.invalid:443"))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// The failed dial leaves nothing behind, and an expired deadline fails
+	// the next dials right away.
+	assert.Equal(t, 0, tcpMux.TotalConns())
+	_, err = pktConn.WriteTo([]byte("hello"), hostAddr("remote.invalid:443"))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	remote, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer func() {
+		_ = remote.Close()
+	}()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := remote.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+
+	// Without a deadline, dials are bounded by the Dialer only.
+	require.NoError(t, pktConn.SetWriteDeadline(time.Time{}))
+	_, err = pktConn.WriteTo([]byte("hello"), remote.Addr())
+	require.NoError(t, err)
+
+	conn := <-accepted
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	buf := make([]byte, receiveMTU)
+	n, err := readStreamingPacket(conn, buf, streamingPacketHeaderLen)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), buf[:n])
+
+	require.NoError(t, tcpMux.Close())
+}
+
+// hostAddr is a remote address given by host name.
+type hostAddr string
+
+func (a hostAddr) Network() string {
+	return "tcp"
+}
+
+func (a hostAddr) String() string {
+	return string(a)
+}
+
+func TestTCPMux_SwapListener(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+	oldAddr := tcpMux.LocalAddr()
+
+	conn, msg := dialTestTCPMux(t, tcpMux, "myufrag")
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	n, raddr, err := pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Raw, buf[:n])
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	require.NoError(t, tcpMux.SwapListener(listener))
+	assert.Equal(t, listener.Addr(), tcpMux.LocalAddr())
+
+	// The old listener doesn't accept anymore.
+	_, err = net.Dial("tcp", oldAddr.String())
+	assert.Error(t, err)
+
+	// The existing connection still works in both directions.
+	_, err = pktConn.WriteTo([]byte("ping"), raddr)
+	require.NoError(t, err)
+	n, err = readStreamingPacket(conn, buf, streamingPacketHeaderLen)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ping"), buf[:n])
+
+	// New connections are accepted from the new listener.
+	_, msg = dialTestTCPMux(t, tcpMux, "myufrag")
+	n, _, err = pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Raw, buf[:n])
+
+	require.NoError(t, tcpMux.Close())
+	assert.ErrorIs(t, tcpMux.SwapListener(listener), io.ErrClosedPipe)
+}
+
+func TestTCPMux_SwapListenerAfterAcceptError(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	errAccept := errors.New("accept failed")
+	tcpMux := NewTCPMuxDefault(TCPMuxParams{
+		Listener:       &failingListener{err: errAccept},
+		Logger:         logging.NewDefaultLoggerFactory().NewLogger("ice"),
+		ReadBufferSize: 20,
+	})
+	assert.Eventually(t, func() bool {
+		return !tcpMux.Healthy()
+	}, time.Second, 10*time.Millisecond)
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	// The accept loop isn't restarted, and listener is left to the caller.
+	assert.ErrorIs(t, tcpMux.SwapListener(listener), errAcceptLoopStopped)
+	assert.NotEqual(t, listener.Addr(), tcpMux.LocalAddr())
+	assert.False(t, tcpMux.Healthy())
+
+	require.NoError(t, listener.SetDeadline(time.Now()))
+	_, err = listener.Accept()
+	assert.True(t, os.IsTimeout(err), "listener was closed: %v", err)
+
+	require.NoError(t, tcpMux.Close())
+	assert.ErrorIs(t, tcpMux.SwapListener(listener), io.ErrClosedPipe)
+}
+
+func TestTCPMux_SetWriteBufferForUfrag(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+	tcpMux.SetWriteBufferForUfrag("screenshare", 4*1024*1024)
+
+	isBuffered := func(ufrag string) bool {
+		pktConn, err := tcpMux.GetConnByUfrag(ufrag, false)
+		require.NoError(t, err)
+
+		buf := make([]byte, receiveMTU)
+		_, raddr, err := pktConn.ReadFrom(buf)
+		require.NoError(t, err)
+
+		tcpConn := pktConn.(*tcpPacketConn)
+		tcpConn.mu.Lock()
+		defer tcpConn.mu.Unlock()
+		_, ok := tcpConn.conns[raddr.String()].(*bufferedConn)
+		return ok
+	}
+
+	dialTestTCPMux(t, tcpMux, "screenshare")
+	assert.True(t, isBuffered("screenshare"))
+
+	dialTestTCPMux(t, tcpMux, "voice")
+	assert.False(t, isBuffered("voice"))
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_HandleConn(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+
+	t.Run("routes pre-accepted conn", func(t *testing.T) {
+		local, remote := net.Pipe()
+		defer func() {
+			_ = remote.Close()
+		}()
+
+		// net.Pipe addresses have no host, so wrap them with TCP addresses.
+		conn := &addrConn{Conn: local, remote: &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000}}
+
+		msg, err := stun.Build(stun.BindingRequest, stun.NewUsername("myufrag:otherufrag"))
+		require.NoError(t, err)
+		go func() {
+			_, err := writeStreamingPacket(remote, msg.Raw, streamingPacketHeaderLen)
+			assert.NoError(t, err)
+		}()
+
+		require.NoError(t, tcpMux.HandleConn(conn))
+
+		pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+		require.NoError(t, err)
+
+		buf := make([]byte, receiveMTU)
+		n, raddr, err := pktConn.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, msg.Raw, buf[:n])
+		assert.Equal(t, conn.remote, raddr)
+	})
+
+	t.Run("rejects non-STUN", func(t *testing.T) {
+		local, remote := net.Pipe()
+		go func() {
+			_, err := writeStreamingPacket(remote, []byte("not stun"), streamingPacketHeaderLen)
+			assert.NoError(t, err)
+		}()
+
+		assert.ErrorIs(t, tcpMux.HandleConn(local), errDecodeSTUNMessage)
+
+		// The rejected conn is closed.
+		_, err := remote.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	require.NoError(t, tcpMux.Close())
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	assert.ErrorIs(t, tcpMux.HandleConn(local), io.ErrClosedPipe)
+}
+
+func TestTCPMux_DuplicateConnKeepBoth(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	listener := icetest.NewPipeListener()
+	tcpMux := NewTCPMuxDefault(TCPMuxParams{
+		Listener:            listener,
+		Logger:              logging.NewDefaultLoggerFactory().NewLogger("ice"),
+		ReadBufferSize:      20,
+		DuplicateConnPolicy: DuplicateConnKeepBoth,
+	})
+
+	raddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000}
+	msg, err := stun.Build(stun.BindingRequest, stun.NewUsername("myufrag:otherufrag"))
+	require.NoError(t, err)
+
+	accepted, err := listener.DialAddr(raddr)
+	require.NoError(t, err)
+	defer func() {
+		_ = accepted.Close()
+	}()
+	_, err = writeStreamingPacket(accepted, msg.Raw, streamingPacketHeaderLen)
+	require.NoError(t, err)
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+	buf := make([]byte, receiveMTU)
+	_, _, err = pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+
+	// The same remote on another local address, as accepted by another
+	// listener, is kept along with the first connection.
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	go func() {
+		_, err := writeStreamingPacket(remote, msg.Raw, streamingPacketHeaderLen)
+		assert.NoError(t, err)
+	}()
+	otherLocal := &net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 443}
+	require.NoError(t, tcpMux.HandleConn(&addrConn{Conn: local, remote: raddr, local: otherLocal}))
+
+	n, _, err := pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Raw, buf[:n])
+	assert.Equal(t, 2, tcpMux.Stats().LiveConns)
+
+	// Packets are written to the first connection.
+	go func() {
+		_, err := pktConn.WriteTo([]byte("reply"), raddr)
+		assert.NoError(t, err)
+	}()
+	n, err = readStreamingPacket(accepted, buf, streamingPacketHeaderLen)
+	require.NoError(t, err)
+	assert.Equal(t, "reply", string(buf[:n]))
+
+	// Another connection accepted from the listener has the local address of
+	// the first one and is rejected.
+	again, err := listener.DialAddr(raddr)
+	require.NoError(t, err)
+	defer func() {
+		_ = again.Close()
+	}()
+	_, err = writeStreamingPacket(again, msg.Raw, streamingPacketHeaderLen)
+	require.NoError(t, err)
+	_, err = again.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, 2, tcpMux.Stats().LiveConns)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+// addrConn overrides the remote address of a net.Conn, and its local address
+// if set.
+type addrConn struct {
+	net.Conn
+	remote, local net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *addrConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func TestTCPMux_RemoteAddrs(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+	assert.Nil(t, tcpMux.RemoteAddrs("myufrag", false))
+
+	conn1, _ := dialTestTCPMux(t, tcpMux, "myufrag")
+	conn2, _ := dialTestTCPMux(t, tcpMux, "myufrag")
+
+	var addrs []string
+	assert.Eventually(t, func() bool {
+		addrs = addrs[:0]
+		for _, addr := range tcpMux.RemoteAddrs("myufrag", false) {
+			addrs = append(addrs, addr.String())
+		}
+		return len(addrs) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{conn1.LocalAddr().String(), conn2.LocalAddr().String()}, addrs)
+	assert.Empty(t, tcpMux.RemoteAddrs("myufrag", true))
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_ConnAges(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+	assert.Nil(t, tcpMux.ConnAges("myufrag", false))
+
+	waitConns := func(expected int) {
+		assert.Eventually(t, func() bool {
+			return len(tcpMux.ConnAges("myufrag", false)) == expected
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	older, _ := dialTestTCPMux(t, tcpMux, "myufrag")
+	waitConns(1)
+	time.Sleep(50 * time.Millisecond)
+	newer, _ := dialTestTCPMux(t, tcpMux, "myufrag")
+	waitConns(2)
+
+	ages := map[string]time.Duration{}
+	for _, age := range tcpMux.ConnAges("myufrag", false) {
+		ages[age.Remote.String()] = age.Age
+	}
+	assert.GreaterOrEqual(t, ages[older.LocalAddr().String()], 50*time.Millisecond)
+	assert.Less(t, ages[newer.LocalAddr().String()], ages[older.LocalAddr().String()])
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+	age, err := pktConn.(*tcpPacketConn).ConnAge(older.LocalAddr())
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, age, ages[older.LocalAddr().String()])
+
+	// A closed connection has no age anymore.
+	require.NoError(t, older.Close())
+	waitConns(1)
+	_, err = pktConn.(*tcpPacketConn).ConnAge(older.LocalAddr())
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_UfragIsolation(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{ReadBufferSize: 4})
+
+	// The packets of the flooding ufrag are never read, its readers block on
+	// its full receive queue.
+	flood, _ := dialTestTCPMux(t, tcpMux, "flood")
+	floodDone := make(chan struct{})
+	go func() {
+		defer close(floodDone)
+		packet := make([]byte, 100)
+		for {
+			if _, err := writeStreamingPacket(flood, packet, streamingPacketHeaderLen); err != nil {
+				return
+			}
+		}
+	}()
+
+	floodConn, err := tcpMux.GetConnByUfrag("flood", false)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		length, capacity := floodConn.(*tcpPacketConn).RecvQueueStats()
+		return length == capacity
+	}, time.Second, 10*time.Millisecond)
+
+	// Meanwhile the other ufrags are accepted, read and written to as usual.
+	const ufrags = 8
+	remotes := make([]*net.TCPConn, ufrags)
+	for i := range remotes {
+		remotes[i], _ = dialTestTCPMux(t, tcpMux, fmt.Sprintf("ufrag%d", i))
+	}
+
+	var wg sync.WaitGroup
+	for i, remote := range remotes {
+		wg.Add(1)
+		go func(ufrag string, remote *net.TCPConn) {
+			defer wg.Done()
+
+			pktConn, err := tcpMux.GetConnByUfrag(ufrag, false)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			buf := make([]byte, receiveMTU)
+			_, raddr, err := pktConn.ReadFrom(buf)
+			if !assert.NoError(t, err) {
+				return
+			}
+			_, err = pktConn.WriteTo([]byte(ufrag), raddr)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			n, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+			if assert.NoError(t, err) {
+				assert.Equal(t, ufrag, string(buf[:n]))
+			}
+		}(fmt.Sprintf("ufrag%d", i), remote)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "ufrags stalled by the flooding ufrag")
+		_ = tcpMux.Close()
+		<-done
+	}
+
+	_ = flood.Close()
+	require.NoError(t, tcpMux.Close())
+	<-floodDone
+}
+
+func TestTCPMux_RemoveStalledUfrag(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	listener := icetest.NewPipeListener()
+	tcpMux := NewTCPMuxDefault(TCPMuxParams{
+		Listener:        listener,
+		Logger:          logging.NewDefaultLoggerFactory().NewLogger("ice"),
+		ReadBufferSize:  20,
+		WriteBufferSize: 4096,
+	})
+
+	msg, err := stun.Build(stun.BindingRequest, stun.NewUsername("stalled:otherufrag"))
+	require.NoError(t, err)
+
+	remote, err := listener.Dial()
+	require.NoError(t, err)
+	defer func() {
+		_ = remote.Close()
+	}()
+	_, err = writeStreamingPacket(remote, msg.Raw, streamingPacketHeaderLen)
+	require.NoError(t, err)
+
+	pktConn, err := tcpMux.GetConnByUfrag("stalled", false)
+	require.NoError(t, err)
+	buf := make([]byte, receiveMTU)
+	_, raddr, err := pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+
+	// The remote never reads, closing the conn waits for its queued packet.
+	_, err = pktConn.WriteTo([]byte("never read"), raddr)
+	require.NoError(t, err)
+
+	removed := make(chan int)
+	go func() {
+		removed <- tcpMux.RemoveConnByUfragCount("stalled")
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The other ufrags don't wait for it.
+	start := time.Now()
+	_, err = tcpMux.GetConnByUfrag("other", false)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), bufferedConnCloseTimeout/2)
+
+	assert.Equal(t, 1, <-removed)
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_PipeListenerIPv6(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	listener := icetest.NewPipeListener()
+	tcpMux := NewTCPMuxDefault(TCPMuxParams{
+		Listener:       listener,
+		ReadBufferSize: 20,
+	})
+
+	raddr := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}
+	conn, err := listener.DialAddr(raddr)
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	msg, err := stun.Build(stun.BindingRequest, stun.NewUsername("myufrag:otherufrag"))
+	require.NoError(t, err)
+	_, err = writeStreamingPacket(conn, msg.Raw, streamingPacketHeaderLen)
+	require.NoError(t, err)
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", true)
+	require.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	n, addr, err := pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Raw, buf[:n])
+	assert.Equal(t, raddr, addr)
+	assert.Empty(t, tcpMux.RemoteAddrs("myufrag", false))
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_DrainConnByUfrag(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	listener := icetest.NewPipeListener()
+	tcpMux := NewTCPMuxDefault(TCPMuxParams{
+		Listener:        listener,
+		Logger:          logging.NewDefaultLoggerFactory().NewLogger("ice"),
+		ReadBufferSize:  20,
+		WriteBufferSize: 4096,
+	})
+
+	dial := func(ufrag string) (net.Conn, net.PacketConn, net.Addr) {
+		conn, err := listener.Dial()
+		require.NoError(t, err)
+
+		msg, err := stun.Build(stun.BindingRequest, stun.NewUsername(ufrag+":otherufrag"))
+		require.NoError(t, err)
+		_, err = writeStreamingPacket(conn, msg.Raw, streamingPacketHeaderLen)
+		require.NoError(t, err)
+
+		pktConn, err := tcpMux.GetConnByUfrag(ufrag, false)
+		require.NoError(t, err)
+
+		buf := make([]byte, receiveMTU)
+		_, raddr, err := pktConn.ReadFrom(buf)
+		require.NoError(t, err)
+
+		return conn, pktConn, raddr
+	}
+
+	t.Run("flushes queued writes", func(t *testing.T) {
+		conn, pktConn, raddr := dial("drained")
+
+		// The peer isn't reading yet, so the packets stay queued.
+		const numPackets = 10
+		for i := 0; i < numPackets; i++ {
+			_, err := pktConn.WriteTo([]byte{byte(i)}, raddr)
+			require.NoError(t, err)
+		}
+
+		received := make(chan []byte, numPackets)
+		go func() {
+			defer close(received)
+			for {
+				buf := make([]byte, receiveMTU)
+				n, err := readStreamingPacket(conn, buf, streamingPacketHeaderLen)
+				if err != nil {
+					return
+				}
+				received <- buf[:n]
+			}
+		}()
+
+		require.NoError(t, tcpMux.DrainConnByUfrag("drained", time.Second))
+
+		var i int
+		for buf := range received {
+			assert.Equal(t, []byte{byte(i)}, buf)
+			i++
+		}
+		assert.Equal(t, numPackets, i)
+		assert.Empty(t, tcpMux.RemoteAddrs("drained", false))
+	})
+
+	t.Run("stalled peer", func(t *testing.T) {
+		conn, pktConn, raddr := dial("stalled")
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		_, err := pktConn.WriteTo([]byte("bye"), raddr)
+		require.NoError(t, err)
+
+		assert.ErrorIs(t, tcpMux.DrainConnByUfrag("stalled", 50*time.Millisecond), errFlushTimeout)
+		assert.Empty(t, tcpMux.RemoteAddrs("stalled", false))
+	})
+
+	require.NoError(t, tcpMux.Close())
+}
+
+// failingListener is a net.Listener whose Accept always fails.
+type failingListener struct {
+	err error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	return nil, l.err
+}
+
+func (l *failingListener) Close() error {
+	return nil
+}
+
+func (l *failingListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 3478}
+}
+
+func TestTCPMux_OnClose(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	t.Run("Close", func(t *testing.T) {
+		closed := make(chan error, 2)
+		tcpMux := newTestTCPMux(t, TCPMuxParams{
+			OnClose: func(err error) {
+				closed <- err
+			},
+		})
+
+		require.NoError(t, tcpMux.Close())
+		assert.NoError(t, <-closed)
+
+		// Closing again doesn't call OnClose a second time.
+		_ = tcpMux.Close()
+		assert.Len(t, closed, 0)
+	})
+
+	t.Run("accept error", func(t *testing.T) {
+		errAccept := errors.New("accept failed")
+
+		closed := make(chan error, 2)
+		tcpMux := NewTCPMuxDefault(TCPMuxParams{
+			Listener:       &failingListener{err: errAccept},
+			Logger:         logging.NewDefaultLoggerFactory().NewLogger("ice"),
+			ReadBufferSize: 20,
+			OnClose: func(err error) {
+				closed <- err
+			},
+		})
+
+		select {
+		case err := <-closed:
+			assert.ErrorIs(t, err, errAccept)
+		case <-time.After(time.Second):
+			assert.Fail(t, "OnClose was not called")
+		}
+
+		require.NoError(t, tcpMux.Close())
+		assert.Len(t, closed, 0)
+	})
+
+	t.Run("SwapListener", func(t *testing.T) {
+		closed := make(chan error, 2)
+		tcpMux := newTestTCPMux(t, TCPMuxParams{
+			OnClose: func(err error) {
+				closed <- err
+			},
+		})
+
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+		require.NoError(t, err)
+		require.NoError(t, tcpMux.SwapListener(listener))
+		assert.Len(t, closed, 0)
+
+		require.NoError(t, tcpMux.Close())
+		assert.NoError(t, <-closed)
+	})
+}
+
+func TestTCPMux_RemoveConnByUfragCount(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+
+	_, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+	_, err = tcpMux.GetConnByUfrag("myufrag", true)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, tcpMux.RemoveConnByUfragCount("myufrag"))
+	assert.Equal(t, 0, tcpMux.RemoveConnByUfragCount("myufrag"))
+	assert.Equal(t, 0, tcpMux.RemoveConnByUfragCount("otherufrag"))
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_NilListener(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := NewTCPMuxDefault(TCPMuxParams{
+		Logger:         logging.NewDefaultLoggerFactory().NewLogger("ice"),
+		ReadBufferSize: 20,
+	})
+
+	assert.Nil(t, tcpMux.LocalAddr())
+	assert.True(t, tcpMux.Closed())
+
+	_, err := tcpMux.GetConnByUfrag("myufrag", false)
+	assert.ErrorIs(t, err, ErrTCPMuxNotInitialized)
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	assert.ErrorIs(t, tcpMux.HandleConn(local), ErrTCPMuxNotInitialized)
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer func() {
+		_ = listener.Close()
+	}()
+	assert.ErrorIs(t, tcpMux.SwapListener(listener), ErrTCPMuxNotInitialized)
+
+	assert.ErrorIs(t, tcpMux.Close(), ErrTCPMuxNotInitialized)
+}
+
+func TestTCPMux_Closed(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+	assert.False(t, tcpMux.Closed())
+
+	require.NoError(t, tcpMux.Close())
+	assert.True(t, tcpMux.Closed())
+}
+
+func TestTCPMux_Healthy(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+	assert.True(t, tcpMux.Healthy())
+
+	tcpMux.Pause()
+	assert.True(t, tcpMux.Healthy())
+
+	require.NoError(t, tcpMux.Close())
+	assert.False(t, tcpMux.Healthy())
+
+	assert.Zero(t, tcpMux.Stats().AcceptErrors)
+
+	errAccept := errors.New("accept failed")
+	failingMux := NewTCPMuxDefault(TCPMuxParams{
+		Listener:       &failingListener{err: errAccept},
+		Logger:         logging.NewDefaultLoggerFactory().NewLogger("ice"),
+		ReadBufferSize: 20,
+	})
+	assert.Eventually(t, func() bool {
+		return !failingMux.Healthy()
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, failingMux.Closed())
+
+	stats := failingMux.Stats()
+	assert.Equal(t, uint64(1), stats.AcceptErrors)
+	assert.Equal(t, errAccept, stats.LastAcceptError)
+	assert.WithinDuration(t, time.Now(), stats.LastAcceptErrorAt, time.Second)
+	require.NoError(t, failingMux.Close())
+
+	nilMux := NewTCPMuxDefault(TCPMuxParams{})
+	assert.False(t, nilMux.Healthy())
+}
+
+func TestTCPMux_TotalConns(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+	assert.Equal(t, 0, tcpMux.TotalConns())
+
+	waitTotalConns := func(expected int) {
+		assert.Eventually(t, func() bool {
+			return tcpMux.TotalConns() == expected
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	conn1, _ := dialTestTCPMux(t, tcpMux, "ufrag1")
+	dialTestTCPMux(t, tcpMux, "ufrag1")
+	dialTestTCPMux(t, tcpMux, "ufrag2")
+	waitTotalConns(3)
+
+	// A remote closing its connection is counted out.
+	require.NoError(t, conn1.Close())
+	waitTotalConns(2)
+
+	tcpMux.RemoveConnByUfrag("ufrag1")
+	waitTotalConns(1)
+
+	require.NoError(t, tcpMux.Close())
+	assert.Equal(t, 0, tcpMux.TotalConns())
+}
+
+func TestTCPMux_Stats(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{WriteBufferSize: 8})
+
+	conn, msg := dialTestTCPMux(t, tcpMux, "myufrag")
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	_, raddr, err := pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+
+	_, err = writeStreamingPacket(conn, []byte("hello"), streamingPacketHeaderLen)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return tcpMux.Stats().RecvQueueLen == 1
+	}, time.Second, 10*time.Millisecond)
+
+	_, _, err = pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+
+	// The first write fits in the write buffer, the second doesn't.
+	_, err = pktConn.WriteTo([]byte("hi"), raddr)
+	require.NoError(t, err)
+	_, err = pktConn.WriteTo([]byte("dropped"), raddr)
+	require.Error(t, err)
+
+	// A connection whose first packet isn't STUN.
+	invalidConn, err := net.DialTCP("tcp", nil, tcpMux.LocalAddr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer func() {
+		_ = invalidConn.Close()
+	}()
+	_, err = writeStreamingPacket(invalidConn, []byte("not stun"), streamingPacketHeaderLen)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return tcpMux.Stats().STUNDecodeFailures == 1
+	}, time.Second, 10*time.Millisecond)
+
+	stats := tcpMux.Stats()
+	assert.Equal(t, uint64(2), stats.AcceptedConns)
+	assert.Equal(t, 1, stats.LiveConns)
+	assert.Equal(t, uint64(3), stats.PacketsRead)
+	assert.Equal(t, uint64(len(msg.Raw)+len("hello")+len("not stun")), stats.BytesRead)
+	assert.Equal(t, uint64(1), stats.PacketsWritten)
+	assert.Equal(t, uint64(len("hi")), stats.BytesWritten)
+	assert.Equal(t, uint64(1), stats.DroppedWrites)
+	assert.Equal(t, 0, stats.RecvQueueLen)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+// handshakeRecord is a handshake reported to recordingTracer.
+type handshakeRecord struct {
+	remote string
+	ufrag  string
+	err    error
+}
+
+// recordingTracer is a HandshakeTracer sending the handshakes to ended once
+// they end.
+type recordingTracer struct {
+	ended chan handshakeRecord
+}
+
+func (r *recordingTracer) StartHandshake(conn net.Conn) func(string, error) {
+	remote := conn.RemoteAddr().String()
+	return func(ufrag string, err error) {
+		r.ended <- handshakeRecord{remote: remote, ufrag: ufrag, err: err}
+	}
+}
+
+func TestTCPMux_Tracer(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tracer := &recordingTracer{ended: make(chan handshakeRecord, 2)}
+	tcpMux := newTestTCPMux(t, TCPMuxParams{Tracer: tracer})
+
+	conn, _ := dialTestTCPMux(t, tcpMux, "myufrag")
+
+	_, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+
+	handshake := <-tracer.ended
+	assert.Equal(t, "myufrag", handshake.ufrag)
+	assert.Equal(t, conn.LocalAddr().String(), handshake.remote)
+	assert.NoError(t, handshake.err)
+
+	invalidConn, err := net.DialTCP("tcp", nil, tcpMux.LocalAddr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer func() {
+		_ = invalidConn.Close()
+	}()
+	_, err = writeStreamingPacket(invalidConn, []byte("not stun"), streamingPacketHeaderLen)
+	require.NoError(t, err)
+
+	handshake = <-tracer.ended
+	assert.Empty(t, handshake.ufrag)
+	assert.Error(t, handshake.err)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+// varintFrameCodec frames packets with a uvarint length prefix.
+type varintFrameCodec struct{}
+
+func (varintFrameCodec) ReadFrame(conn net.Conn, buf []byte) (int, error) {
+	length, err := binary.ReadUvarint(byteReader{conn})
+	if err != nil {
+		return 0, err
+	}
+	if length > uint64(len(buf)) {
+		return 0, io.ErrShortBuffer
+	}
+
+	return io.ReadFull(conn, buf[:length])
+}
+
+func (varintFrameCodec) WriteFrame(conn net.Conn, buf []byte) (int, error) {
+	frame := make([]byte, binary.MaxVarintLen64+len(buf))
+	headerLen := binary.PutUvarint(frame, uint64(len(buf)))
+	copy(frame[headerLen:], buf)
+
+	n, err := conn.Write(frame[:headerLen+len(buf)])
+	if err != nil {
+		return 0, err
+	}
+
+	return n - headerLen, nil
+}
+
+// byteReader reads one byte at a time from a reader, so that no more than
+// the length prefix is consumed.
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+func TestTCPMux_FrameCodec(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	codec := varintFrameCodec{}
+	tcpMux := newTestTCPMux(t, TCPMuxParams{FrameCodec: codec})
+
+	conn, err := net.DialTCP("tcp", nil, tcpMux.LocalAddr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	msg, err := stun.Build(stun.BindingRequest, stun.NewUsername("myufrag:otherufrag"))
+	require.NoError(t, err)
+	_, err = codec.WriteFrame(conn, msg.Raw)
+	require.NoError(t, err)
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	n, raddr, err := pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Raw, buf[:n])
+
+	_, err = pktConn.WriteTo([]byte("hello"), raddr)
+	require.NoError(t, err)
+
+	n, err = codec.ReadFrame(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_CompressFrames(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{CompressFrames: true})
+	codec := compressedFrameCodec{codec: streamingPacketCodec{headerLen: streamingPacketHeaderLen}}
+
+	conn, err := net.DialTCP("tcp", nil, tcpMux.LocalAddr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
+		stun.NewUsername("myufrag:otherufrag"),
+		stun.NewShortTermIntegrity("pwd"),
+		stun.Fingerprint,
+	)
+	require.NoError(t, err)
+	_, err = codec.WriteFrame(conn, msg.Raw)
+	require.NoError(t, err)
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	n, raddr, err := pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Raw, buf[:n])
+
+	// Redundant packets are deflated, the others are stored as they are.
+	redundant := bytes.Repeat([]byte(`{"type":"candidate"}`), 50)
+	random := make([]byte, 1000)
+	_, err = rand.Read(random)
+	require.NoError(t, err)
+
+	_, err = pktConn.WriteTo(redundant, raddr)
+	require.NoError(t, err)
+	n, err = readStreamingPacket(conn, buf, streamingPacketHeaderLen)
+	require.NoError(t, err)
+	assert.Equal(t, byte(compressedFrameDeflate), buf[0])
+	assert.Less(t, n, len(redundant)/4)
+
+	pkt := make([]byte, receiveMTU)
+	n, err = inflate(pkt, buf[compressedFrameHeaderLen:n])
+	require.NoError(t, err)
+	assert.Equal(t, redundant, pkt[:n])
+
+	_, err = pktConn.WriteTo(random, raddr)
+	require.NoError(t, err)
+	n, err = readStreamingPacket(conn, buf, streamingPacketHeaderLen)
+	require.NoError(t, err)
+	assert.Equal(t, byte(compressedFrameStored), buf[0])
+	assert.Equal(t, random, buf[compressedFrameHeaderLen:n])
+
+	// A packet inflating past the buffer isn't truncated.
+	_, err = pktConn.WriteTo(redundant, raddr)
+	require.NoError(t, err)
+	_, err = codec.ReadFrame(conn, buf[:len(redundant)-1])
+	assert.ErrorIs(t, err, io.ErrShortBuffer)
+
+	// A peer without compression is rejected.
+	plainConn, err := net.DialTCP("tcp", nil, tcpMux.LocalAddr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer func() {
+		_ = plainConn.Close()
+	}()
+
+	_, err = writeStreamingPacket(plainConn, msg.Raw, streamingPacketHeaderLen)
+	require.NoError(t, err)
+	_, err = plainConn.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+// loopbackConn reads back what is written to it, counting the bytes written.
+type loopbackConn struct {
+	net.Conn
+	buf     bytes.Buffer
+	written int
+}
+
+func (c *loopbackConn) Read(b []byte) (int, error) {
+	return c.buf.Read(b)
+}
+
+func (c *loopbackConn) Write(b []byte) (int, error) {
+	c.written += len(b)
+	return c.buf.Write(b)
+}
+
+func BenchmarkCompressedFrameCodec(b *testing.B) {
+	msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
+		stun.NewUsername("myufrag:otherufrag"),
+		stun.NewShortTermIntegrity("pwd"),
+		stun.Fingerprint,
+	)
+	require.NoError(b, err)
+
+	srtp := make([]byte, 1200)
+	_, err = rand.Read(srtp)
+	require.NoError(b, err)
+
+	packets := map[string][]byte{
+		"stun": msg.Raw,
+		"srtp": srtp,
+		"text": bytes.Repeat([]byte(`{"type":"candidate","candidate":"candidate:1 1 tcp 1 127.0.0.1 443 typ host"}`), 10),
+	}
+	plain := streamingPacketCodec{headerLen: streamingPacketHeaderLen}
+	codecs := map[string]FrameCodec{
+		"plain":      plain,
+		"compressed": compressedFrameCodec{codec: plain},
+	}
+
+	for pktName, pkt := range packets {
+		for codecName, codec := range codecs {
+			pkt, codec := pkt, codec
+			b.Run(pktName+"/"+codecName, func(b *testing.B) {
+				conn := &loopbackConn{}
+				buf := make([]byte, receiveMTU)
+
+				b.SetBytes(int64(len(pkt)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := codec.WriteFrame(conn, pkt); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := codec.ReadFrame(conn, buf); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(conn.written)/float64(b.N), "wire-B/op")
+			})
+		}
+	}
+}
+
+func TestTCPMux_DialUfrag(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	remote, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer func() {
+		_ = remote.Close()
+	}()
+
+	// An IPv6 remote that is never reached.
+	unreachable := &net.TCPAddr{IP: net.ParseIP("100::1"), Port: 9}
+
+	t.Run("without dialer", func(t *testing.T) {
+		tcpMux := newTestTCPMux(t, TCPMuxParams{})
+		_, _, err := tcpMux.DialUfrag("myufrag", []net.Addr{remote.Addr()})
+		assert.ErrorIs(t, err, errNoDialer)
+		require.NoError(t, tcpMux.Close())
+	})
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{
+		Dialer:            &net.Dialer{},
+		DialFallbackDelay: 10 * time.Millisecond,
+	})
+
+	_, _, err = tcpMux.DialUfrag("myufrag", nil)
+	assert.ErrorIs(t, err, errNoRemoteAddrs)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := remote.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+
+	pktConn, raddr, err := tcpMux.DialUfrag("myufrag", []net.Addr{unreachable, remote.Addr()})
+	require.NoError(t, err)
+	assert.Equal(t, remote.Addr().String(), raddr.String())
+
+	conn := <-accepted
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	ipv4Conn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+	assert.Equal(t, ipv4Conn, pktConn)
+
+	_, err = pktConn.WriteTo([]byte("hello"), raddr)
+	require.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	n, err := readStreamingPacket(conn, buf, streamingPacketHeaderLen)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), buf[:n])
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestValidateUfrag(t *testing.T) {
+	for _, tc := range []struct {
+		ufrag  string
+		strict bool
+		err    error
+	}{
+		{"", false, errEmptyUfrag},
+		{"", true, errEmptyUfrag},
+		{"ab", false, nil},
+		{"ab", true, errInvalidUfrag},
+		{"abcd", true, nil},
+		{"ab+/12", true, nil},
+		{"abc-d", true, errInvalidUfrag},
+		{strings.Repeat("a", maxUfragLen), true, nil},
+		{strings.Repeat("a", maxUfragLen+1), true, errInvalidUfrag},
+	} {
+		err := validateUfrag(tc.ufrag, tc.strict)
+		if tc.err == nil {
+			assert.NoError(t, err, tc.ufrag)
+		} else {
+			assert.ErrorIs(t, err, tc.err, tc.ufrag)
+		}
+	}
+}
+
+func TestTCPMux_InvalidUfrag(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{StrictUfrag: true})
+
+	handle := func(username string) error {
+		local, remote := net.Pipe()
+		defer func() {
+			_ = remote.Close()
+		}()
+
+		msg, err := stun.Build(stun.BindingRequest, stun.NewUsername(username))
+		require.NoError(t, err)
+		go func() {
+			_, err := writeStreamingPacket(remote, msg.Raw, streamingPacketHeaderLen)
+			assert.NoError(t, err)
+		}()
+
+		return tcpMux.HandleConn(&addrConn{Conn: local, remote: &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000}})
+	}
+
+	assert.ErrorIs(t, handle(":otherufrag"), errEmptyUfrag)
+	assert.ErrorIs(t, handle("ab:otherufrag"), errInvalidUfrag)
+	assert.Equal(t, uint64(2), tcpMux.Stats().InvalidUfrags)
+	assert.Equal(t, 0, tcpMux.TotalConns())
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_Pause(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+
+	dialTestTCPMux(t, tcpMux, "known")
+	assert.Eventually(t, func() bool {
+		return tcpMux.TotalConns() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	tcpMux.Pause()
+	assert.True(t, tcpMux.Paused())
+
+	conn, _ := dialTestTCPMux(t, tcpMux, "paused")
+	_, err := conn.Read(make([]byte, 1))
+	assert.Error(t, err, "connection should be closed while paused")
+	assert.Equal(t, uint64(1), tcpMux.Stats().PausedConns)
+
+	// Existing connections are kept.
+	assert.Equal(t, 1, tcpMux.TotalConns())
+	assert.Len(t, tcpMux.RemoteAddrs("known", false), 1)
+
+	tcpMux.Resume()
+	assert.False(t, tcpMux.Paused())
+
+	dialTestTCPMux(t, tcpMux, "resumed")
+	assert.Eventually(t, func() bool {
+		return tcpMux.TotalConns() == 2
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_UfragStatsRecvQueue(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{ReadBufferSize: 8})
+
+	conn, _ := dialTestTCPMux(t, tcpMux, "myufrag")
+	_, err := writeStreamingPacket(conn, []byte("hello"), streamingPacketHeaderLen)
+	require.NoError(t, err)
+
+	// The binding request and the packet are both waiting to be read.
+	assert.Eventually(t, func() bool {
+		return tcpMux.UfragStats()["myufrag"].RecvQueueLen == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 8, tcpMux.UfragStats()["myufrag"].RecvQueueCap)
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+	_, _, err = pktConn.ReadFrom(make([]byte, receiveMTU))
+	require.NoError(t, err)
+
+	length, capacity := pktConn.(*tcpPacketConn).RecvQueueStats()
+	assert.Equal(t, 1, length)
+	assert.Equal(t, 8, capacity)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_LogFields(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	var logs syncBuffer
+	loggerFactory := &logging.DefaultLoggerFactory{
+		Writer:          &logs,
+		DefaultLogLevel: logging.LogLevelDebug,
+	}
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{
+		Logger:      loggerFactory.NewLogger("ice"),
+		StrictUfrag: true,
+	})
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	conn := &addrConn{Conn: local, remote: &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000}}
+
+	msg, err := stun.Build(stun.BindingRequest, stun.NewUsername("ab:otherufrag"))
+	require.NoError(t, err)
+	go func() {
+		_, err := writeStreamingPacket(remote, msg.Raw, streamingPacketHeaderLen)
+		assert.NoError(t, err)
+	}()
+
+	assert.ErrorIs(t, tcpMux.HandleConn(conn), errInvalidUfrag)
+	assert.Contains(t, logs.String(), "ufrag=ab remote=10.0.0.1:5000 event=rejected: ")
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_QuietRejections(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	var logs syncBuffer
+	loggerFactory := &logging.DefaultLoggerFactory{
+		Writer:          &logs,
+		DefaultLogLevel: logging.LogLevelDebug,
+	}
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{
+		Logger:          loggerFactory.NewLogger("ice"),
+		QuietRejections: true,
+	})
+
+	var remotes []net.Conn
+	defer func() {
+		for _, remote := range remotes {
+			_ = remote.Close()
+		}
+	}()
+	handle := func(packet []byte) error {
+		local, remote := net.Pipe()
+		remotes = append(remotes, remote)
+		conn := &addrConn{Conn: local, remote: &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000}}
+
+		go func() {
+			_, err := writeStreamingPacket(remote, packet, streamingPacketHeaderLen)
+			assert.NoError(t, err)
+		}()
+		return tcpMux.HandleConn(conn)
+	}
+
+	// A scanner is rejected quietly.
+	assert.ErrorIs(t, handle([]byte("GET / HTTP/1.1")), errDecodeSTUNMessage)
+	assert.Contains(t, logs.String(), "ice DEBUG")
+	assert.Contains(t, logs.String(), "event=rejected: ")
+	assert.NotContains(t, logs.String(), "ice WARNING")
+
+	// A duplicate connection is still a warning.
+	msg, err := stun.Build(stun.BindingRequest, stun.NewUsername("myufrag:otherufrag"))
+	require.NoError(t, err)
+	require.NoError(t, handle(msg.Raw))
+	assert.ErrorIs(t, handle(msg.Raw), errConnectionAddrAlreadyExist)
+	assert.Contains(t, logs.String(), "ice WARNING")
+
+	assert.Equal(t, uint64(2), tcpMux.stats.loadCloses(closeReasonRejected))
+
+	require.NoError(t, tcpMux.Close())
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestTCPMux_Context(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	newListener := func() net.Listener {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+		require.NoError(t, err)
+		return listener
+	}
+
+	t.Run("closed by context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		closed := make(chan error, 1)
+		tcpMux := NewTCPMuxDefaultContext(ctx, TCPMuxParams{
+			Listener:       newListener(),
+			ReadBufferSize: 20,
+			OnClose: func(err error) {
+				closed <- err
+			},
+		})
+
+		cancel()
+		assert.NoError(t, <-closed)
+		assert.True(t, tcpMux.Closed())
+	})
+
+	t.Run("closed directly", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		tcpMux := NewTCPMuxDefaultContext(ctx, TCPMuxParams{
+			Listener:       newListener(),
+			ReadBufferSize: 20,
+		})
+
+		// Close waits for the context goroutine, which must not leak.
+		require.NoError(t, tcpMux.Close())
+	})
+
+	t.Run("closed concurrently", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			ctx, cancel := context.WithCancel(context.Background())
+			closed := make(chan error, 2)
+			tcpMux := NewTCPMuxDefaultContext(ctx, TCPMuxParams{
+				Listener:       newListener(),
+				ReadBufferSize: 20,
+				OnClose: func(err error) {
+					closed <- err
+				},
+			})
+
+			// Whichever Close comes second must neither close the listener
+			// again nor call OnClose again.
+			go cancel()
+			require.NoError(t, tcpMux.Close())
+			require.NoError(t, tcpMux.Close())
+			assert.NoError(t, <-closed)
+			assert.Empty(t, closed)
+		}
+	})
+}
+
+func TestTCPMux_MigrateOnICERestart(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{
+		MigrateOnICERestart: true,
+		WriteBufferSize:     4096,
+	})
+
+	conn, _ := dialTestTCPMux(t, tcpMux, "oldufrag")
+
+	oldConn, err := tcpMux.GetConnByUfrag("oldufrag", false)
+	require.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	_, raddr, err := oldConn.ReadFrom(buf)
+	require.NoError(t, err)
+
+	// The remote restarts ICE over the same connection.
+	restart, err := stun.Build(stun.BindingRequest, stun.NewUsername("newufrag:otherufrag"))
+	require.NoError(t, err)
+	_, err = writeStreamingPacket(conn, restart.Raw, streamingPacketHeaderLen)
+	require.NoError(t, err)
+
+	newConn, err := tcpMux.GetConnByUfrag("newufrag", false)
+	require.NoError(t, err)
+
+	n, newRaddr, err := newConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, restart.Raw, buf[:n])
+	assert.Equal(t, raddr.String(), newRaddr.String())
+
+	// The old ufrag is kept until removed, without the connection.
+	assert.Empty(t, oldConn.(*tcpPacketConn).RemoteAddrs())
+	_, err = oldConn.WriteTo([]byte("old"), raddr)
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	assert.Equal(t, 1, tcpMux.Stats().LiveConns)
+
+	// The socket is still open and now belongs to the new ufrag.
+	_, err = newConn.WriteTo([]byte("hello"), newRaddr)
+	require.NoError(t, err)
+
+	n, err = readStreamingPacket(conn, buf, streamingPacketHeaderLen)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), buf[:n])
+
+	_, err = writeStreamingPacket(conn, []byte("media"), streamingPacketHeaderLen)
+	require.NoError(t, err)
+	n, _, err = newConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("media"), buf[:n])
+
+	tcpMux.RemoveConnByUfrag("oldufrag")
+	assert.Equal(t, 1, tcpMux.TotalConns())
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_RouteAnySTUNMessage(t *testing.T) {
+	for name, routeAny := range map[string]bool{
+		"default":  false,
+		"routeAny": true,
+	} {
+		routeAny := routeAny
+		t.Run(name, func(t *testing.T) {
+			report := test.CheckRoutines(t)
+			defer report()
+
+			tcpMux := newTestTCPMux(t, TCPMuxParams{RouteAnySTUNMessage: routeAny})
+
+			local, remote := net.Pipe()
+			defer func() {
+				_ = remote.Close()
+			}()
+
+			// The client leads with a Send indication carrying its USERNAME.
+			msg, err := stun.Build(stun.NewType(stun.MethodSend, stun.ClassIndication), stun.NewUsername("myufrag:otherufrag"))
+			require.NoError(t, err)
+			go func() {
+				_, err := writeStreamingPacket(remote, msg.Raw, streamingPacketHeaderLen)
+				assert.NoError(t, err)
+			}()
+
+			err = tcpMux.HandleConn(&addrConn{Conn: local, remote: &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000}})
+			if !routeAny {
+				assert.ErrorIs(t, err, errNotSTUNBindingMessage)
+				assert.Equal(t, 0, tcpMux.TotalConns())
+				require.NoError(t, tcpMux.Close())
+				return
+			}
+			require.NoError(t, err)
+
+			pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+			require.NoError(t, err)
+
+			buf := make([]byte, receiveMTU)
+			n, _, err := pktConn.ReadFrom(buf)
+			require.NoError(t, err)
+			assert.Equal(t, msg.Raw, buf[:n])
+
+			require.NoError(t, tcpMux.Close())
+		})
+	}
+}
+
+func TestTCPMux_UserData(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+
+	type session struct{ id int }
+
+	_, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+
+	assert.Nil(t, tcpMux.UserData("myufrag"))
+	tcpMux.SetUserData("myufrag", &session{id: 1})
+	assert.Equal(t, &session{id: 1}, tcpMux.UserData("myufrag"))
+	assert.Nil(t, tcpMux.UserData("otherufrag"))
+
+	tcpMux.SetUserData("myufrag", nil)
+	assert.Nil(t, tcpMux.UserData("myufrag"))
+
+	// The value goes away with the conns of the ufrag.
+	tcpMux.SetUserData("myufrag", &session{id: 2})
+	tcpMux.RemoveConnByUfrag("myufrag")
+	assert.Nil(t, tcpMux.UserData("myufrag"))
+
+	tcpMux.SetUserData("myufrag", &session{id: 3})
+	require.NoError(t, tcpMux.Close())
+	assert.Nil(t, tcpMux.UserData("myufrag"))
+}
+
+func TestTCPMux_ZonedIPv6Remote(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+
+	msg, err := stun.Build(stun.BindingRequest, stun.NewUsername("myufrag:otherufrag"))
+	require.NoError(t, err)
+	go func() {
+		_, err := writeStreamingPacket(remote, msg.Raw, streamingPacketHeaderLen)
+		assert.NoError(t, err)
+	}()
+
+	raddr := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 5000, Zone: "eth0"}
+	require.NoError(t, tcpMux.HandleConn(&addrConn{Conn: local, remote: raddr}))
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", true)
+	require.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	n, addr, err := pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Raw, buf[:n])
+	assert.Equal(t, raddr, addr)
+	assert.Empty(t, tcpMux.RemoteAddrs("myufrag", false))
+
+	// Remote candidate addresses have no zone but still match the conn.
+	go func() {
+		_, err := pktConn.WriteTo([]byte("hello"), &net.TCPAddr{IP: raddr.IP, Port: raddr.Port})
+		assert.NoError(t, err)
+	}()
+	n, err = readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), buf[:n])
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_GatherCandidateInfo(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+	network, addr := tcpMux.GatherCandidateInfo()
+	assert.Equal(t, "tcp4", network)
+	assert.Equal(t, tcpMux.LocalAddr().String(), addr.String())
+	require.NoError(t, tcpMux.Close())
+
+	// A wildcard bind resolves to an interface address, if any.
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4zero})
+	require.NoError(t, err)
+	wildcardMux := NewTCPMuxDefault(TCPMuxParams{Listener: listener})
+
+	network, addr = wildcardMux.GatherCandidateInfo()
+	assert.Equal(t, "tcp4", network)
+	assert.Equal(t, listener.Addr().(*net.TCPAddr).Port, addr.Port)
+	assert.False(t, addr.IP.IsLoopback())
+	assert.NotNil(t, addr.IP.To4())
+	require.NoError(t, wildcardMux.Close())
+
+	nilMux := NewTCPMuxDefault(TCPMuxParams{})
+	network, addr = nilMux.GatherCandidateInfo()
+	assert.Empty(t, network)
+	assert.Nil(t, addr)
+}
+
+func TestTCPMux_Done(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+	dialTestTCPMux(t, tcpMux, "myufrag")
+
+	select {
+	case <-tcpMux.Done():
+		t.Fatal("done before Close")
+	default:
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		<-tcpMux.Done()
+		assert.Equal(t, 0, tcpMux.TotalConns())
+		close(closed)
+	}()
+
+	require.NoError(t, tcpMux.Close())
+	<-closed
+
+	// It stays closed, closing it again returns the error of the first
+	// Close.
+	<-tcpMux.Done()
+	assert.NoError(t, tcpMux.Close())
+
+	nilMux := NewTCPMuxDefault(TCPMuxParams{})
+	<-nilMux.Done()
+}
+
+func TestTCPMux_CloseLogsNoAcceptError(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	var logs syncBuffer
+	loggerFactory := &logging.DefaultLoggerFactory{
+		Writer:          &logs,
+		DefaultLogLevel: logging.LogLevelTrace,
+	}
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{Logger: loggerFactory.NewLogger("ice")})
+	require.NoError(t, tcpMux.Close())
+
+	assert.Contains(t, logs.String(), "Stopped listening TCP")
+	assert.NotContains(t, logs.String(), "Error accepting connection")
+	assert.NotContains(t, logs.String(), "WARNING")
+	assert.NotContains(t, logs.String(), "ERROR")
+}
+
+func TestTCPMux_ReconnectAfterClose(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+
+	dialTestTCPMux(t, tcpMux, "myufrag")
+	oldConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+	require.NoError(t, oldConn.Close())
+
+	// The closed conn is replaced rather than reused.
+	newConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+	assert.NotSame(t, oldConn, newConn)
+
+	_, msg := dialTestTCPMux(t, tcpMux, "myufrag")
+	buf := make([]byte, receiveMTU)
+	n, _, err := newConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Raw, buf[:n])
+
+	// Removing the old conn once it is closed leaves the new one alone.
+	assert.Never(t, func() bool {
+		return newConn.(*tcpPacketConn).isClosed()
+	}, 100*time.Millisecond, 10*time.Millisecond)
+
+	current, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+	assert.Same(t, newConn, current)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_MaxHandshakeFrameSize(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{MaxHandshakeFrameSize: 512})
+
+	// Frames over the limit are rejected whether or not they would fit in
+	// the pooled read buffers.
+	for _, length := range []int{744, 60000} {
+		local, remote := net.Pipe()
+
+		// Only the header announcing the frame is sent, the payload is never
+		// waited for.
+		go func(length int) {
+			header := make([]byte, streamingPacketHeaderLen)
+			putStreamingPacketHeader(header, length, streamingPacketHeaderLen)
+			_, err := remote.Write(header)
+			assert.NoError(t, err)
+		}(length)
+
+		err := tcpMux.HandleConn(&addrConn{Conn: local, remote: &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000}})
+		assert.ErrorIs(t, err, errHandshakeFrameTooLarge, length)
+
+		// The connection was closed.
+		_, err = remote.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+		assert.Equal(t, 0, tcpMux.TotalConns())
+		_ = remote.Close()
+	}
+
+	// Binding requests under the limit are still routed.
+	_, msg := dialTestTCPMux(t, tcpMux, "myufrag")
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	n, _, err := pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Raw, buf[:n])
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_ConnKey(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	// The conns are keyed by the order they were handled in, as their
+	// remote addresses are all the same "pipe".
+	keys := map[net.Conn]string{}
+	tcpMux := newTestTCPMux(t, TCPMuxParams{
+		ConnKey: func(conn net.Conn) string {
+			return keys[conn]
+		},
+	})
+
+	msg, err := stun.Build(stun.BindingRequest, stun.NewUsername("myufrag:otherufrag"))
+	require.NoError(t, err)
+
+	localAddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 443}
+	remotes := map[string]net.Conn{}
+	for i := 0; i < 2; i++ {
+		local, remote := net.Pipe()
+		defer func() {
+			_ = remote.Close()
+		}()
+
+		go func() {
+			_, err := writeStreamingPacket(remote, msg.Raw, streamingPacketHeaderLen)
+			assert.NoError(t, err)
+		}()
+
+		conn := &addrConn{Conn: local, remote: local.RemoteAddr(), local: localAddr}
+		keys[conn] = fmt.Sprint(i)
+		remotes[keys[conn]] = remote
+		require.NoError(t, tcpMux.HandleConn(conn))
+	}
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	for i := 0; i < 2; i++ {
+		_, addr, err := pktConn.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "pipe", addr.String())
+
+		// Replying to the address reaches the conn the packet came from.
+		key := addr.(*keyedAddr).key
+		go func() {
+			_, err := pktConn.WriteTo([]byte(key), addr)
+			assert.NoError(t, err)
+		}()
+
+		n, err := readStreamingPacket(remotes[key], buf, streamingPacketHeaderLen)
+		require.NoError(t, err)
+		assert.Equal(t, key, string(buf[:n]))
+	}
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_OnConnClose(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	type connClose struct {
+		ufrag string
+		err   error
+	}
+	closes := make(chan connClose, 1)
+	tcpMux := newTestTCPMux(t, TCPMuxParams{
+		OnConnClose: func(ufrag string, _ net.Addr, err error) {
+			closes <- connClose{ufrag, err}
+		},
+	})
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	readFirstPacket := func(t *testing.T) *net.TCPConn {
+		t.Helper()
+
+		conn, msg := dialTestTCPMux(t, tcpMux, "myufrag")
+		n, _, err := pktConn.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, msg.Raw, buf[:n])
+		return conn
+	}
+
+	t.Run("clean close", func(t *testing.T) {
+		conn := readFirstPacket(t)
+		require.NoError(t, conn.Close())
+
+		_, _, err := pktConn.ReadFrom(buf)
+		assert.ErrorIs(t, err, io.EOF)
+
+		closed := <-closes
+		assert.Equal(t, "myufrag", closed.ufrag)
+		assert.NoError(t, closed.err)
+
+		stats := tcpMux.Stats()
+		assert.Equal(t, uint64(1), stats.ClosedByRemote)
+		assert.Equal(t, uint64(0), stats.ReadErrors)
+	})
+
+	t.Run("truncated packet", func(t *testing.T) {
+		conn := readFirstPacket(t)
+		_, err := conn.Write([]byte{0, 10, 1, 2})
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+
+		_, _, err = pktConn.ReadFrom(buf)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+		closed := <-closes
+		assert.ErrorIs(t, closed.err, io.ErrUnexpectedEOF)
+
+		stats := tcpMux.Stats()
+		assert.Equal(t, uint64(1), stats.ClosedByRemote)
+		assert.Equal(t, uint64(1), stats.ReadErrors)
+	})
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_MuxRuntimeStats(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+	assert.Equal(t, TCPMuxRuntimeStats{}, tcpMux.MuxRuntimeStats())
+	assert.Zero(t, tcpMux.MuxRuntimeStats().HandshakeAvg())
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	for i := 0; i < 2; i++ {
+		dialTestTCPMux(t, tcpMux, "myufrag")
+		_, _, err = pktConn.ReadFrom(buf)
+		require.NoError(t, err)
+	}
+
+	stats := tcpMux.MuxRuntimeStats()
+	assert.Equal(t, uint64(2), stats.Handshakes)
+	assert.Positive(t, stats.HandshakeMin)
+	assert.LessOrEqual(t, stats.HandshakeMin, stats.HandshakeAvg())
+	assert.LessOrEqual(t, stats.HandshakeAvg(), stats.HandshakeMax)
+	assert.Equal(t, stats.HandshakeMin+stats.HandshakeMax, stats.HandshakeTotal)
+	assert.Equal(t, 2, stats.ReaderGoroutines)
+
+	// A connection that never sends its first packet stays in its handshake.
+	conn, err := net.DialTCP("tcp", nil, tcpMux.LocalAddr().(*net.TCPAddr))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return tcpMux.MuxRuntimeStats().ActiveHandshakes == 1
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, conn.Close())
+
+	require.NoError(t, tcpMux.Close())
+	stats = tcpMux.MuxRuntimeStats()
+	assert.Zero(t, stats.ActiveHandshakes)
+	assert.Zero(t, stats.ReaderGoroutines)
+}
+
+func TestTCPMux_NumGoroutines(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{
+		MigrateOnICERestart: true,
+		Dialer:              &net.Dialer{},
+		ShareDialedConns:    true,
+	})
+
+	// The accept loop and the migrations.
+	assert.Equal(t, 2, tcpMux.NumGoroutines())
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+
+	// The ufrag watcher, and the reader of the routed connection once its
+	// handshake is done.
+	buf := make([]byte, receiveMTU)
+	dialTestTCPMux(t, tcpMux, "myufrag")
+	_, _, err = pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return tcpMux.NumGoroutines() == 4
+	}, time.Second, 10*time.Millisecond)
+
+	// The reader of a shared dialed connection.
+	remote, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer func() {
+		_ = remote.Close()
+	}()
+	_, err = pktConn.WriteTo([]byte("hello"), remote.Addr())
+	require.NoError(t, err)
+	assert.Equal(t, 5, tcpMux.NumGoroutines())
+
+	require.NoError(t, tcpMux.Close())
+	assert.Zero(t, tcpMux.NumGoroutines())
+}
+
+func TestTCPMux_TLSServerName(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	certificate, err := selfsign.GenerateSelfSigned()
+	require.NoError(t, err)
+
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+
+	type routed struct {
+		ufrag, serverName string
+	}
+	routedConns := make(chan routed, 1)
+	tcpMux := NewTCPMuxDefault(TCPMuxParams{
+		Listener:       tls.NewListener(tcpListener, &tls.Config{Certificates: []tls.Certificate{certificate}}), //nolint:gosec
+		Logger:         logging.NewDefaultLoggerFactory().NewLogger("ice"),
+		ReadBufferSize: 20,
+		OnConn: func(ufrag string, _ net.Addr, serverName string) {
+			routedConns <- routed{ufrag, serverName}
+		},
+	})
+
+	conn, err := tls.Dial("tcp", tcpListener.Addr().String(), &tls.Config{
+		ServerName:         "tenant.example.com",
+		InsecureSkipVerify: true, //nolint:gosec
+	})
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	msg, err := stun.Build(stun.BindingRequest, stun.NewUsername("myufrag:otherufrag"))
+	require.NoError(t, err)
+	_, err = writeStreamingPacket(conn, msg.Raw, streamingPacketHeaderLen)
+	require.NoError(t, err)
+
+	assert.Equal(t, routed{"myufrag", "tenant.example.com"}, <-routedConns)
+	assert.Equal(t, map[string]uint64{"tenant.example.com": 1}, tcpMux.Stats().ConnsByServerName)
+
+	// Plain TCP connections have no server name.
+	assert.Empty(t, tlsServerName(&net.TCPConn{}))
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_ShareDialedConns(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpMux := newTestTCPMux(t, TCPMuxParams{Dialer: &net.Dialer{}, ShareDialedConns: true})
+
+	remote, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer func() {
+		_ = remote.Close()
+	}()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := remote.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	connA, err := tcpMux.GetConnByUfrag("ufragA", false)
+	require.NoError(t, err)
+	connB, err := tcpMux.GetConnByUfrag("ufragB", false)
+	require.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	expectPacket := func(conn net.Conn, expected string) {
+		t.Helper()
+		n, err := readStreamingPacket(conn, buf, streamingPacketHeaderLen)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(buf[:n]))
+	}
+
+	_, err = connA.WriteTo([]byte("from A"), remote.Addr())
+	require.NoError(t, err)
+	conn := <-accepted
+	defer func() {
+		_ = conn.Close()
+	}()
+	expectPacket(conn, "from A")
+
+	// The second ufrag writes through the same connection.
+	_, err = connB.WriteTo([]byte("from B"), remote.Addr())
+	require.NoError(t, err)
+	expectPacket(conn, "from B")
+	assert.Len(t, accepted, 0)
+	assert.Equal(t, 2, tcpMux.TotalConns())
+
+	// Packets read go to the ufrag that dialed.
+	_, err = writeStreamingPacket(conn, []byte("to A"), streamingPacketHeaderLen)
+	require.NoError(t, err)
+	n, _, err := connA.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "to A", string(buf[:n]))
+
+	// Once it releases the connection, the connection stays open for the
+	// other ufrag, which now gets the packets.
+	tcpMux.RemoveConnByUfrag("ufragA")
+	_, err = writeStreamingPacket(conn, []byte("to B"), streamingPacketHeaderLen)
+	require.NoError(t, err)
+	n, _, err = connB.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "to B", string(buf[:n]))
+
+	_, err = connB.WriteTo([]byte("still B"), remote.Addr())
+	require.NoError(t, err)
+	expectPacket(conn, "still B")
+
+	// The last release closes it.
+	tcpMux.RemoveConnByUfrag("ufragB")
+	_, err = readStreamingPacket(conn, buf, streamingPacketHeaderLen)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, 0, tcpMux.TotalConns())
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_CloseReasons(t *testing.T) {
+	assert.Equal(t, closeReasonRemoteClosed, readCloseReason(io.EOF))
+	assert.Equal(t, closeReasonExplicit, readCloseReason(fmt.Errorf("read: %w", net.ErrClosed)))
+	assert.Equal(t, closeReasonExplicit, readCloseReason(io.ErrClosedPipe))
+	assert.Equal(t, closeReasonReadError, readCloseReason(io.ErrUnexpectedEOF))
+
+	for reason := closeReason(0); reason < numCloseReasons; reason++ {
+		assert.NotEqual(t, "unknown", reason.String())
+	}
+
+	// A connection whose handshake fails is counted as rejected.
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 0})
+	require.NoError(t, err)
+
+	tcpMux := NewTCPMuxDefault(TCPMuxParams{
+		Listener:       listener,
+		Logger:         logging.NewDefaultLoggerFactory().NewLogger("ice"),
+		ReadBufferSize: 20,
+	})
+
+	conn, err := net.DialTCP("tcp", nil, tcpMux.LocalAddr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_, err = writeStreamingPacket(conn, []byte("not stun"), streamingPacketHeaderLen)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return tcpMux.stats.loadCloses(closeReasonRejected) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_UnixListener(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "mux.sock"))
+	require.NoError(t, err)
+
+	tcpMux := NewTCPMuxDefault(TCPMuxParams{
+		Listener:        listener,
+		Logger:          logging.NewDefaultLoggerFactory().NewLogger("ice"),
+		ReadBufferSize:  20,
+		NonIPRemoteIPv6: true,
+	})
+
+	conn, err := net.Dial("unix", listener.Addr().String())
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
+		stun.NewUsername("myufrag:otherufrag"),
+		stun.NewShortTermIntegrity("pwd"),
+		stun.Fingerprint,
+	)
+	require.NoError(t, err)
+
+	_, err = writeStreamingPacket(conn, msg.Raw, streamingPacketHeaderLen)
+	require.NoError(t, err)
+
+	// The connection has no IP, it is routed to the configured family.
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", true)
+	require.NoError(t, err)
+
+	buf := make([]byte, receiveMTU)
+	n, raddr, err := pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Raw, buf[:n])
+	assert.Equal(t, "tcp", raddr.Network())
+	assert.Equal(t, conn.LocalAddr().String(), raddr.String())
+	assert.Equal(t, "tcp", pktConn.LocalAddr().Network())
+	assert.Equal(t, listener.Addr().String(), pktConn.LocalAddr().String())
+
+	_, err = pktConn.WriteTo([]byte("reply"), raddr)
+	require.NoError(t, err)
+
+	n, err = readStreamingPacket(conn, buf, streamingPacketHeaderLen)
+	require.NoError(t, err)
+	assert.Equal(t, "reply", string(buf[:n]))
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_ClassifyConn(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 0})
+	require.NoError(t, err)
+
+	// Connections starting with a TLS handshake record are taken over, the
+	// others are left to the mux.
+	peeks := make(chan []byte, 2)
+	claimed := make(chan net.Conn, 1)
+	tcpMux := NewTCPMuxDefault(TCPMuxParams{
+		Listener:       listener,
+		Logger:         logging.NewDefaultLoggerFactory().NewLogger("ice"),
+		ReadBufferSize: 20,
+		ClassifyConn: func(conn net.Conn, peek []byte) bool {
+			peeks <- append([]byte(nil), peek...)
+			if peek[0] != 0x16 {
+				return false
+			}
+			claimed <- conn
+			return true
+		},
+	})
+
+	other, err := net.DialTCP("tcp", nil, tcpMux.LocalAddr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer func() {
+		_ = other.Close()
+	}()
+
+	_, err = other.Write([]byte{0x16, 0x03, 0x01})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x16, 0x03, 0x01}, <-peeks)
+
+	// The claimed connection still reads the peeked bytes.
+	claimedConn := <-claimed
+	buf := make([]byte, receiveMTU)
+	_, err = io.ReadFull(claimedConn, buf[:3])
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x16, 0x03, 0x01}, buf[:3])
+	require.NoError(t, claimedConn.Close())
+	assert.Equal(t, 0, tcpMux.TotalConns())
+
+	msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
+		stun.NewUsername("myufrag:otherufrag"),
+		stun.NewShortTermIntegrity("pwd"),
+		stun.Fingerprint,
+	)
+	require.NoError(t, err)
+
+	conn, err := net.DialTCP("tcp", nil, tcpMux.LocalAddr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// The next frame is sent along with the binding request, so it is already
+	// buffered by the classification when the connection is routed.
+	stream := []byte{byte(len(msg.Raw) >> 8), byte(len(msg.Raw))}
+	stream = append(stream, msg.Raw...)
+	stream = append(stream, 0, byte(len("next")))
+	stream = append(stream, "next"...)
+	_, err = conn.Write(stream)
+	require.NoError(t, err)
+
+	// The classifier sees the raw frame, which is then routed and delivered.
+	peek := <-peeks
+	require.Greater(t, len(peek), streamingPacketHeaderLen)
+	assert.Equal(t, stream[:len(peek)], peek)
+
+	pktConn, err := tcpMux.GetConnByUfrag("myufrag", false)
+	require.NoError(t, err)
+
+	n, _, err := pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Raw, buf[:n])
+
+	n, _, err = pktConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "next", string(buf[:n]))
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_Events(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 0})
+	require.NoError(t, err)
+
+	tcpMux := NewTCPMuxDefault(TCPMuxParams{
+		Listener:       listener,
+		Logger:         logging.NewDefaultLoggerFactory().NewLogger("ice"),
+		ReadBufferSize: 20,
+	})
+
+	conn, err := net.DialTCP("tcp", nil, tcpMux.LocalAddr().(*net.TCPAddr))
+	require.NoError(t, err)
+
+	msg, err := stun.Build(stun.BindingRequest, stun.TransactionID,
+		stun.NewUsername("myufrag:otherufrag"),
+		stun.NewShortTermIntegrity("pwd"),
+		stun.Fingerprint,
+	)
+	require.NoError(t, err)
+
+	_, err = writeStreamingPacket(conn, msg.Raw, streamingPacketHeaderLen)
+	require.NoError(t, err)
+
+	event := <-tcpMux.Events()
+	assert.Equal(t, MuxEventConnAdded, event.Type)
+	assert.Equal(t, "myufrag", event.Ufrag)
+	assert.Equal(t, conn.LocalAddr().String(), event.Remote.String())
+
+	// The remote disconnecting removes its connection.
+	require.NoError(t, conn.Close())
+
+	event = <-tcpMux.Events()
+	assert.Equal(t, MuxEventConnRemoved, event.Type)
+	assert.Equal(t, "myufrag", event.Ufrag)
+	assert.Equal(t, conn.LocalAddr().String(), event.Remote.String())
+
+	// The channel is closed with the mux.
+	require.NoError(t, tcpMux.Close())
+	_, ok := <-tcpMux.Events()
+	assert.False(t, ok)
+}
+
+func TestTCPMux_EventsDropped(t *testing.T) {
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+
+	// Nobody reads the events, those past the buffer are dropped without
+	// blocking.
+	for i := 0; i < muxEventsBufferSize+10; i++ {
+		tcpMux.emit(MuxEventConnAdded, "myufrag", &net.TCPAddr{Port: i})
+	}
+	assert.Len(t, tcpMux.Events(), muxEventsBufferSize)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_RejectionStats(t *testing.T) {
+	tcpMux := newTestTCPMux(t, TCPMuxParams{})
+
+	allocate, err := stun.Build(stun.NewType(stun.MethodAllocate, stun.ClassRequest), stun.TransactionID,
+		stun.NewUsername("myufrag:otherufrag"),
+	)
+	require.NoError(t, err)
+	noUsername, err := stun.Build(stun.BindingRequest, stun.TransactionID)
+	require.NoError(t, err)
+
+	// Each rejection is counted under its reason.
+	for _, pkt := range [][]byte{[]byte("not stun"), allocate.Raw, noUsername.Raw} {
+		conn, err := net.DialTCP("tcp", nil, tcpMux.LocalAddr().(*net.TCPAddr))
+		require.NoError(t, err)
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		_, err = writeStreamingPacket(conn, pkt, streamingPacketHeaderLen)
+		require.NoError(t, err)
+	}
+
+	assert.Eventually(t, func() bool {
+		return tcpMux.stats.loadCloses(closeReasonRejected) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	stats := tcpMux.Stats()
+	assert.Equal(t, uint64(1), stats.STUNDecodeFailures)
+	assert.Equal(t, uint64(1), stats.NonBindingMessages)
+	assert.Equal(t, uint64(1), stats.MissingUsernames)
+	assert.Equal(t, uint64(0), stats.InvalidUfrags)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_ReceiveMTU(t *testing.T) {
+	tcpMux := newTestTCPMux(t, TCPMuxParams{DeliverFirstPacket: new(bool)})
+
+	bigConn, err := tcpMux.GetConnByUfragWithReceiveMTU("big", false, 2*receiveMTU)
+	require.NoError(t, err)
+	defaultConn, err := tcpMux.GetConnByUfrag("default", false)
+	require.NoError(t, err)
+
+	big, _ := dialTestTCPMux(t, tcpMux, "big")
+	other, _ := dialTestTCPMux(t, tcpMux, "default")
+
+	pkt := make([]byte, receiveMTU+1)
+	buf := make([]byte, 2*receiveMTU)
+
+	// The ufrag with a larger MTU reads the packet, the other closes its
+	// connection.
+	_, err = writeStreamingPacket(big, pkt, streamingPacketHeaderLen)
+	require.NoError(t, err)
+	n, _, err := bigConn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, len(pkt), n)
+
+	_, err = writeStreamingPacket(other, pkt, streamingPacketHeaderLen)
+	require.NoError(t, err)
+	_, _, err = defaultConn.ReadFrom(buf)
+	assert.ErrorIs(t, err, io.ErrShortBuffer)
+
+	// Lowering the MTU applies to the existing connections.
+	_, err = tcpMux.GetConnByUfragWithReceiveMTU("big", false, 100)
+	require.NoError(t, err)
+	_, err = writeStreamingPacket(big, make([]byte, 101), streamingPacketHeaderLen)
+	require.NoError(t, err)
+	_, _, err = bigConn.ReadFrom(buf)
+	assert.ErrorIs(t, err, io.ErrShortBuffer)
+
+	require.NoError(t, tcpMux.Close())
+}
+
+func TestTCPMux_ReceiveMTUBufferedWrites(t *testing.T) {
+	tcpMux := newTestTCPMux(t, TCPMuxParams{WriteBufferSize: 64 * 1024})
+
+	bigConn, err := tcpMux.GetConnByUfragWithReceiveMTU("big", false, 4*receiveMTU)
+	require.NoError(t, err)
+
+	big, _ := dialTestTCPMux(t, tcpMux, "big")
+
+	buf := make([]byte, 4*receiveMTU)
+	_, raddr, err := bigConn.ReadFrom(buf)
+	require.NoError(t, err)
+
+	// Packets as large as the MTU of the ufrag go through the write buffer
+	// whole.
+	for _, size := range []int{4 * receiveMTU, 10, receiveMTU + 1} {
+		pkt := bytes.Repeat([]byte{byte(size)}, size)
+		_, err = bigConn.WriteTo(pkt, raddr)
+		require.NoError(t, err)
+
+		n, err := readStreamingPacket(big, buf, streamingPacketHeaderLen)
+		require.NoError(t, err)
+		assert.Equal(t, pkt, buf[:n])
+	}
+
+	require.NoError(t, tcpMux.Close())
+}
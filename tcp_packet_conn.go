@@ -1,259 +1,2055 @@
 package ice
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/pion/logging"
+	"github.com/pion/stun"
 	"github.com/pion/transport/packetio"
 )
 
+const (
+	// bufferedConnCloseTimeout bounds how long Close waits for queued writes
+	// to be flushed to the socket.
+	bufferedConnCloseTimeout = time.Second
+	// bufferedConnFlushTimeout bounds how long tcpPacketConn.Flush waits.
+	bufferedConnFlushTimeout = time.Second
+)
+
 type bufferedConn struct {
 	net.Conn
 	buffer *packetio.Buffer
 	logger logging.LeveledLogger
-	closed int32
+
+	// writeTimeout bounds each write to the socket, 0 disables it.
+	writeTimeout time.Duration
+
+	// batchBytes is the size up to which queued packets are coalesced into
+	// a single write to the socket, 0 writes them one by one.
+	batchBytes int
+
+	// done is closed when writeProcess exits.
+	done chan struct{}
+
+	// queued and sent count the packets accepted by Write and those taken
+	// out of the buffer since, progress is closed and replaced whenever sent
+	// grows.
+	mu       sync.Mutex
+	queued   uint64
+	sent     uint64
+	progress chan struct{}
+
+	// highWatermark is the largest size the buffer has reached.
+	highWatermark int
+
+	// limitSize is the size limit of the buffer.
+	limitSize int
+
+	// lowWatermark is the size from which a filling buffer is logged, 0
+	// disables it, aboveLowWatermark whether the buffer is above it.
+	lowWatermark      int
+	aboveLowWatermark bool
+
+	// nearFull is the fraction of limitSize from which onNearFull is called,
+	// 0 disables it, aboveNearFull whether the buffer is at least that full.
+	nearFull      float64
+	onNearFull    func(queued, limit int)
+	aboveNearFull bool
+
+	// blockWhenFull makes Write wait for room in a full buffer instead of
+	// failing.
+	blockWhenFull bool
+
+	// The underlying conn is closed either by Close or by writeProcess when a
+	// write fails.
+	closeConnOnce sync.Once
+	closeConnErr  error
+}
+
+// maxBufferedFrameLen is the largest frame a packetio.Buffer holds.
+const maxBufferedFrameLen = 0xFFFF
+
+// bufferedConnParams configure a bufferedConn, see the fields of the same
+// name in tcpPacketParams.
+type bufferedConnParams struct {
+	Size          int
+	WriteTimeout  time.Duration
+	BatchBytes    int
+	LowWatermark  int
+	BlockWhenFull bool
+
+	// NearFull and OnNearFull implement WriteBufferNearFull and
+	// OnWriteBufferNearFull.
+	NearFull   float64
+	OnNearFull func(queued, limit int)
+}
+
+func newBufferedConn(conn net.Conn, params bufferedConnParams, logger logging.LeveledLogger) net.Conn {
+	buffer := packetio.NewBuffer()
+	if params.Size > 0 {
+		buffer.SetLimitSize(params.Size)
+	}
+
+	bc := &bufferedConn{
+		Conn:          conn,
+		buffer:        buffer,
+		logger:        logger,
+		writeTimeout:  params.WriteTimeout,
+		batchBytes:    params.BatchBytes,
+		limitSize:     params.Size,
+		lowWatermark:  params.LowWatermark,
+		blockWhenFull: params.BlockWhenFull,
+		nearFull:      params.NearFull,
+		onNearFull:    params.OnNearFull,
+		done:          make(chan struct{}),
+		progress:      make(chan struct{}),
+	}
+
+	go bc.writeProcess()
+	return bc
+}
+
+// Write queues b. If the buffer is full, it fails with ErrWriteBufferFull,
+// or with blockWhenFull waits until the packet fits or the conn fails.
+func (bc *bufferedConn) Write(b []byte) (int, error) {
+	return bc.write(b, bc.blockWhenFull, time.Time{})
+}
+
+// write queues b, waiting for room in a full buffer if block is set, until
+// deadline unless it is zero.
+func (bc *bufferedConn) write(b []byte, block bool, deadline time.Time) (int, error) {
+	if len(b) > maxBufferedFrameLen {
+		return 0, fmt.Errorf("%w: frame of %d bytes, over the %d bytes a write buffer holds", errStreamingPacketTooLarge, len(b), maxBufferedFrameLen)
+	}
+
+	var expired <-chan time.Time
+	if block && !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		bc.mu.Lock()
+		n, err := bc.buffer.Write(b)
+		if err == nil {
+			nearFull := bc.recordQueued()
+			queued, limit := bc.buffer.Size(), bc.limitSize
+			bc.mu.Unlock()
+
+			if nearFull {
+				bc.onNearFull(queued, limit)
+			}
+			return n, nil
+		}
+
+		// A packet that doesn't fit in the empty buffer never will.
+		progress, empty := bc.progress, bc.buffer.Size() == 0
+		bc.mu.Unlock()
+
+		if !errors.Is(err, packetio.ErrFull) {
+			return n, err
+		}
+		if !block || empty {
+			return n, wrapError(ErrWriteBufferFull, err)
+		}
+
+		select {
+		case <-progress:
+		case <-bc.done:
+			return 0, io.ErrClosedPipe
+		case <-expired:
+			return 0, wrapError(ErrWriteBufferFull, os.ErrDeadlineExceeded)
+		}
+	}
+}
+
+// bufferedDeadlineConn is a bufferedConn whose writes wait for room in the
+// buffer until deadline.
+type bufferedDeadlineConn struct {
+	*bufferedConn
+	deadline time.Time
+}
+
+func (c bufferedDeadlineConn) Write(b []byte) (int, error) {
+	return c.write(b, true, c.deadline)
+}
+
+// recordQueued records a packet queued, and returns whether it made the
+// buffer nearly full, for onNearFull to be called once bc.mu is released.
+// Must be called with bc.mu held.
+func (bc *bufferedConn) recordQueued() bool {
+	bc.queued++
+
+	size := bc.buffer.Size()
+	if size > bc.highWatermark {
+		bc.highWatermark = size
+	}
+
+	if bc.lowWatermark > 0 && size >= bc.lowWatermark && !bc.aboveLowWatermark {
+		bc.aboveLowWatermark = true
+		bc.logger.Warnf("event=write_buffer_filling: %d bytes queued, limit %d", size, bc.limitSize)
+	}
+
+	if bc.onNearFull != nil && bc.isNearFull() && !bc.aboveNearFull {
+		bc.aboveNearFull = true
+		return true
+	}
+	return false
+}
+
+// isNearFull returns whether the buffer is at least nearFull full. Must be
+// called with bc.mu held.
+func (bc *bufferedConn) isNearFull() bool {
+	if bc.nearFull <= 0 || bc.limitSize <= 0 {
+		return false
+	}
+	return float64(bc.buffer.Size()) >= bc.nearFull*float64(bc.limitSize)
+}
+
+// setLimitSize changes the size limit of the buffer.
+func (bc *bufferedConn) setLimitSize(size int) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.limitSize = size
+	bc.buffer.SetLimitSize(size)
+
+	// Writes waiting for room retry with the new limit.
+	close(bc.progress)
+	bc.progress = make(chan struct{})
+}
+
+// BufferStats returns the number of bytes currently queued and the most
+// that have ever been queued at once.
+func (bc *bufferedConn) BufferStats() (queued, highWatermark int) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	return bc.buffer.Size(), bc.highWatermark
+}
+
+// written marks n packets taken from the buffer as handled.
+func (bc *bufferedConn) written(n int) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.sent += uint64(n)
+	close(bc.progress)
+	bc.progress = make(chan struct{})
+
+	if bc.aboveLowWatermark && bc.buffer.Size() < bc.lowWatermark {
+		bc.aboveLowWatermark = false
+		bc.logger.Infof("event=write_buffer_drained: %d bytes queued", bc.buffer.Size())
+	}
+
+	if bc.aboveNearFull && !bc.isNearFull() {
+		bc.aboveNearFull = false
+	}
+}
+
+// WriteBatch writes each of bufs as a separate packet to raddr. Unless a
+// write buffer or a custom FrameCodec is used, the framed packets are
+// coalesced into a single vectored write on the socket. It returns the number
+// of packets fully written and the error that stopped the batch, if any.
+func (t *tcpPacketConn) WriteBatch(bufs [][]byte, raddr net.Addr) (int, error) {
+	t.mu.Lock()
+	conn, ok := t.conns[t.key(raddr)]
+	t.mu.Unlock()
+
+	if !ok {
+		return 0, io.ErrClosedPipe
+	}
+
+	headerLen, inPlace := t.streamingHeaderLen()
+
+	defer t.lockWrites(conn)()
+
+	// Buffered packets are queued one by one to keep their boundaries, as
+	// are those written to a shared conn, which must not interleave with
+	// the writes of its other ufrags.
+	_, buffered := conn.(*bufferedConn)
+	if _, pooled := conn.(*pooledConn); buffered || pooled || !inPlace {
+		for i, buf := range bufs {
+			if err := t.checkBoundaries(buf); err != nil {
+				return i, err
+			}
+			_, err := t.params.FrameCodec.WriteFrame(conn, buf)
+			t.params.Stats.addWrite(len(buf), err)
+			if err != nil {
+				return i, err
+			}
+		}
+		return len(bufs), nil
+	}
+
+	var batchErr error
+	headers := make([]byte, headerLen*len(bufs))
+	frames := make(net.Buffers, 0, 2*len(bufs))
+	for i, buf := range bufs {
+		batchErr = t.checkBoundaries(buf)
+		if batchErr == nil && len(buf) > maxStreamingPacketLen(headerLen) {
+			batchErr = fmt.Errorf("%w: %d bytes", errStreamingPacketTooLarge, len(buf))
+		}
+		if batchErr != nil {
+			bufs = bufs[:i]
+			break
+		}
+
+		header := headers[i*headerLen : (i+1)*headerLen]
+		putStreamingPacketHeader(header, len(buf), headerLen)
+		frames = append(frames, header, buf)
+	}
+
+	// Vectored writes on sockets only return short on errors, the writes of
+	// other conns must be completed before the next buffer is written.
+	var w io.Writer = conn
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+	default:
+		w = fullWriter{conn}
+	}
+	n, err := frames.WriteTo(w)
+
+	var written int
+	for _, buf := range bufs {
+		size := int64(headerLen + len(buf))
+		if n < size {
+			break
+		}
+		n -= size
+		written++
+		t.params.Stats.addWrite(len(buf), nil)
+	}
+
+	if err != nil {
+		t.connLogger(raddr).Tracef("event=write_error: %s", err)
+		return written, err
+	}
+
+	return written, batchErr
+}
+
+// RemoteAddrs returns the addresses of the remotes currently connected.
+func (t *tcpPacketConn) RemoteAddrs() []net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	addrs := make([]net.Addr, 0, len(t.conns))
+	for key, conn := range t.conns {
+		addrs = append(addrs, t.remoteAddr(conn, key))
+	}
+
+	return addrs
+}
+
+// ConnAge returns how long ago the connection to raddr was added, which is
+// about when it was established for accepted and dialed connections.
+func (t *tcpPacketConn) ConnAge(raddr net.Addr) (time.Duration, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conn, ok := t.conns[t.key(raddr)]
+	if !ok {
+		return 0, io.ErrClosedPipe
+	}
+
+	return time.Since(t.addedAt[conn]), nil
+}
+
+// ConnAges returns the age of the connections of the remotes currently
+// connected, see ConnAge.
+func (t *tcpPacketConn) ConnAges() []RemoteConnAge {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	ages := make([]RemoteConnAge, 0, len(t.conns))
+	for key, conn := range t.conns {
+		ages = append(ages, RemoteConnAge{
+			Remote: t.remoteAddr(conn, key),
+			Age:    now.Sub(t.addedAt[conn]),
+		})
+	}
+
+	return ages
+}
+
+// Conn returns the connection to raddr, unwrapped from its write buffer if
+// any, for inspection such as reading its socket options or TLS connection
+// state. It must not be read from or written to: reads race with the reader
+// of t and writes corrupt the framing of the stream.
+func (t *tcpPacketConn) Conn(raddr net.Addr) (net.Conn, bool) {
+	t.mu.Lock()
+	conn, ok := t.conns[t.key(raddr)]
+	t.mu.Unlock()
+
+	if bc, isBuffered := conn.(*bufferedConn); isBuffered {
+		return bc.Conn, true
+	}
+
+	return conn, ok
+}
+
+// RTT returns the smoothed round-trip time estimated by the kernel for the
+// connection to raddr, read from TCP_INFO. It is only supported on Linux
+// for *net.TCPConn connections, ErrUnsupported is returned otherwise.
+func (t *tcpPacketConn) RTT(raddr net.Addr) (time.Duration, error) {
+	conn, ok := t.Conn(raddr)
+	if !ok {
+		return 0, io.ErrClosedPipe
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+
+	return tcpRTT(tcpConn)
+}
+
+// RecvQueueStats returns the number of received packets waiting to be read
+// and the capacity of the receive queue. A queue that stays close to full
+// reveals a reader that can't keep up.
+func (t *tcpPacketConn) RecvQueueStats() (length, capacity int) {
+	t.recvMu.RLock()
+	defer t.recvMu.RUnlock()
+
+	return len(t.recvChan), cap(t.recvChan)
+}
+
+// WriteBufferStats returns the number of bytes queued in the write buffers
+// of all conns, and the highest number of bytes any of them has queued.
+func (t *tcpPacketConn) WriteBufferStats() (queued, highWatermark int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, conn := range t.conns {
+		if bc, ok := conn.(*bufferedConn); ok {
+			q, hwm := bc.BufferStats()
+			queued += q
+			if hwm > highWatermark {
+				highWatermark = hwm
+			}
+		}
+	}
+
+	return queued, highWatermark
+}
+
+// Flush blocks until every packet accepted by Write so far has been written
+// to the socket, or timeout elapses.
+func (bc *bufferedConn) Flush(timeout time.Duration) error {
+	return bc.FlushDeadline(time.Now().Add(timeout))
+}
+
+// FlushDeadline is like Flush but waits until deadline, or without a limit if
+// deadline is zero. Packets written concurrently with or after the call
+// aren't waited for, so a steady stream of writes can't hold it up.
+func (bc *bufferedConn) FlushDeadline(deadline time.Time) error {
+	bc.mu.Lock()
+	target := bc.queued
+	bc.mu.Unlock()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		bc.mu.Lock()
+		sent, progress := bc.sent, bc.progress
+		bc.mu.Unlock()
+
+		if sent >= target {
+			return nil
+		}
+
+		select {
+		case <-progress:
+		case <-bc.done:
+			// writeProcess may have sent the last packets right before exiting.
+			bc.mu.Lock()
+			sent = bc.sent
+			bc.mu.Unlock()
+
+			if sent >= target {
+				return nil
+			}
+			return io.ErrClosedPipe
+		case <-expired:
+			return errFlushTimeout
+		}
+	}
+}
+
+func (bc *bufferedConn) writeProcess() {
+	defer close(bc.done)
+
+	// Packets in the buffer are already framed, and may be larger than
+	// receiveMTU with the extended header or the receive MTU of a ufrag, so
+	// room is left for the largest frame the buffer holds, whatever its size
+	// limit is set to later on. A batch may go over batchBytes by up to one
+	// packet.
+	const maxFrameLen = maxBufferedFrameLen
+	pktBuf := make([]byte, maxFrameLen+bc.batchBytes)
+	for {
+		// Read keeps returning queued packets after the buffer is closed and
+		// only returns io.EOF once it has been drained.
+		n, err := bc.buffer.Read(pktBuf[:maxFrameLen])
+		if errors.Is(err, io.EOF) {
+			return
+		}
+
+		if err != nil {
+			bc.logger.Warnf("event=buffer_read_error: %s", err)
+			bc.written(1)
+			continue
+		}
+
+		// Coalesce the packets already queued, without waiting for more. The
+		// buffer has a single reader, so Read doesn't block while Count is
+		// non-zero.
+		packets := 1
+		for n < bc.batchBytes && bc.buffer.Count() > 0 {
+			m, err := bc.buffer.Read(pktBuf[n : n+maxFrameLen])
+			if err != nil {
+				bc.logger.Warnf("event=buffer_read_error: %s", err)
+				bc.written(1)
+				break
+			}
+			n += m
+			packets++
+		}
+
+		if bc.writeTimeout > 0 {
+			if err = bc.Conn.SetWriteDeadline(time.Now().Add(bc.writeTimeout)); err != nil {
+				bc.logger.Warnf("event=write_deadline_error: %s", err)
+			}
+		}
+
+		err = writeFull(bc.Conn, pktBuf[:n])
+		bc.written(packets)
+		if err != nil {
+			// The stream can't be resynchronized after a failed write. Closing
+			// the conn makes the reader fail, which removes the conn.
+			bc.logger.Warnf("event=write_error: %s", err)
+			_ = bc.closeConn()
+			return
+		}
+	}
+}
+
+// Close stops accepting writes, waits up to bufferedConnCloseTimeout for
+// the queued packets to be written and then closes the underlying conn. As it
+// may block that long, it must not be called with a lock held that other
+// conns or ufrags need.
+func (bc *bufferedConn) Close() error {
+	_ = bc.buffer.Close()
+
+	timer := time.NewTimer(bufferedConnCloseTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-bc.done:
+		return bc.closeConn()
+	case <-timer.C:
+	}
+
+	// Closing the conn unblocks a pending Write in writeProcess.
+	err := bc.closeConn()
+	<-bc.done
+	return err
+}
+
+// detach stops accepting writes, waits up to bufferedConnCloseTimeout for the
+// queued packets to be written and returns the underlying conn, which is left
+// open. It returns false if the conn was closed instead, after a failed write
+// or on timeout.
+func (bc *bufferedConn) detach() (net.Conn, bool) {
+	_ = bc.buffer.Close()
+
+	timer := time.NewTimer(bufferedConnCloseTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-bc.done:
+	case <-timer.C:
+		_ = bc.closeConn()
+		<-bc.done
+		return nil, false
+	}
+
+	// Consuming closeConnOnce keeps the conn open from now on, unless
+	// writeProcess already closed it.
+	detached := false
+	bc.closeConnOnce.Do(func() {
+		detached = true
+	})
+
+	return bc.Conn, detached
+}
+
+func (bc *bufferedConn) closeConn() error {
+	bc.closeConnOnce.Do(func() {
+		bc.closeConnErr = bc.Conn.Close()
+	})
+	return bc.closeConnErr
+}
+
+type tcpPacketConn struct {
+	params *tcpPacketParams
+
+	// conns is a map of net.Conns indexed by the KeyFunc of their remote
+	// address, or their ConnKey
+	conns map[string]net.Conn
+
+	// altConns holds the second conn of the remotes connected twice under
+	// DuplicateConnKeepBoth, which takes over once the first is removed.
+	altConns map[string]net.Conn
+
+	// replacedConns are the conns closed by DuplicateConnPreferNew, whose
+	// read error isn't returned by ReadFrom.
+	replacedConns map[net.Conn]struct{}
+
+	// connKeys is the key each registered conn is stored under, so that it
+	// can be removed even if its RemoteAddr changes.
+	connKeys map[net.Conn]string
+
+	// addedAt is when each registered conn was added.
+	addedAt map[net.Conn]time.Time
+
+	// writeMus serialize the writes to each registered unbuffered conn,
+	// along with the write deadlines they set.
+	writeMus map[net.Conn]*sync.Mutex
+
+	// recvChan is the receive queue. SetReadBufferSize replaces it under
+	// recvMu, after closing recvResized to wake up blocked senders.
+	recvChan    chan streamingPacket
+	recvResized chan struct{}
+	recvMu      sync.RWMutex
+	resizeMu    sync.Mutex
+
+	// readBufferPool recycles the buffers packets are read into.
+	readBufferPool *sync.Pool
+
+	// receiveMTU is the largest packet read, accessed atomically.
+	receiveMTU int64
+
+	// writeDeadline bounds the dials of WriteTo, in Unix nanoseconds or 0
+	// for none, accessed atomically.
+	writeDeadline int64
+
+	// fragmentMu keeps the fragments of concurrent WriteTo calls from
+	// interleaving.
+	fragmentMu sync.Mutex
+
+	mu         sync.Mutex
+	wg         sync.WaitGroup
+	closedChan chan struct{}
+	closeOnce  sync.Once
+}
+
+type streamingPacket struct {
+	Data  []byte
+	RAddr net.Addr
+	Err   error
+
+	// pooled is the read buffer pool entry backing Data, if any.
+	pooled *[]byte
+}
+
+type tcpPacketParams struct {
+	Ufrag       string
+	ReadBuffer  int
+	LocalAddr   net.Addr
+	Logger      logging.LeveledLogger
+	WriteBuffer int
+
+	// Stats, if set, accumulates the counters of the conns.
+	Stats *tcpMuxStats
+
+	// WriteTimeout bounds each write of a buffered conn to its socket, and
+	// each WriteTo on an unbuffered conn. 0 disables it.
+	WriteTimeout time.Duration
+
+	// WriteBufferNearFull is the fraction of WriteBuffer from which
+	// OnWriteBufferNearFull is called, 0 disables it.
+	WriteBufferNearFull float64
+	// OnWriteBufferNearFull, if set, is called by the writer that fills the
+	// write buffer of a conn up to WriteBufferNearFull, once until the
+	// buffer drains below it again.
+	OnWriteBufferNearFull func(raddr net.Addr, queued, limit int)
+
+	// WriteBatchBytes is the size up to which the packets queued in the
+	// write buffer of a conn are coalesced into a single socket write, 0
+	// disables coalescing.
+	WriteBatchBytes int
+
+	// WriteBufferLowWatermark is the size of a write buffer from which a
+	// warning is logged, once until it drains below it again, 0 disables it.
+	WriteBufferLowWatermark int
+
+	// WriteBufferBlocking makes the writes to a full write buffer wait for
+	// room instead of failing with ErrWriteBufferFull.
+	WriteBufferBlocking bool
+
+	// ReadRate limits the bytes read per second from each conn, 0 disables
+	// it.
+	ReadRate int
+
+	// FrameCodec frames the packets on the conns, defaults to RFC 4571
+	// framing with a streamingPacketHeaderLen header.
+	FrameCodec FrameCodec
+
+	// PoolReadBuffers makes the reader hand the pooled buffers of received
+	// packets over to ReadFrom, which releases them once copied out, rather
+	// than copying the packets.
+	PoolReadBuffers bool
+	// ReadBufferPool, if set, is the pool of receiveMTU sized buffers the
+	// packets are read into, shared with other tcpPacketConns. A pool of
+	// this conn is used otherwise.
+	ReadBufferPool *sync.Pool
+	// ReceiveMTU is the largest packet read from the conns, larger ones
+	// close their conn. 0 defaults to receiveMTU.
+	ReceiveMTU int
+
+	// KeyFunc maps a remote address to the key its conn is stored under,
+	// defaults to remoteAddrKey. Remote addresses with the same key share a
+	// single conn: AddConn rejects a second conn with errConnectionAddrAlreadyExist
+	// until the first is removed, and WriteTo to any of them uses it.
+	KeyFunc func(net.Addr) string
+
+	// OnConnClose, if set, is called by the reader of each conn once it
+	// stops, with nil if the remote closed the conn cleanly.
+	OnConnClose func(raddr net.Addr, err error)
+
+	// OnConnChange, if set, is called with mu held whenever a conn is
+	// registered or unregistered, it must not block.
+	OnConnChange func(raddr net.Addr, added bool)
+
+	// AllowFragmentation splits the packets written that don't fit in a
+	// frame read by the peer, and reassembles the fragments read.
+	AllowFragmentation bool
+
+	// StrictBoundaries makes the writes of packets larger than the peer
+	// reads, without AllowFragmentation, fail.
+	StrictBoundaries bool
+
+	// ConnKey, if set, replaces KeyFunc to key the conns by their identity
+	// rather than their remote address. The packets read from them then
+	// carry a keyedAddr, which WriteTo maps back to the conn.
+	ConnKey func(net.Conn) string
+
+	// Dialer is used by WriteTo to connect to remotes without a conn, nil
+	// disables active connections.
+	Dialer *net.Dialer
+	// ConnPool, if set, shares the dialed conns with the other
+	// tcpPacketConns using the same pool.
+	ConnPool *connPool
+	// Network is the network used to dial remotes, "tcp4" or "tcp6" for the
+	// address family of this conn, so a dial never picks the other family.
+	Network string
+
+	// DuplicatePolicy decides what AddConn does with a conn from a remote
+	// that already has one.
+	DuplicatePolicy DuplicateConnPolicy
+
+	// Migrations, if set, receives the conns that get a STUN binding request
+	// for another ufrag, removed from this tcpPacketConn but left open.
+	Migrations chan<- connMigration
+}
+
+// connMigration is a conn moving to another ufrag after an ICE restart, with
+// the binding request that carried the new ufrag.
+type connMigration struct {
+	Conn  net.Conn
+	Ufrag string
+	Msg   *stun.Message
+
+	// Leftover holds the bytes of conn read ahead of its framing and not
+	// consumed yet.
+	Leftover []byte
+}
+
+func newTCPPacketConn(params tcpPacketParams) *tcpPacketConn {
+	if params.FrameCodec == nil {
+		params.FrameCodec = streamingPacketCodec{headerLen: streamingPacketHeaderLen}
+	}
+	if params.KeyFunc == nil {
+		params.KeyFunc = remoteAddrKey
+	}
+	if params.Ufrag != "" {
+		params.Logger = withLogFields(params.Logger, "ufrag", params.Ufrag)
+	}
+
+	p := &tcpPacketConn{
+		params: &params,
+
+		conns:         map[string]net.Conn{},
+		altConns:      map[string]net.Conn{},
+		replacedConns: map[net.Conn]struct{}{},
+		connKeys:      map[net.Conn]string{},
+		addedAt:       map[net.Conn]time.Time{},
+		writeMus:      map[net.Conn]*sync.Mutex{},
+
+		recvChan:    make(chan streamingPacket, params.ReadBuffer),
+		recvResized: make(chan struct{}),
+		closedChan:  make(chan struct{}),
+	}
+
+	p.readBufferPool = params.ReadBufferPool
+	if p.readBufferPool == nil {
+		p.readBufferPool = newReadBufferPool()
+	}
+	p.SetReceiveMTU(params.ReceiveMTU)
+
+	return p
+}
+
+func (t *tcpPacketConn) AddConn(conn net.Conn, firstPacketData []byte) error {
+	_, err := t.addConn(conn, firstPacketData, nil)
+	return err
+}
+
+// AddConnWithLeftover is like AddConn for a conn that was read past its first
+// packet: leftover holds the bytes read beyond it, which are read as the
+// start of the stream, before reading from conn.
+func (t *tcpPacketConn) AddConnWithLeftover(conn net.Conn, firstPacketData, leftover []byte) error {
+	_, err := t.addConn(conn, firstPacketData, leftover)
+	return err
+}
+
+// addConn registers conn and starts reading from it, leftover first. It
+// returns the conn as stored in conns, which may wrap the given conn.
+func (t *tcpPacketConn) addConn(conn net.Conn, firstPacketData, leftover []byte) (net.Conn, error) {
+	log := t.connLogger(conn.RemoteAddr())
+	log.Infof("event=added: %s connection", conn.RemoteAddr().Network())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// The closed check must happen under t.mu: Close closes closedChan and
+	// drains conns while holding the same lock, so a conn is either rejected
+	// here or inserted before Close runs and then closed by it.
+	if t.isClosed() {
+		return nil, io.ErrClosedPipe
+	}
+
+	key := t.connKey(conn)
+	conns := t.conns
+	if existing, ok := t.conns[key]; ok {
+		switch t.params.DuplicatePolicy {
+		case DuplicateConnPreferNew:
+			log.Infof("event=replaced: previous connection to %s", existing.LocalAddr())
+			t.replacedConns[existing] = struct{}{}
+			t.unregister(key, existing)
+			t.params.Stats.addClose(closeReasonReplaced)
+
+			// The mux adds conns while holding its own lock, so the
+			// replaced conn is closed in the background rather than
+			// making the conns of every ufrag wait for its queued packets
+			// to be written.
+			t.wg.Add(1)
+			go func() {
+				defer t.wg.Done()
+				t.closeAndLogError(existing)
+			}()
+		case DuplicateConnKeepBoth:
+			if _, ok := t.altConns[key]; ok || existing.LocalAddr().String() == conn.LocalAddr().String() {
+				return nil, fmt.Errorf("%w: %s", errConnectionAddrAlreadyExist, key)
+			}
+			conns = t.altConns
+		default:
+			return nil, fmt.Errorf("%w: %s", errConnectionAddrAlreadyExist, key)
+		}
+	}
+
+	pooled, isPooled := conn.(*pooledConn)
+	raddr := t.remoteAddr(conn, key)
+	if t.params.WriteBuffer > 0 {
+		var onNearFull func(queued, limit int)
+		if t.params.OnWriteBufferNearFull != nil {
+			onNearFull = func(queued, limit int) {
+				t.params.OnWriteBufferNearFull(raddr, queued, limit)
+			}
+		}
+		conn = newBufferedConn(conn, bufferedConnParams{
+			Size:          t.params.WriteBuffer,
+			WriteTimeout:  t.params.WriteTimeout,
+			BatchBytes:    t.params.WriteBatchBytes,
+			LowWatermark:  t.params.WriteBufferLowWatermark,
+			BlockWhenFull: t.params.WriteBufferBlocking,
+			NearFull:      t.params.WriteBufferNearFull,
+			OnNearFull:    onNearFull,
+		}, log)
+	}
+	conns[key] = conn
+	t.connKeys[conn] = key
+	t.addedAt[conn] = time.Now()
+	t.writeMus[conn] = &sync.Mutex{}
+	t.params.Stats.addLiveConns(1)
+
+	t.connChanged(raddr, true)
+
+	// Shared conns are read by their pool, through the same read path.
+	if isPooled {
+		reader := t.newConnReader(conn, raddr, nil)
+		stored := conn
+		pooled.attach(func(src net.Conn) error {
+			_, err := t.readPacket(reader, src)
+			return err
+		}, func(err error) {
+			t.stopReading(stored, raddr, err)
+		})
+		return conn, nil
+	}
+
+	t.wg.Add(1)
+	t.params.Stats.addReaderGoroutines(1)
+	go func() {
+		defer t.wg.Done()
+		defer t.params.Stats.addReaderGoroutines(-1)
+		if firstPacketData != nil {
+			t.handleRecv(streamingPacket{firstPacketData, raddr, nil, nil})
+		}
+		t.startReading(conn, raddr, leftover)
+	}()
+
+	return conn, nil
+}
+
+// SetWriteBufferSize changes the write buffer size of the conns added from
+// now on and the limit of the write buffers of the existing ones. Packets
+// already queued above a lowered limit are kept, further writes are dropped
+// until the buffer is back under it. Existing conns without a write buffer
+// stay unbuffered, and a size of 0 only applies to conns added afterwards.
+func (t *tcpPacketConn) SetWriteBufferSize(size int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.params.WriteBuffer = size
+
+	if size <= 0 {
+		return
+	}
+	for _, conns := range []map[string]net.Conn{t.conns, t.altConns} {
+		for _, conn := range conns {
+			if bc, ok := conn.(*bufferedConn); ok {
+				bc.setLimitSize(size)
+			}
+		}
+	}
+}
+
+// SetReadBufferSize changes the number of received packets that can be
+// queued for ReadFrom before the conns stop being read. The queued packets
+// are kept: if there are more than size, the queue is sized to hold them.
+func (t *tcpPacketConn) SetReadBufferSize(size int) {
+	t.resizeMu.Lock()
+	defer t.resizeMu.Unlock()
+
+	if t.isClosed() {
+		return
+	}
+
+	// Wake up the senders blocked on a full queue, they then wait on recvMu
+	// and retry with the new queue.
+	close(t.recvResized)
+
+	t.recvMu.Lock()
+	defer t.recvMu.Unlock()
+
+	t.recvResized = make(chan struct{})
+	t.params.ReadBuffer = size
+
+	// Close may have run while waiting for recvMu, in which case the queue is
+	// closed.
+	if t.isClosed() {
+		return
+	}
+
+	// Readers may take packets concurrently, so the queue only shrinks while
+	// they are moved.
+	oldChan := t.recvChan
+	if n := len(oldChan); n > size {
+		size = n
+	}
+	t.recvChan = make(chan streamingPacket, size)
+
+	for moved := false; !moved; {
+		select {
+		case pkt := <-oldChan:
+			t.recvChan <- pkt
+		default:
+			moved = true
+		}
+	}
+
+	// Readers blocked on the old queue move on to the new one.
+	close(oldChan)
+}
+
+// dial actively connects to raddr using the network of this conn's address
+// family and adds the new conn. If a conn to raddr was added concurrently,
+// the dialed conn is dropped and the existing one is returned. With a
+// ConnPool, the conn to raddr of another tcpPacketConn is reused if any.
+// The dial is bounded by deadline unless it is zero, past which it fails with
+// a timeout net.Error, and by the Timeout of the Dialer.
+func (t *tcpPacketConn) dial(raddr net.Addr, deadline time.Time) (net.Conn, error) {
+	poolKey := t.params.Network + " " + raddr.String()
+	if t.params.ConnPool != nil {
+		conn, err := t.params.ConnPool.acquire(poolKey)
+		if err != nil {
+			return nil, err
+		}
+		if conn != nil {
+			return t.addDialedConn(conn, raddr)
+		}
+	}
+
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	conn, err := t.params.Dialer.DialContext(ctx, t.params.Network, raddr.String())
+	if err != nil {
+		// The error of a dial interrupted by the deadline depends on the
+		// step interrupted, it is reported as a timeout whatever it was.
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = &net.OpError{Op: "dial", Net: t.params.Network, Addr: raddr, Err: os.ErrDeadlineExceeded}
+		}
+		t.connLogger(raddr).Tracef("event=dial_error: %s %s", t.params.Network, err)
+		return nil, err
+	}
+
+	if t.params.ConnPool != nil {
+		if conn, err = t.params.ConnPool.share(poolKey, conn); err != nil {
+			return nil, err
+		}
+	}
+
+	return t.addDialedConn(conn, raddr)
+}
+
+// addDialedConn adds conn, dialed to raddr. If a conn to raddr was added
+// concurrently, conn is closed and the existing one is returned.
+func (t *tcpPacketConn) addDialedConn(conn net.Conn, raddr net.Addr) (net.Conn, error) {
+	added, err := t.addConn(conn, nil, nil)
+	if errors.Is(err, errConnectionAddrAlreadyExist) {
+		t.closeAndLogError(conn)
+
+		t.mu.Lock()
+		existing, ok := t.conns[t.key(raddr)]
+		t.mu.Unlock()
+		if ok {
+			return existing, nil
+		}
+		return nil, io.ErrClosedPipe
+	} else if err != nil {
+		t.closeAndLogError(conn)
+		return nil, err
+	}
+
+	return added, nil
+}
+
+// connReader is the state of the reading of the packets of a conn.
+type connReader struct {
+	conn  net.Conn
+	raddr net.Addr
+
+	header      []byte
+	leftover    *leftoverConn
+	reassembler *fragmentReassembler
+	limiter     *tokenBucket
+}
+
+// newConnReader returns the reader of the packets of conn, received from
+// raddr, starting with those in leftover.
+func (t *tcpPacketConn) newConnReader(conn net.Conn, raddr net.Addr, leftover []byte) *connReader {
+	r := &connReader{
+		conn:   conn,
+		raddr:  raddr,
+		header: make([]byte, streamingPacketHeaderLenExtended),
+	}
+
+	if len(leftover) > 0 {
+		r.leftover = &leftoverConn{Conn: conn, leftover: leftover}
+	}
+	if t.params.AllowFragmentation {
+		r.reassembler = &fragmentReassembler{}
+	}
+	if t.params.ReadRate > 0 {
+		rate := float64(t.params.ReadRate)
+		r.limiter = newTokenBucket(rate, rate)
+	}
+
+	return r
+}
+
+// startReading reads the packets of conn, starting with those in leftover,
+// until it fails or is closed, and queues them as received from raddr.
+func (t *tcpPacketConn) startReading(conn net.Conn, raddr net.Addr, leftover []byte) {
+	r := t.newConnReader(conn, raddr, leftover)
+
+	// src is the stream of conn, with the leftover bytes prepended.
+	var src net.Conn = conn
+	if r.leftover != nil {
+		src = r.leftover
+	}
+
+	for {
+		reading, err := t.readPacket(r, src)
+		if err != nil {
+			t.stopReading(conn, raddr, err)
+			return
+		}
+		if !reading {
+			return
+		}
+	}
+}
+
+// stopReading reports err, which stopped the reading of conn, and removes
+// conn.
+func (t *tcpPacketConn) stopReading(conn net.Conn, raddr net.Addr, err error) {
+	if !t.wasReplaced(conn) {
+		t.readFailed(conn, raddr, err)
+	}
+	t.removeConn(conn, readCloseReason(err))
+}
+
+// readPacket reads the next packet of the conn of r from src and queues it.
+// It returns the error that stopped reading src, or false if the conn was
+// removed or migrated meanwhile and mustn't be read anymore.
+func (t *tcpPacketConn) readPacket(r *connReader, src net.Conn) (bool, error) {
+	pooled, n, err := t.readFrame(src, r.header)
+	// t.params.Logger.Infof("readStreamingPacket read %d bytes", n)
+	if err != nil {
+		return false, err
+	}
+
+	t.params.Stats.addRead(n)
+
+	// With PoolReadBuffers the buffer is handed over to the reader as it
+	// is, otherwise the packet is copied and the buffer put back.
+	data := (*pooled)[:n]
+	if !t.params.PoolReadBuffers {
+		data = make([]byte, n)
+		copy(data, *pooled)
+		t.putReadBuffer(pooled)
+		pooled = nil
+	}
+
+	if t.params.Migrations != nil && t.migrate(r.conn, data, r.leftover.remaining()) {
+		if pooled != nil {
+			t.putReadBuffer(pooled)
+		}
+		return false, nil
+	}
+
+	complete := true
+	if r.reassembler != nil && isFragment(data) {
+		data, complete, err = r.reassembler.add(data)
+		if pooled != nil {
+			t.putReadBuffer(pooled)
+			pooled = nil
+		}
+		if err != nil {
+			t.connLogger(r.conn.RemoteAddr()).Warnf("event=%s: %s", closeReasonReadError, err)
+			t.handleRecv(streamingPacket{nil, r.raddr, err, nil})
+			t.removeConn(r.conn, closeReasonReadError)
+			return false, nil
+		}
+	}
+
+	// t.params.Logger.Infof("Writing read streaming packet to recvChan: %d bytes", len(data))
+	if complete {
+		t.handleRecv(streamingPacket{data, r.raddr, nil, pooled})
+	}
+
+	if r.limiter != nil && !t.throttle(r.limiter.reserve(float64(n))) {
+		t.removeConn(r.conn, closeReasonExplicit)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// leftoverConn reads the bytes of conn read ahead of its framing before
+// reading from conn.
+type leftoverConn struct {
+	net.Conn
+	leftover []byte
+}
+
+func (c *leftoverConn) Read(b []byte) (int, error) {
+	if len(c.leftover) == 0 {
+		return c.Conn.Read(b)
+	}
+
+	n := copy(b, c.leftover)
+	c.leftover = c.leftover[n:]
+	return n, nil
+}
+
+// remaining returns the leftover bytes not read yet, nil for a nil c.
+func (c *leftoverConn) remaining() []byte {
+	if c == nil || len(c.leftover) == 0 {
+		return nil
+	}
+	return c.leftover
+}
+
+// readFrame reads the next frame of conn into a buffer of the read buffer
+// pool, which is put back on error. With RFC 4571 framing the buffer is only
+// taken once the length header of the frame is read into header, so that idle
+// conns don't hold one.
+func (t *tcpPacketConn) readFrame(conn net.Conn, header []byte) (pooled *[]byte, n int, err error) {
+	codec, ok := t.params.FrameCodec.(streamingPacketCodec)
+	if !ok {
+		mtu := t.ReceiveMTU()
+		pooled = t.getReadBuffer(mtu)
+		if n, err = t.params.FrameCodec.ReadFrame(conn, (*pooled)[:mtu]); err != nil {
+			t.putReadBuffer(pooled)
+			return nil, n, err
+		}
+		return pooled, n, nil
+	}
+
+	length, err := readStreamingPacketHeader(conn, header[:codec.headerLen])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if length > t.ReceiveMTU() {
+		return nil, length, io.ErrShortBuffer
+	}
+
+	pooled = t.getReadBuffer(length)
+	if n, err = readStreamingPacketPayload(conn, (*pooled)[:length]); err != nil {
+		t.putReadBuffer(pooled)
+		return nil, n, err
+	}
+	return pooled, n, nil
+}
+
+// getReadBuffer returns a buffer of at least size bytes, from the read buffer
+// pool unless size is over receiveMTU.
+func (t *tcpPacketConn) getReadBuffer(size int) *[]byte {
+	if size > receiveMTU {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return t.readBufferPool.Get().(*[]byte) //nolint:forcetypeassert
+}
+
+// putReadBuffer returns a buffer from getReadBuffer to the pool, dropping
+// those that didn't come from it.
+func (t *tcpPacketConn) putReadBuffer(pooled *[]byte) {
+	if cap(*pooled) == receiveMTU {
+		t.readBufferPool.Put(pooled)
+	}
+}
+
+// ReceiveMTU returns the size of the largest packet read from the conns.
+func (t *tcpPacketConn) ReceiveMTU() int {
+	return int(atomic.LoadInt64(&t.receiveMTU))
+}
+
+// SetReceiveMTU changes the size of the largest packet read from the conns,
+// a conn receiving a larger one is closed. It applies from the next packet
+// read, 0 resets it to the default of receiveMTU.
+func (t *tcpPacketConn) SetReceiveMTU(size int) {
+	if size <= 0 {
+		size = receiveMTU
+	}
+	atomic.StoreInt64(&t.receiveMTU, int64(size))
+}
+
+// newReadBufferPool returns a pool of receiveMTU sized read buffers.
+func newReadBufferPool() *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, receiveMTU)
+			return &buf
+		},
+	}
+}
+
+// readFailed reports the error that stopped the reader of conn, which is
+// io.EOF if the remote closed it cleanly, to ReadFrom and OnConnClose.
+func (t *tcpPacketConn) readFailed(conn net.Conn, raddr net.Addr, err error) {
+	log := t.connLogger(conn.RemoteAddr())
+	closeErr := err
+	switch readCloseReason(err) {
+	case closeReasonRemoteClosed:
+		log.Debugf("event=closed_by_remote")
+		closeErr = nil
+	case closeReasonExplicit:
+		log.Debugf("event=closed: %s", err)
+	default:
+		log.Warnf("event=read_error: %s", err)
+	}
+
+	t.handleRecv(streamingPacket{nil, raddr, err, nil})
+
+	if t.params.OnConnClose != nil {
+		t.params.OnConnClose(raddr, closeErr)
+	}
+}
+
+// migrate hands conn over to Migrations if data is a STUN binding request for
+// another ufrag, as sent by a remote restarting ICE over the same connection.
+// It returns false if conn stays with t. The conn is closed if t is closed
+// before the migration is picked up.
+func (t *tcpPacketConn) migrate(conn net.Conn, data, leftover []byte) bool {
+	msg, ufrag, ok := bindingRequestUfrag(data)
+	if !ok || ufrag == t.params.Ufrag {
+		return false
+	}
+
+	t.mu.Lock()
+	registered := t.unregister(t.connKeys[conn], conn)
+	t.mu.Unlock()
+	if !registered {
+		return false
+	}
+
+	t.connLogger(conn.RemoteAddr()).Infof("event=migrating: to ufrag %s", ufrag)
+
+	if bc, ok := conn.(*bufferedConn); ok {
+		if conn, ok = bc.detach(); !ok {
+			return true
+		}
+	}
+
+	// A shared conn keeps its packets for it until the new ufrag attaches.
+	if pooled, ok := conn.(*pooledConn); ok {
+		pooled.attach(nil, nil)
+	}
+
+	select {
+	case t.params.Migrations <- connMigration{conn, ufrag, msg, leftover}:
+	case <-t.closedChan:
+		t.closeAndLogError(conn)
+	}
+
+	return true
+}
+
+// bindingRequestUfrag decodes data and returns it with its local ufrag if it
+// is a STUN binding request with a USERNAME.
+func bindingRequestUfrag(data []byte) (*stun.Message, string, bool) {
+	if !stun.IsMessage(data) {
+		return nil, "", false
+	}
+
+	msg := &stun.Message{Raw: make([]byte, len(data))}
+	copy(msg.Raw, data)
+	if err := msg.Decode(); err != nil || msg.Type != stun.BindingRequest {
+		return nil, "", false
+	}
+
+	attr, err := msg.Get(stun.AttrUsername)
+	if err != nil {
+		return nil, "", false
+	}
+
+	return msg, strings.SplitN(string(attr), ":", 2)[0], true
+}
+
+// throttle pauses reading for wait, leaving the data in the socket so that
+// the sender is slowed down. It returns false if t was closed meanwhile.
+func (t *tcpPacketConn) throttle(wait time.Duration) bool {
+	if wait <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-t.closedChan:
+		return false
+	}
+}
+
+// handleRecv queues pkt for ReadFrom, blocking while the queue is full so
+// that the conn stops being read. It holds no lock but the read lock of
+// recvMu, which keeps the queue from being closed under it and which
+// SetReadBufferSize and Close make it release before taking the write lock,
+// so a ufrag that isn't read only stalls its own readers.
+func (t *tcpPacketConn) handleRecv(pkt streamingPacket) {
+	for {
+		t.recvMu.RLock()
+
+		recvChan := t.recvChan
+		if t.isClosed() {
+			recvChan = nil
+		}
+
+		select {
+		case recvChan <- pkt:
+			t.recvMu.RUnlock()
+			return
+		case <-t.closedChan:
+			t.recvMu.RUnlock()
+			return
+		case <-t.recvResized:
+			t.recvMu.RUnlock()
+		}
+	}
 }
 
-func newBufferedConn(conn net.Conn, bufferSize int, logger logging.LeveledLogger) net.Conn {
-	buffer := packetio.NewBuffer()
-	if bufferSize > 0 {
-		buffer.SetLimitSize(bufferSize)
+// recv takes the next packet from the receive queue, following it when it is
+// replaced by SetReadBufferSize. Unless wait is set, it returns
+// errRecvQueueEmpty instead of blocking.
+func (t *tcpPacketConn) recv(ctx context.Context, wait bool) (streamingPacket, error) {
+	for {
+		t.recvMu.RLock()
+		recvChan := t.recvChan
+		t.recvMu.RUnlock()
+
+		var (
+			pkt streamingPacket
+			ok  bool
+		)
+		if wait {
+			select {
+			case pkt, ok = <-recvChan:
+			case <-ctx.Done():
+				return pkt, ctx.Err()
+			}
+		} else {
+			select {
+			case pkt, ok = <-recvChan:
+			default:
+				return pkt, errRecvQueueEmpty
+			}
+		}
+
+		if ok {
+			return pkt, nil
+		}
+
+		t.recvMu.RLock()
+		resized := t.recvChan != recvChan
+		t.recvMu.RUnlock()
+
+		if !resized {
+			return pkt, io.ErrClosedPipe
+		}
 	}
+}
 
-	bc := &bufferedConn{
-		Conn:   conn,
-		buffer: buffer,
-		logger: logger,
+func (t *tcpPacketConn) isClosed() bool {
+	select {
+	case <-t.closedChan:
+		return true
+	default:
+		return false
 	}
+}
 
-	go bc.writeProcess()
-	return bc
+// ReadFrom reads the next packet received from any conn. ReadFrom,
+// ReadFromContext and ReadBatch may be called from several goroutines at
+// once: each packet is delivered to exactly one of the callers, but the order
+// in which concurrent callers get consecutive packets is unspecified, so a
+// caller relying on packet order must read from a single goroutine. raddr is
+// the remote address of the conn the packet was read from, with the "tcp"
+// network like LocalAddr.
+func (t *tcpPacketConn) ReadFrom(b []byte) (n int, raddr net.Addr, err error) {
+	return t.ReadFromContext(context.Background(), b)
 }
 
-func (bc *bufferedConn) Write(b []byte) (int, error) {
-	n, err := bc.buffer.Write(b)
+// ReadFromContext is like ReadFrom but also returns once ctx is done, with
+// ctx.Err() as is. Cancelling a read leaves t usable.
+func (t *tcpPacketConn) ReadFromContext(ctx context.Context, b []byte) (n int, raddr net.Addr, err error) {
+	pkt, err := t.recv(ctx, true)
 	if err != nil {
-		return n, err
+		// A done ctx isn't a failure of t.
+		if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+			return 0, nil, err
+		}
+		return 0, nil, t.readError(nil, err)
+	}
+
+	n, err = copyPacket(b, pkt)
+	t.releasePacket(pkt)
+	if err != nil {
+		err = t.readError(pkt.RAddr, err)
+	}
+	return n, pkt.RAddr, err
+}
+
+// readError wraps an error returned by ReadFrom or ReadBatch in a
+// *net.OpError, unless it already is one, like the read errors of a
+// net.TCPConn.
+func (t *tcpPacketConn) readError(raddr net.Addr, err error) error {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return err
+	}
+
+	return &net.OpError{Op: "read", Net: "tcp", Source: t.LocalAddr(), Addr: raddr, Err: err}
+}
+
+// releasePacket returns the pooled buffer of pkt, which must not be used
+// afterwards.
+func (t *tcpPacketConn) releasePacket(pkt streamingPacket) {
+	if pkt.pooled != nil {
+		t.putReadBuffer(pkt.pooled)
+	}
+}
+
+// copyPacket copies the data of pkt to b and returns its length, or the
+// error carried by pkt.
+func copyPacket(b []byte, pkt streamingPacket) (int, error) {
+	if pkt.Err != nil {
+		return 0, pkt.Err
+	}
+
+	if cap(b) < len(pkt.Data) {
+		return 0, io.ErrShortBuffer
 	}
+
+	n := len(pkt.Data)
+	copy(b[:n], pkt.Data)
 	return n, nil
 }
 
-func (bc *bufferedConn) writeProcess() {
-	pktBuf := make([]byte, receiveMTU)
-	for atomic.LoadInt32(&bc.closed) == 0 {
-		n, err := bc.buffer.Read(pktBuf)
-		if errors.Is(err, io.EOF) {
-			return
+// ReadBatch reads up to len(bufs) packets. It blocks until the first packet
+// is available and then only takes the packets that are already queued.
+// Each bufs[i] is resliced to the length of the packet stored in it and
+// addrs[i] is set to its remote address. It returns the number of packets
+// read; if an error is returned, it applies to packet n, which is lost, and
+// the first n slots are still valid.
+func (t *tcpPacketConn) ReadBatch(bufs [][]byte, addrs []net.Addr) (n int, err error) {
+	if len(addrs) < len(bufs) {
+		bufs = bufs[:len(addrs)]
+	}
+
+	for n < len(bufs) {
+		pkt, err := t.recv(context.Background(), n == 0)
+		if errors.Is(err, errRecvQueueEmpty) {
+			return n, nil
+		} else if err != nil {
+			return n, t.readError(nil, err)
 		}
 
+		addrs[n] = pkt.RAddr
+		size, err := copyPacket(bufs[n], pkt)
+		t.releasePacket(pkt)
 		if err != nil {
-			bc.logger.Warnf("read buffer error: %s", err)
-			continue
+			return n, t.readError(pkt.RAddr, err)
 		}
 
-		if _, err := bc.Conn.Write(pktBuf[:n]); err != nil {
-			bc.logger.Warnf("write error: %s", err)
-			continue
-		}
+		bufs[n] = bufs[n][:size]
+		n++
 	}
+
+	return n, nil
 }
 
-func (bc *bufferedConn) Close() error {
-	atomic.StoreInt32(&bc.closed, 1)
-	_ = bc.buffer.Close()
-	return bc.Conn.Close()
+// WriteTo is for active and s-o candidates.
+func (t *tcpPacketConn) WriteTo(buf []byte, raddr net.Addr) (n int, err error) {
+	return t.writeTo(buf, raddr, time.Time{})
 }
 
-type tcpPacketConn struct {
-	params *tcpPacketParams
+// WriteToWithDeadline is like WriteTo, but this write alone is bounded by
+// deadline, before WriteTimeout if that comes first, and so is its dial if
+// raddr has no conn. A write to the socket that doesn't complete in time
+// removes its conn, as the stream is left with a partial packet. With a
+// write buffer, deadline bounds the wait for room in a full buffer instead,
+// after which it fails with ErrWriteBufferFull.
+func (t *tcpPacketConn) WriteToWithDeadline(buf []byte, raddr net.Addr, deadline time.Time) (int, error) {
+	return t.writeTo(buf, raddr, deadline)
+}
 
-	// conns is a map of net.Conns indexed by remote net.Addr.String()
-	conns map[string]net.Conn
+// writeTo writes buf to raddr, bounded by deadline unless it is zero.
+func (t *tcpPacketConn) writeTo(buf []byte, raddr net.Addr, deadline time.Time) (n int, err error) {
+	if err = t.checkBoundaries(buf); err != nil {
+		return 0, err
+	}
 
-	recvChan chan streamingPacket
+	t.mu.Lock()
+	conn, ok := t.conns[t.key(raddr)]
+	t.mu.Unlock()
 
-	mu         sync.Mutex
-	wg         sync.WaitGroup
-	closedChan chan struct{}
-	closeOnce  sync.Once
-}
+	if !ok {
+		if t.params.Dialer == nil {
+			return 0, io.ErrClosedPipe
+		}
 
-type streamingPacket struct {
-	Data  []byte
-	RAddr net.Addr
-	Err   error
-}
+		dialDeadline := deadline
+		if writeDeadline := atomic.LoadInt64(&t.writeDeadline); dialDeadline.IsZero() && writeDeadline != 0 {
+			dialDeadline = time.Unix(0, writeDeadline)
+		}
+		if conn, err = t.dial(raddr, dialDeadline); err != nil {
+			return 0, err
+		}
+	}
 
-type tcpPacketParams struct {
-	ReadBuffer  int
-	LocalAddr   net.Addr
-	Logger      logging.LeveledLogger
-	WriteBuffer int
+	if t.params.AllowFragmentation && needsFragmenting(buf) {
+		n, err = t.writeFragments(conn, buf, deadline)
+	} else {
+		n, err = t.writeWithTimeout(conn, buf, deadline)
+	}
+	t.params.Stats.addWrite(len(buf), err)
+	if err != nil {
+		t.connLogger(raddr).Tracef("event=write_error: %s", err)
+		return n, err
+	}
+
+	return n, nil
 }
 
-func newTCPPacketConn(params tcpPacketParams) *tcpPacketConn {
-	p := &tcpPacketConn{
-		params: &params,
+// lockWrites waits for the other writes to conn to complete, so that frames
+// and write deadlines don't interleave, and returns the function letting the
+// next one in. Buffered conns serialize their writes themselves, and the
+// writes to a conn removed meanwhile fail anyway, neither is locked.
+func (t *tcpPacketConn) lockWrites(conn net.Conn) (unlock func()) {
+	if _, ok := conn.(*bufferedConn); ok {
+		return func() {}
+	}
 
-		conns: map[string]net.Conn{},
+	t.mu.Lock()
+	mu, ok := t.writeMus[conn]
+	t.mu.Unlock()
 
-		recvChan:   make(chan streamingPacket, params.ReadBuffer),
-		closedChan: make(chan struct{}),
+	if !ok {
+		return func() {}
 	}
+	mu.Lock()
+	return mu.Unlock
+}
 
-	return p
+// checkBoundaries returns an error if StrictBoundaries is set and buf is a
+// packet the peer couldn't read in one piece.
+func (t *tcpPacketConn) checkBoundaries(buf []byte) error {
+	if t.params.StrictBoundaries && !t.params.AllowFragmentation && len(buf) > receiveMTU {
+		return fmt.Errorf("%w: %d bytes, over the %d bytes read by the peer", errStreamingPacketTooLarge, len(buf), receiveMTU)
+	}
+	return nil
 }
 
-func (t *tcpPacketConn) AddConn(conn net.Conn, firstPacketData []byte) error {
-	t.params.Logger.Infof("AddConn: %s %s", conn.RemoteAddr().Network(), conn.RemoteAddr())
+// writeWithTimeout writes buf framed to conn. Unless conn is buffered, the
+// write is bounded by WriteTimeout and by deadline unless it is zero,
+// whichever comes first. A timed out write may have been partial, which
+// leaves the stream unusable, so conn is then removed. If conn is buffered,
+// deadline bounds the wait for room in its buffer.
+func (t *tcpPacketConn) writeWithTimeout(conn net.Conn, buf []byte, deadline time.Time) (int, error) {
+	if bc, ok := conn.(*bufferedConn); ok {
+		if !deadline.IsZero() {
+			conn = bufferedDeadlineConn{bc, deadline}
+		}
+		return t.params.FrameCodec.WriteFrame(conn, buf)
+	}
 
-	t.mu.Lock()
-	defer t.mu.Unlock()
+	// The deadline of a write must not be reset by a concurrent one before
+	// it completes.
+	defer t.lockWrites(conn)()
 
-	select {
-	case <-t.closedChan:
-		return io.ErrClosedPipe
-	default:
+	if t.params.WriteTimeout > 0 {
+		if timeout := time.Now().Add(t.params.WriteTimeout); deadline.IsZero() || timeout.Before(deadline) {
+			deadline = timeout
+		}
+	}
+	if deadline.IsZero() {
+		return t.params.FrameCodec.WriteFrame(conn, buf)
 	}
 
-	if _, ok := t.conns[conn.RemoteAddr().String()]; ok {
-		return fmt.Errorf("%w: %s", errConnectionAddrAlreadyExist, conn.RemoteAddr().String())
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		return 0, err
 	}
 
-	if t.params.WriteBuffer > 0 {
-		conn = newBufferedConn(conn, t.params.WriteBuffer, t.params.Logger)
+	n, err := t.params.FrameCodec.WriteFrame(conn, buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.connLogger(conn.RemoteAddr()).Warnf("event=%s: removing connection", closeReasonWriteTimeout)
+		t.removeConn(conn, closeReasonWriteTimeout)
+		return n, err
 	}
-	t.conns[conn.RemoteAddr().String()] = conn
 
-	t.wg.Add(1)
-	go func() {
-		if firstPacketData != nil {
-			t.recvChan <- streamingPacket{firstPacketData, conn.RemoteAddr(), nil}
+	// Other writes to conn aren't bounded, don't let the deadline expire them.
+	if deadlineErr := conn.SetWriteDeadline(time.Time{}); deadlineErr != nil && err == nil {
+		err = deadlineErr
+	}
+
+	return n, err
+}
+
+// writeFragments writes buf to conn as fragments, each in its own frame,
+// bounded as writeWithTimeout. It returns len(buf) once all were written.
+func (t *tcpPacketConn) writeFragments(conn net.Conn, buf []byte, deadline time.Time) (int, error) {
+	frags, err := fragment(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	t.fragmentMu.Lock()
+	defer t.fragmentMu.Unlock()
+
+	for _, frag := range frags {
+		if _, err := t.writeWithTimeout(conn, frag, deadline); err != nil {
+			return 0, err
 		}
-		defer t.wg.Done()
-		t.startReading(conn)
-	}()
+	}
 
-	return nil
+	return len(buf), nil
 }
 
-func (t *tcpPacketConn) startReading(conn net.Conn) {
-	buf := make([]byte, receiveMTU)
+// WriteToAll writes buf as a packet to every connected remote, framing it
+// only once unless a custom FrameCodec is used. It returns the payload length
+// if all writes succeeded, or the first error otherwise. Remotes after a
+// failed write are still written to.
+func (t *tcpPacketConn) WriteToAll(buf []byte) (n int, err error) {
+	if err = t.checkBoundaries(buf); err != nil {
+		return 0, err
+	}
 
-	for {
-		n, err := readStreamingPacket(conn, buf)
-		// t.params.Logger.Infof("readStreamingPacket read %d bytes", n)
-		if err != nil {
-			t.params.Logger.Infof("%w: %s", errReadingStreamingPacket, err)
-			t.handleRecv(streamingPacket{nil, conn.RemoteAddr(), err})
-			t.removeConn(conn)
-			return
+	write := func(conn net.Conn) error {
+		_, err := t.params.FrameCodec.WriteFrame(conn, buf)
+		return err
+	}
+
+	if headerLen, ok := t.streamingHeaderLen(); ok {
+		if len(buf) > maxStreamingPacketLen(headerLen) {
+			return 0, fmt.Errorf("%w: %d bytes", errStreamingPacketTooLarge, len(buf))
 		}
 
-		data := make([]byte, n)
-		copy(data, buf[:n])
+		// bufferedConn copies the frame into its buffer, so it can be shared.
+		frame := make([]byte, headerLen+len(buf))
+		putStreamingPacketHeader(frame, len(buf), headerLen)
+		copy(frame[headerLen:], buf)
 
-		// t.params.Logger.Infof("Writing read streaming packet to recvChan: %d bytes", len(data))
-		t.handleRecv(streamingPacket{data, conn.RemoteAddr(), nil})
+		write = func(conn net.Conn) error {
+			return writeFull(conn, frame)
+		}
 	}
-}
 
-func (t *tcpPacketConn) handleRecv(pkt streamingPacket) {
 	t.mu.Lock()
+	conns := make([]net.Conn, 0, len(t.conns))
+	for _, conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.mu.Unlock()
 
-	recvChan := t.recvChan
-	if t.isClosed() {
-		recvChan = nil
+	if len(conns) == 0 {
+		return 0, io.ErrClosedPipe
 	}
 
-	t.mu.Unlock()
+	for _, conn := range conns {
+		unlock := t.lockWrites(conn)
+		writeErr := write(conn)
+		unlock()
+		t.params.Stats.addWrite(len(buf), writeErr)
+		if writeErr != nil {
+			t.connLogger(conn.RemoteAddr()).Tracef("event=write_error: %s", writeErr)
+			if err == nil {
+				err = writeErr
+			}
+		}
+	}
 
-	select {
-	case recvChan <- pkt:
-	case <-t.closedChan:
+	if err != nil {
+		return 0, err
 	}
+
+	return len(buf), nil
 }
 
-func (t *tcpPacketConn) isClosed() bool {
-	select {
-	case <-t.closedChan:
-		return true
-	default:
-		return false
-	}
+// Flush blocks until the packets written to raddr so far have been written
+// to its socket, or bufferedConnFlushTimeout elapses. It is a no-op if no
+// write buffer is used, as writes are then synchronous.
+func (t *tcpPacketConn) Flush(raddr net.Addr) error {
+	return t.FlushDeadline(raddr, time.Now().Add(bufferedConnFlushTimeout))
 }
 
-// WriteTo is for passive and s-o candidates.
-func (t *tcpPacketConn) ReadFrom(b []byte) (n int, raddr net.Addr, err error) {
-	pkt, ok := <-t.recvChan
+// FlushDeadline is like Flush but waits until deadline, or without a limit if
+// deadline is zero. It may be called concurrently with WriteTo, the packets
+// written to raddr after it was called aren't waited for.
+func (t *tcpPacketConn) FlushDeadline(raddr net.Addr, deadline time.Time) error {
+	t.mu.Lock()
+	conn, ok := t.conns[t.key(raddr)]
+	t.mu.Unlock()
 
 	if !ok {
-		return 0, nil, io.ErrClosedPipe
+		return io.ErrClosedPipe
 	}
 
-	if pkt.Err != nil {
-		return 0, pkt.RAddr, pkt.Err
+	if bc, ok := conn.(*bufferedConn); ok {
+		return bc.FlushDeadline(deadline)
 	}
 
-	if cap(b) < len(pkt.Data) {
-		return 0, pkt.RAddr, io.ErrShortBuffer
+	return nil
+}
+
+// Drain waits until the write buffers of all conns are flushed, or timeout
+// elapses, and then closes t. It returns errFlushTimeout if some packets were
+// still queued when the timeout elapsed.
+func (t *tcpPacketConn) Drain(timeout time.Duration) error {
+	t.mu.Lock()
+	conns := make([]net.Conn, 0, len(t.conns))
+	for _, conn := range t.conns {
+		conns = append(conns, conn)
 	}
+	t.mu.Unlock()
 
-	n = len(pkt.Data)
-	copy(b, pkt.Data[:n])
-	return n, pkt.RAddr, err
+	deadline := time.Now().Add(timeout)
+
+	var flushErr error
+	for _, conn := range conns {
+		bc, ok := conn.(*bufferedConn)
+		if !ok {
+			continue
+		}
+
+		// A conn closed meanwhile has nothing left to flush.
+		if err := bc.FlushDeadline(deadline); errors.Is(err, errFlushTimeout) && flushErr == nil {
+			flushErr = err
+		}
+	}
+
+	if err := t.Close(); err != nil {
+		return err
+	}
+
+	return flushErr
 }
 
-// WriteTo is for active and s-o candidates.
-func (t *tcpPacketConn) WriteTo(buf []byte, raddr net.Addr) (n int, err error) {
+// RelayFrom reads packets from src and writes them framed to raddr until
+// reading or writing fails, reusing a single buffer for all packets. It
+// returns the number of payload bytes written and the error that stopped the
+// relay.
+func (t *tcpPacketConn) RelayFrom(src net.PacketConn, raddr net.Addr) (written int64, err error) {
 	t.mu.Lock()
-	conn, ok := t.conns[raddr.String()]
+	conn, ok := t.conns[t.key(raddr)]
 	t.mu.Unlock()
 
 	if !ok {
 		return 0, io.ErrClosedPipe
-		// conn, err := net.DialTCP(tcp, nil, raddr.(*net.TCPAddr))
+	}
+
+	// With RFC 4571 framing, packets are read right after room for their
+	// header, which is then filled in place.
+	headerLen, inPlace := t.streamingHeaderLen()
+	buf := make([]byte, headerLen+receiveMTU)
+
+	for {
+		n, _, err := src.ReadFrom(buf[headerLen:])
+		if err != nil {
+			return written, err
+		}
 
-		// if err != nil {
-		// 	t.params.Logger.Tracef("DialTCP error: %s", err)
-		// 	return 0, err
-		// }
+		unlock := t.lockWrites(conn)
+		if inPlace {
+			putStreamingPacketHeader(buf, n, headerLen)
+			err = writeFull(conn, buf[:headerLen+n])
+		} else {
+			_, err = t.params.FrameCodec.WriteFrame(conn, buf[:n])
+		}
+		unlock()
+		t.params.Stats.addWrite(n, err)
+		if err != nil {
+			t.connLogger(raddr).Tracef("event=write_error: %s", err)
+			return written, err
+		}
 
-		// go t.startReading(conn)
-		// t.conns[raddr.String()] = conn
+		written += int64(n)
 	}
+}
 
-	n, err = writeStreamingPacket(conn, buf)
-	if err != nil {
-		t.params.Logger.Tracef("%w %s", errWriting, raddr)
-		return n, err
+// streamingHeaderLen returns the length header size of the RFC 4571 framing,
+// and false if a custom FrameCodec is used, in which case packets can't be
+// framed in place.
+func (t *tcpPacketConn) streamingHeaderLen() (int, bool) {
+	codec, ok := t.params.FrameCodec.(streamingPacketCodec)
+	return codec.headerLen, ok
+}
+
+// key returns the key of the conn to raddr in conns.
+func (t *tcpPacketConn) key(raddr net.Addr) string {
+	if addr, ok := raddr.(*keyedAddr); ok {
+		return addr.key
+	}
+	return t.params.KeyFunc(raddr)
+}
+
+// remoteAddrKey is the default KeyFunc. It is the address without the zone of
+// IPv6 link-local addresses, so that the addresses of remote candidates, which
+// have no zone, match the conns accepted from them.
+func remoteAddrKey(raddr net.Addr) string {
+	if addr, ok := raddr.(*net.TCPAddr); ok && addr.Zone != "" {
+		return (&net.TCPAddr{IP: addr.IP, Port: addr.Port}).String()
 	}
+	return raddr.String()
+}
 
-	return n, err
+// connKey returns the key conn is stored under in conns.
+func (t *tcpPacketConn) connKey(conn net.Conn) string {
+	if t.params.ConnKey != nil {
+		return t.params.ConnKey(conn)
+	}
+	return t.key(conn.RemoteAddr())
+}
+
+// remoteAddr returns the address the packets of conn, stored under key, are
+// received from. Its network is always "tcp", see tcpNetAddr.
+func (t *tcpPacketConn) remoteAddr(conn net.Conn, key string) net.Addr {
+	if t.params.ConnKey != nil {
+		return &keyedAddr{Addr: newTCPNetAddr(conn.RemoteAddr()), key: key}
+	}
+	return newTCPNetAddr(conn.RemoteAddr())
+}
+
+// keyedAddr is the remote address of a conn keyed by ConnKey, which may not
+// identify the conn by itself.
+type keyedAddr struct {
+	net.Addr
+	key string
+}
+
+// tcpNetAddr is an address of a conn that isn't a TCP connection, such as a
+// Unix socket or a tunnel, reported with the "tcp" network so that the
+// candidates built from the addresses of a tcpPacketConn are TCP candidates.
+// String is still that of the underlying address.
+type tcpNetAddr struct {
+	net.Addr
+}
+
+func (tcpNetAddr) Network() string {
+	return "tcp"
+}
+
+// newTCPNetAddr returns addr if its network is "tcp", as for *net.TCPAddr,
+// and addr wrapped in a tcpNetAddr otherwise.
+func newTCPNetAddr(addr net.Addr) net.Addr {
+	if addr == nil || addr.Network() == "tcp" {
+		return addr
+	}
+	return tcpNetAddr{Addr: addr}
+}
+
+// connLogger returns the logger for the messages about the conn to raddr.
+func (t *tcpPacketConn) connLogger(raddr net.Addr) logging.LeveledLogger {
+	return withLogFields(t.params.Logger, "remote", raddr.String())
 }
 
 func (t *tcpPacketConn) closeAndLogError(closer io.Closer) {
 	err := closer.Close()
 	if err != nil {
-		t.params.Logger.Warnf("%w: %s", errClosingConnection, err)
+		t.params.Logger.Warnf("%v: %v", errClosingConnection, err)
+	}
+}
+
+// closeConcurrently closes all of closers at once, so that closing several
+// buffered conns waiting for their queued packets takes no longer than
+// closing one, and returns the errors of those that failed.
+func closeConcurrently(closers []io.Closer) []error {
+	results := make([]error, len(closers))
+
+	var wg sync.WaitGroup
+	for i, closer := range closers {
+		wg.Add(1)
+		go func(i int, closer io.Closer) {
+			defer wg.Done()
+			results[i] = closer.Close()
+		}(i, closer)
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+		}
 	}
+	return errs
 }
 
-func (t *tcpPacketConn) removeConn(conn net.Conn) {
+// removeConn closes and removes conn, counting it as closed for reason. It is
+// a no-op if conn isn't registered anymore, either because it was already
+// removed or because a new conn from the same remote address replaced it.
+func (t *tcpPacketConn) removeConn(conn net.Conn, reason closeReason) {
 	t.mu.Lock()
-	defer t.mu.Unlock()
+	removed := t.unregister(t.connKeys[conn], conn)
+	t.mu.Unlock()
+
+	// Closing a buffered conn waits for its queued packets to be written,
+	// which must not hold up the other users of mu.
+	if removed {
+		t.params.Stats.addClose(reason)
+		t.connLogger(conn.RemoteAddr()).Debugf("event=removed: %s", reason)
+		t.closeAndLogError(conn)
+	}
+}
+
+// unregister removes conn from the conns of key, without closing it, and
+// returns false if it wasn't registered. The other conn of the remote, if
+// any, takes over. Must be called with mu held.
+func (t *tcpPacketConn) unregister(key string, conn net.Conn) bool {
+	switch {
+	case t.conns[key] == conn:
+		if alt, ok := t.altConns[key]; ok {
+			t.conns[key] = alt
+			delete(t.altConns, key)
+		} else {
+			delete(t.conns, key)
+		}
+	case t.altConns[key] == conn:
+		delete(t.altConns, key)
+	default:
+		return false
+	}
+
+	delete(t.connKeys, conn)
+	delete(t.addedAt, conn)
+	delete(t.writeMus, conn)
+	t.params.Stats.addLiveConns(-1)
+	t.connChanged(t.remoteAddr(conn, key), false)
+	return true
+}
+
+// connChanged reports a registered or unregistered conn to OnConnChange.
+func (t *tcpPacketConn) connChanged(raddr net.Addr, added bool) {
+	if t.params.OnConnChange != nil {
+		t.params.OnConnChange(raddr, added)
+	}
+}
 
-	t.closeAndLogError(conn)
+// wasReplaced returns whether conn was closed by DuplicateConnPreferNew and
+// forgets it.
+func (t *tcpPacketConn) wasReplaced(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	delete(t.conns, conn.RemoteAddr().String())
+	_, ok := t.replacedConns[conn]
+	delete(t.replacedConns, conn)
+	return ok
 }
 
+// Close closes all conns and waits for their readers to exit. It returns the
+// errors from closing the conns joined together, or nil if all closed
+// cleanly. The conns are closed concurrently, so Close waits at most
+// bufferedConnCloseTimeout for the packets queued in their write buffers.
 func (t *tcpPacketConn) Close() error {
 	t.mu.Lock()
 
@@ -263,35 +2059,66 @@ func (t *tcpPacketConn) Close() error {
 		shouldCloseRecvChan = true
 	})
 
-	for _, conn := range t.conns {
-		t.closeAndLogError(conn)
-		delete(t.conns, conn.RemoteAddr().String())
+	// The conns are closed after releasing mu, as closing a buffered conn
+	// waits for its queued packets to be written.
+	var closers []io.Closer
+	for _, conns := range []map[string]net.Conn{t.conns, t.altConns} {
+		for key, conn := range conns {
+			closers = append(closers, conn)
+			delete(conns, key)
+			delete(t.connKeys, conn)
+			delete(t.addedAt, conn)
+			delete(t.writeMus, conn)
+			t.params.Stats.addLiveConns(-1)
+			t.params.Stats.addClose(closeReasonExplicit)
+			t.connChanged(t.remoteAddr(conn, key), false)
+		}
 	}
 
 	t.mu.Unlock()
 
+	errs := closeConcurrently(closers)
+	for i, err := range errs {
+		errs[i] = wrapError(errClosingConnection, err)
+		t.params.Logger.Warnf("%v", errs[i])
+	}
+
 	t.wg.Wait()
 
 	if shouldCloseRecvChan {
+		t.recvMu.Lock()
 		close(t.recvChan)
+		t.recvMu.Unlock()
 	}
 
-	return nil
+	return joinErrors(errs...)
 }
 
+// LocalAddr returns the address of the listener, or of the conn for a
+// tcpPacketConn created by a dialed conn. Its network is "tcp" whatever the
+// transport, and it is a *net.TCPAddr for TCP listeners and conns.
 func (t *tcpPacketConn) LocalAddr() net.Addr {
-	return t.params.LocalAddr
+	return newTCPNetAddr(t.params.LocalAddr)
 }
 
+// SetDeadline sets the write deadline, read deadlines aren't supported.
 func (t *tcpPacketConn) SetDeadline(tm time.Time) error {
-	return nil
+	return t.SetWriteDeadline(tm)
 }
 
 func (t *tcpPacketConn) SetReadDeadline(tm time.Time) error {
 	return nil
 }
 
+// SetWriteDeadline bounds the dials of WriteTo to remotes without a conn, a
+// zero tm removes the deadline. The writes to existing conns are bounded by
+// WriteTimeout instead.
 func (t *tcpPacketConn) SetWriteDeadline(tm time.Time) error {
+	var deadline int64
+	if !tm.IsZero() {
+		deadline = tm.UnixNano()
+	}
+	atomic.StoreInt64(&t.writeDeadline, deadline)
 	return nil
 }
 
@@ -300,5 +2127,5 @@ func (t *tcpPacketConn) CloseChannel() <-chan struct{} {
 }
 
 func (t *tcpPacketConn) String() string {
-	return fmt.Sprintf("tcpPacketConn{LocalAddr: %s}", t.params.LocalAddr)
+	return fmt.Sprintf("tcpPacketConn{Ufrag: %s, LocalAddr: %s}", t.params.Ufrag, t.params.LocalAddr)
 }
@@ -0,0 +1,77 @@
+//go:build go1.18
+// +build go1.18
+
+package ice
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/pion/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func FuzzTCPPacketConn_StrictBoundaries(f *testing.F) {
+	f.Add([]byte{0, 1, 0, 5, 0x20, 0x00, 0x20, 0x01, 0xff, 0xff})
+	f.Add([]byte{0x01, 0x00, 0x00, 0x00, 0x1f, 0xff})
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	loggerFactory.DefaultLogLevel = logging.LogLevelError
+
+	f.Fuzz(func(t *testing.T, sizes []byte) {
+		writer := newTCPPacketConn(tcpPacketParams{
+			ReadBuffer:       20,
+			Logger:           loggerFactory.NewLogger("ice"),
+			StrictBoundaries: true,
+		})
+		reader := newTCPPacketConn(tcpPacketParams{
+			ReadBuffer: 20,
+			Logger:     loggerFactory.NewLogger("ice"),
+		})
+		defer func() {
+			assert.NoError(t, writer.Close())
+			assert.NoError(t, reader.Close())
+		}()
+
+		local, remote := net.Pipe()
+		assert.NoError(t, writer.AddConn(local, nil))
+		assert.NoError(t, reader.AddConn(remote, nil))
+
+		// Each pair of bytes is the size of a packet, whose bytes identify it.
+		var pkts [][]byte
+		for i := 0; i+1 < len(sizes) && len(pkts) < 32; i += 2 {
+			pkt := make([]byte, int(binary.BigEndian.Uint16(sizes[i:])))
+			for j := range pkt {
+				pkt[j] = byte(len(pkts) + j)
+			}
+			pkts = append(pkts, pkt)
+		}
+
+		written := make(chan []byte, len(pkts))
+		go func() {
+			defer close(written)
+			for _, pkt := range pkts {
+				_, err := writer.WriteTo(pkt, local.RemoteAddr())
+				if len(pkt) > receiveMTU {
+					assert.ErrorIs(t, err, errStreamingPacketTooLarge)
+					continue
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				written <- pkt
+			}
+		}()
+
+		// Every packet written is read whole, as a single packet.
+		buf := make([]byte, receiveMTU)
+		for pkt := range written {
+			n, _, err := reader.ReadFrom(buf)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, pkt, buf[:n])
+		}
+	})
+}
@@ -0,0 +1,2249 @@
+package ice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/ice/v2/icetest"
+	"github.com/pion/logging"
+	"github.com/pion/transport/packetio"
+	"github.com/pion/transport/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPPacketConn_AddConnRacingClose(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	for i := 0; i < 50; i++ {
+		packetConn := newTCPPacketConn(tcpPacketParams{
+			ReadBuffer: 20,
+			Logger:     loggerFactory.NewLogger("ice"),
+		})
+
+		const numConns = 10
+		var (
+			wg    sync.WaitGroup
+			mu    sync.Mutex
+			peers []net.Conn
+		)
+
+		for j := 0; j < numConns; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				local, remote := net.Pipe()
+				if err := packetConn.AddConn(local, nil); err != nil {
+					assert.ErrorIs(t, err, io.ErrClosedPipe)
+					_ = local.Close()
+				}
+
+				mu.Lock()
+				peers = append(peers, remote)
+				mu.Unlock()
+			}()
+		}
+
+		assert.NoError(t, packetConn.Close())
+		wg.Wait()
+
+		// Every conn must have been closed, either by Close or because AddConn rejected it.
+		for _, peer := range peers {
+			// SetReadDeadline fails once the other end is closed, which is what we expect.
+			_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+			_, err := peer.Read(make([]byte, 1))
+			assert.ErrorIs(t, err, io.EOF)
+			_ = peer.Close()
+		}
+	}
+}
+
+func TestBufferedConn_CloseFlushesQueuedWrites(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	local, remote := net.Pipe()
+	conn := newBufferedConn(local, bufferedConnParams{Size: 4096}, loggerFactory.NewLogger("ice"))
+
+	const numPackets = 10
+	for i := 0; i < numPackets; i++ {
+		_, err := conn.Write([]byte{byte(i)})
+		assert.NoError(t, err)
+	}
+
+	received := make(chan []byte, numPackets)
+	go func() {
+		defer close(received)
+		for {
+			buf := make([]byte, 1)
+			if _, err := remote.Read(buf); err != nil {
+				return
+			}
+			received <- buf
+		}
+	}()
+
+	assert.NoError(t, conn.Close())
+
+	var i int
+	for buf := range received {
+		assert.Equal(t, []byte{byte(i)}, buf)
+		i++
+	}
+	assert.Equal(t, numPackets, i)
+}
+
+func TestBufferedConn_CloseStalledPeer(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	conn := newBufferedConn(local, bufferedConnParams{Size: 4096}, loggerFactory.NewLogger("ice"))
+
+	_, err := conn.Write([]byte("never read"))
+	assert.NoError(t, err)
+
+	start := time.Now()
+	assert.NoError(t, conn.Close())
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(bufferedConnCloseTimeout))
+}
+
+func TestTCPPacketConn_CloseStalledConns(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer:  20,
+		WriteBuffer: 4096,
+		Logger:      logging.NewDefaultLoggerFactory().NewLogger("ice"),
+	})
+
+	// The peers never read, closing each conn waits for its packet.
+	for i := 0; i < 3; i++ {
+		local, remote := net.Pipe()
+		defer func() {
+			_ = remote.Close()
+		}()
+		raddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000 + i}
+		assert.NoError(t, packetConn.AddConn(&addrConn{Conn: local, remote: raddr}, nil))
+
+		_, err := packetConn.WriteTo([]byte("never read"), raddr)
+		assert.NoError(t, err)
+	}
+
+	start := time.Now()
+	closed := make(chan error)
+	go func() {
+		closed <- packetConn.Close()
+	}()
+
+	// The conns are closed without holding mu.
+	assert.Eventually(t, func() bool {
+		return len(packetConn.RemoteAddrs()) == 0
+	}, bufferedConnCloseTimeout/2, time.Millisecond)
+
+	assert.NoError(t, <-closed)
+	assert.Less(t, time.Since(start), 2*bufferedConnCloseTimeout)
+}
+
+// countingConn counts the writes to the wrapped conn.
+type countingConn struct {
+	net.Conn
+	writes int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestBufferedConn_WriteBatch(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	local, remote := net.Pipe()
+	counting := &countingConn{Conn: local}
+	conn := newBufferedConn(counting, bufferedConnParams{Size: 4096, BatchBytes: 1024}, loggerFactory.NewLogger("ice"))
+
+	// The pipe blocks the first write until it is read, meanwhile the other
+	// packets pile up in the buffer.
+	const numPackets = 10
+	for i := 0; i < numPackets; i++ {
+		_, err := writeStreamingPacket(conn, []byte{byte(i)}, streamingPacketHeaderLen)
+		assert.NoError(t, err)
+	}
+
+	buf := make([]byte, receiveMTU)
+	for i := 0; i < numPackets; i++ {
+		n, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{byte(i)}, buf[:n])
+	}
+
+	assert.Less(t, atomic.LoadInt64(&counting.writes), int64(numPackets))
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, remote.Close())
+}
+
+func TestBufferedConn_LargeFrames(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	local, remote := net.Pipe()
+	conn := newBufferedConn(local, bufferedConnParams{Size: 1024 * 1024, BatchBytes: 1024}, loggerFactory.NewLogger("ice"))
+
+	// Frames larger than receiveMTU are written whole, alone or batched.
+	sizes := []int{receiveMTU + 1, 10, maxBufferedFrameLen - streamingPacketHeaderLenExtended, 3 * receiveMTU}
+	for i, size := range sizes {
+		_, err := writeStreamingPacket(conn, bytes.Repeat([]byte{byte(i)}, size), streamingPacketHeaderLenExtended)
+		require.NoError(t, err)
+	}
+
+	buf := make([]byte, maxBufferedFrameLen)
+	for i, size := range sizes {
+		n, err := readStreamingPacket(remote, buf, streamingPacketHeaderLenExtended)
+		require.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, size), buf[:n])
+	}
+
+	// Larger frames don't fit in the buffer whatever its size.
+	_, err := writeStreamingPacket(conn, make([]byte, maxBufferedFrameLen), streamingPacketHeaderLenExtended)
+	assert.ErrorIs(t, err, errStreamingPacketTooLarge)
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, remote.Close())
+}
+
+func BenchmarkBufferedConn_Write(b *testing.B) {
+	for name, batchBytes := range map[string]int{
+		"unbatched": 0,
+		"batched":   16 * 1024,
+	} {
+		batchBytes := batchBytes
+		b.Run(name, func(b *testing.B) {
+			loggerFactory := logging.NewDefaultLoggerFactory()
+
+			local, remote := net.Pipe()
+			go func() {
+				_, _ = io.Copy(io.Discard, remote)
+			}()
+
+			counting := &countingConn{Conn: local}
+			conn := newBufferedConn(counting, bufferedConnParams{Size: 4 * 1024 * 1024, BatchBytes: batchBytes}, loggerFactory.NewLogger("ice"))
+			defer func() {
+				_ = conn.Close()
+			}()
+
+			rtcp := make([]byte, 100)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(rtcp)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for {
+					_, err := writeStreamingPacket(conn, rtcp, streamingPacketHeaderLen)
+					if err == nil {
+						break
+					}
+					// The buffer is full, let the writer catch up.
+					runtime.Gosched()
+				}
+			}
+			if err := conn.(*bufferedConn).Flush(10 * time.Second); err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+
+			// Each write to the conn is a syscall on a real socket.
+			b.ReportMetric(float64(atomic.LoadInt64(&counting.writes))/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestTCPPacketConn_LogsUfrag(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	var logs bytes.Buffer
+	loggerFactory := &logging.DefaultLoggerFactory{
+		Writer:          &logs,
+		DefaultLogLevel: logging.LogLevelDebug,
+	}
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		Ufrag:      "myufrag",
+		ReadBuffer: 20,
+		Logger:     loggerFactory.NewLogger("ice"),
+	})
+
+	local, remote := net.Pipe()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+	assert.NoError(t, remote.Close())
+	assert.NoError(t, packetConn.Close())
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	assert.Len(t, lines, 2, "expected AddConn and remote close log lines")
+	for _, line := range lines {
+		assert.Contains(t, line, "ufrag=myufrag remote=pipe event=")
+		assert.NotContains(t, line, "%!", "malformed format verb")
+	}
+}
+
+func TestTCPPacketConn_RelayFrom(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer: 20,
+		Logger:     loggerFactory.NewLogger("ice"),
+	})
+	defer func() {
+		assert.NoError(t, packetConn.Close())
+	}()
+
+	local, remote := net.Pipe()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	src, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() {
+		_ = sender.Close()
+	}()
+
+	type relayResult struct {
+		written int64
+		err     error
+	}
+	done := make(chan relayResult)
+	go func() {
+		written, err := packetConn.RelayFrom(src, local.RemoteAddr())
+		done <- relayResult{written, err}
+	}()
+
+	packets := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	for _, pkt := range packets {
+		_, err = sender.WriteTo(pkt, src.LocalAddr())
+		assert.NoError(t, err)
+
+		buf := make([]byte, receiveMTU)
+		n, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+		assert.NoError(t, err)
+		assert.Equal(t, pkt, buf[:n])
+	}
+
+	assert.NoError(t, src.Close())
+	result := <-done
+	assert.Error(t, result.err)
+	assert.Equal(t, int64(len("first")+len("second")+len("third")), result.written)
+}
+
+func TestTCPPacketConn_ReadBatch(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer: 20,
+		Logger:     loggerFactory.NewLogger("ice"),
+	})
+	defer func() {
+		assert.NoError(t, packetConn.Close())
+	}()
+
+	local, remote := net.Pipe()
+	assert.NoError(t, packetConn.AddConn(local, []byte("first")))
+
+	for _, pkt := range []string{"second", "third"} {
+		_, err := writeStreamingPacket(remote, []byte(pkt), streamingPacketHeaderLen)
+		assert.NoError(t, err)
+	}
+
+	// Wait until everything is queued so the batch is deterministic.
+	assert.Eventually(t, func() bool {
+		return len(packetConn.recvChan) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	bufs := make([][]byte, 4)
+	for i := range bufs {
+		bufs[i] = make([]byte, receiveMTU)
+	}
+	addrs := make([]net.Addr, len(bufs))
+
+	n, err := packetConn.ReadBatch(bufs, addrs)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []byte("first"), bufs[0])
+	assert.Equal(t, []byte("second"), bufs[1])
+	assert.Equal(t, []byte("third"), bufs[2])
+	for _, addr := range addrs[:n] {
+		assert.Equal(t, local.RemoteAddr().String(), addr.String())
+	}
+
+	t.Run("short buffer", func(t *testing.T) {
+		_, err := writeStreamingPacket(remote, []byte("too long"), streamingPacketHeaderLen)
+		assert.NoError(t, err)
+
+		n, err := packetConn.ReadBatch([][]byte{make([]byte, 1)}, make([]net.Addr, 1))
+		assert.ErrorIs(t, err, io.ErrShortBuffer)
+		assert.Equal(t, 0, n)
+	})
+}
+
+func TestTCPPacketConn_Flush(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer:  20,
+		WriteBuffer: 4096,
+		Logger:      loggerFactory.NewLogger("ice"),
+	})
+	defer func() {
+		assert.NoError(t, packetConn.Close())
+	}()
+
+	local, remote := net.Pipe()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	// Nothing queued, so nothing to wait for.
+	assert.NoError(t, packetConn.Flush(local.RemoteAddr()))
+
+	_, err := packetConn.WriteTo([]byte("bye"), local.RemoteAddr())
+	assert.NoError(t, err)
+
+	// The peer isn't reading, the write can't complete.
+	assert.ErrorIs(t, packetConn.Flush(local.RemoteAddr()), errFlushTimeout)
+
+	received := make(chan []byte)
+	go func() {
+		buf := make([]byte, receiveMTU)
+		n, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+		assert.NoError(t, err)
+		received <- buf[:n]
+	}()
+
+	assert.NoError(t, packetConn.Flush(local.RemoteAddr()))
+	assert.Equal(t, []byte("bye"), <-received)
+
+	assert.ErrorIs(t, packetConn.Flush(&net.TCPAddr{}), io.ErrClosedPipe)
+}
+
+func TestTCPPacketConn_FlushDeadline(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer:  20,
+		WriteBuffer: 1 << 20,
+		Logger:      loggerFactory.NewLogger("ice"),
+	})
+
+	local, remote := net.Pipe()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	_, err := packetConn.WriteTo([]byte("urgent"), local.RemoteAddr())
+	assert.NoError(t, err)
+
+	// The peer isn't reading yet, the deadline expires.
+	assert.ErrorIs(t, packetConn.FlushDeadline(local.RemoteAddr(), time.Now().Add(20*time.Millisecond)), errFlushTimeout)
+
+	// Writes keep coming while flushing, only the packets queued before
+	// FlushDeadline are waited for.
+	stopWriting := make(chan struct{})
+	writing := make(chan struct{})
+	go func() {
+		defer close(writing)
+		for {
+			select {
+			case <-stopWriting:
+				return
+			default:
+			}
+			if _, err := packetConn.WriteTo([]byte("bulk"), local.RemoteAddr()); err != nil {
+				return
+			}
+		}
+	}()
+
+	reading := make(chan struct{})
+	go func() {
+		defer close(reading)
+		buf := make([]byte, receiveMTU)
+		n, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("urgent"), buf[:n])
+		for err == nil {
+			_, err = readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+		}
+	}()
+
+	assert.NoError(t, packetConn.FlushDeadline(local.RemoteAddr(), time.Time{}))
+
+	close(stopWriting)
+	<-writing
+	assert.NoError(t, packetConn.Close())
+	<-reading
+}
+
+func TestTCPPacketConn_WriteBatch(t *testing.T) {
+	for name, writeBuffer := range map[string]int{
+		"no buffer": 0,
+		"buffered":  4096,
+	} {
+		writeBuffer := writeBuffer
+		t.Run(name, func(t *testing.T) {
+			report := test.CheckRoutines(t)
+			defer report()
+
+			loggerFactory := logging.NewDefaultLoggerFactory()
+
+			packetConn := newTCPPacketConn(tcpPacketParams{
+				ReadBuffer:  20,
+				WriteBuffer: writeBuffer,
+				Logger:      loggerFactory.NewLogger("ice"),
+			})
+			defer func() {
+				assert.NoError(t, packetConn.Close())
+			}()
+
+			local, remote := net.Pipe()
+			assert.NoError(t, packetConn.AddConn(local, nil))
+
+			received := make(chan []byte, 3)
+			go func() {
+				for i := 0; i < 3; i++ {
+					buf := make([]byte, receiveMTU)
+					n, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+					assert.NoError(t, err)
+					received <- buf[:n]
+				}
+			}()
+
+			bufs := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+			n, err := packetConn.WriteBatch(bufs, local.RemoteAddr())
+			assert.NoError(t, err)
+			assert.Equal(t, 3, n)
+
+			for _, buf := range bufs {
+				assert.Equal(t, buf, <-received)
+			}
+
+			// A packet that can't be framed stops the batch.
+			go func() {
+				buf := make([]byte, receiveMTU)
+				n, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+				assert.NoError(t, err)
+				received <- buf[:n]
+			}()
+
+			n, err = packetConn.WriteBatch([][]byte{[]byte("ok"), make([]byte, 1<<16), []byte("never")}, local.RemoteAddr())
+			assert.ErrorIs(t, err, errStreamingPacketTooLarge)
+			assert.Equal(t, 1, n)
+			assert.Equal(t, []byte("ok"), <-received)
+		})
+	}
+}
+
+func TestTCPPacketConn_WriteBatchShortWrites(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer: 20,
+		Logger:     logging.NewDefaultLoggerFactory().NewLogger("ice"),
+	})
+	defer func() {
+		assert.NoError(t, packetConn.Close())
+	}()
+
+	local, remote := net.Pipe()
+	conn := &shortWriteConn{Conn: local, max: 3}
+	assert.NoError(t, packetConn.AddConn(conn, nil))
+
+	received := make(chan []byte, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			buf := make([]byte, receiveMTU)
+			n, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+			assert.NoError(t, err)
+			received <- buf[:n]
+		}
+	}()
+
+	// Each buffer is written in full before the next one, keeping the frames
+	// intact.
+	bufs := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	n, err := packetConn.WriteBatch(bufs, conn.RemoteAddr())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	for _, buf := range bufs {
+		assert.Equal(t, buf, <-received)
+	}
+}
+
+func TestTCPPacketConn_RemoveConnAfterReconnect(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer: 20,
+		Logger:     loggerFactory.NewLogger("ice"),
+	})
+	defer func() {
+		assert.NoError(t, packetConn.Close())
+	}()
+
+	// All net.Pipe conns share the same remote address, like a peer that
+	// reconnected from the same address.
+	oldLocal, oldRemote := net.Pipe()
+	assert.NoError(t, packetConn.AddConn(oldLocal, nil))
+	assert.NoError(t, oldRemote.Close())
+
+	// Drain the read error so startReading can remove the old conn.
+	_, _, err := packetConn.ReadFrom(make([]byte, receiveMTU))
+	assert.Error(t, err)
+	assert.Eventually(t, func() bool {
+		packetConn.mu.Lock()
+		defer packetConn.mu.Unlock()
+		return len(packetConn.conns) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	newLocal, newRemote := net.Pipe()
+	assert.NoError(t, packetConn.AddConn(newLocal, nil))
+
+	// A late removal of the old conn must not touch the new one.
+	packetConn.removeConn(oldLocal, closeReasonExplicit)
+
+	go func() {
+		_, err := packetConn.WriteTo([]byte("still here"), newLocal.RemoteAddr())
+		assert.NoError(t, err)
+	}()
+	buf := make([]byte, receiveMTU)
+	n, err := readStreamingPacket(newRemote, buf, streamingPacketHeaderLen)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("still here"), buf[:n])
+}
+
+func TestTCPPacketConn_PoolReadBuffers(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer:      20,
+		Logger:          loggerFactory.NewLogger("ice"),
+		PoolReadBuffers: true,
+	})
+	defer func() {
+		assert.NoError(t, packetConn.Close())
+	}()
+
+	local, remote := net.Pipe()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	go func() {
+		for _, pkt := range []string{"first", "second"} {
+			_, err := writeStreamingPacket(remote, []byte(pkt), streamingPacketHeaderLen)
+			assert.NoError(t, err)
+		}
+	}()
+
+	// Packets must stay intact even though their buffers are recycled.
+	buf := make([]byte, receiveMTU)
+	for _, pkt := range []string{"first", "second"} {
+		n, _, err := packetConn.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, pkt, string(buf[:n]))
+	}
+}
+
+func TestTCPPacketConn_ReadBufferPool(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	var allocs int32
+	pool := &sync.Pool{
+		New: func() interface{} {
+			atomic.AddInt32(&allocs, 1)
+			buf := make([]byte, receiveMTU)
+			return &buf
+		},
+	}
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	var (
+		packetConns []*tcpPacketConn
+		remotes     []net.Conn
+	)
+	for i := 0; i < 2; i++ {
+		packetConn := newTCPPacketConn(tcpPacketParams{
+			ReadBuffer:     20,
+			Logger:         loggerFactory.NewLogger("ice"),
+			ReadBufferPool: pool,
+		})
+		packetConns = append(packetConns, packetConn)
+
+		local, remote := net.Pipe()
+		defer func() {
+			_ = remote.Close()
+		}()
+		remotes = append(remotes, remote)
+		assert.NoError(t, packetConn.AddConn(local, nil))
+	}
+
+	// Idle conns don't hold a buffer.
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&allocs))
+
+	// Both conns read from the shared pool.
+	buf := make([]byte, receiveMTU)
+	for i, packetConn := range packetConns {
+		go func(remote net.Conn) {
+			_, err := writeStreamingPacket(remote, []byte("hello"), streamingPacketHeaderLen)
+			assert.NoError(t, err)
+		}(remotes[i])
+
+		n, _, err := packetConn.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(buf[:n]))
+	}
+	assert.Greater(t, atomic.LoadInt32(&allocs), int32(0))
+
+	for _, packetConn := range packetConns {
+		assert.NoError(t, packetConn.Close())
+	}
+}
+
+func BenchmarkTCPPacketConn_ReadFrom(b *testing.B) {
+	for name, pool := range map[string]bool{
+		"alloc": false,
+		"pool":  true,
+	} {
+		pool := pool
+		b.Run(name, func(b *testing.B) {
+			loggerFactory := logging.NewDefaultLoggerFactory()
+
+			packetConn := newTCPPacketConn(tcpPacketParams{
+				ReadBuffer:      20,
+				Logger:          loggerFactory.NewLogger("ice"),
+				PoolReadBuffers: pool,
+			})
+			defer func() {
+				_ = packetConn.Close()
+			}()
+
+			local, remote := net.Pipe()
+			if err := packetConn.AddConn(local, nil); err != nil {
+				b.Fatal(err)
+			}
+
+			frame := make([]byte, streamingPacketHeaderLen+1200)
+			putStreamingPacketHeader(frame, 1200, streamingPacketHeaderLen)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := remote.Write(frame); err != nil {
+						return
+					}
+				}
+			}()
+
+			buf := make([]byte, receiveMTU)
+			b.ReportAllocs()
+			b.SetBytes(1200)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := packetConn.ReadFrom(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestTCPPacketConn_WriteBufferStats(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer:  20,
+		WriteBuffer: 4096,
+		Logger:      loggerFactory.NewLogger("ice"),
+	})
+
+	local, remote := net.Pipe()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	queued, highWatermark := packetConn.WriteBufferStats()
+	assert.Equal(t, 0, queued)
+	assert.Equal(t, 0, highWatermark)
+
+	// The peer doesn't read, so everything after the first packet (picked by
+	// writeProcess) stays queued.
+	for i := 0; i < 3; i++ {
+		_, err := packetConn.WriteTo(make([]byte, 100), local.RemoteAddr())
+		assert.NoError(t, err)
+	}
+
+	queued, highWatermark = packetConn.WriteBufferStats()
+	assert.Greater(t, queued, 0)
+	assert.GreaterOrEqual(t, highWatermark, queued)
+
+	go func() {
+		_, _ = io.Copy(io.Discard, remote)
+	}()
+	assert.NoError(t, packetConn.Flush(local.RemoteAddr()))
+
+	queued, highWatermark2 := packetConn.WriteBufferStats()
+	assert.Equal(t, 0, queued)
+	assert.Equal(t, highWatermark, highWatermark2)
+
+	assert.NoError(t, packetConn.Close())
+}
+
+func TestTCPPacketConn_WriteToAll(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	for name, writeBuffer := range map[string]int{
+		"unbuffered": 0,
+		"buffered":   4096,
+	} {
+		writeBuffer := writeBuffer
+		t.Run(name, func(t *testing.T) {
+			packetConn := newTCPPacketConn(tcpPacketParams{
+				ReadBuffer:  20,
+				WriteBuffer: writeBuffer,
+				Logger:      loggerFactory.NewLogger("ice"),
+			})
+
+			_, err := packetConn.WriteToAll([]byte("hello"))
+			assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+			const numConns = 3
+			var wg sync.WaitGroup
+			for i := 0; i < numConns; i++ {
+				local, remote := net.Pipe()
+				conn := &addrConn{Conn: local, remote: &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000 + i}}
+				assert.NoError(t, packetConn.AddConn(conn, nil))
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer func() {
+						_ = remote.Close()
+					}()
+
+					buf := make([]byte, receiveMTU)
+					n, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+					assert.NoError(t, err)
+					assert.Equal(t, []byte("hello"), buf[:n])
+				}()
+			}
+
+			n, err := packetConn.WriteToAll([]byte("hello"))
+			assert.NoError(t, err)
+			assert.Equal(t, 5, n)
+
+			wg.Wait()
+			assert.NoError(t, packetConn.Close())
+		})
+	}
+}
+
+func TestTCPPacketConn_WriteTimeout(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer:   20,
+		WriteBuffer:  4096,
+		WriteTimeout: 50 * time.Millisecond,
+		Logger:       loggerFactory.NewLogger("ice"),
+	})
+	defer func() {
+		assert.NoError(t, packetConn.Close())
+	}()
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	// The peer never reads, the write times out and the conn is removed.
+	_, err := packetConn.WriteTo([]byte("stalled"), local.RemoteAddr())
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return len(packetConn.RemoteAddrs()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestTCPPacketConn_WriteToTimeout(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer:   20,
+		WriteTimeout: 50 * time.Millisecond,
+		Logger:       loggerFactory.NewLogger("ice"),
+	})
+	defer func() {
+		assert.NoError(t, packetConn.Close())
+	}()
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	// A write the peer reads completes, and doesn't leave a deadline behind.
+	go func() {
+		buf := make([]byte, receiveMTU)
+		_, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+		assert.NoError(t, err)
+	}()
+	_, err := packetConn.WriteTo([]byte("read"), local.RemoteAddr())
+	assert.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// The peer stops reading, the write times out and the conn is removed.
+	_, err = packetConn.WriteTo([]byte("stalled"), local.RemoteAddr())
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Empty(t, packetConn.RemoteAddrs())
+}
+
+// overlapConn counts the writes to the wrapped conn that overlap, and the
+// write deadlines set while another one is.
+type overlapConn struct {
+	net.Conn
+	writing, deadline, overlaps int32
+}
+
+func (c *overlapConn) Write(b []byte) (int, error) {
+	if atomic.AddInt32(&c.writing, 1) > 1 {
+		atomic.AddInt32(&c.overlaps, 1)
+	}
+	defer atomic.AddInt32(&c.writing, -1)
+
+	// Let the other writers run meanwhile, even on a single CPU.
+	runtime.Gosched()
+	return c.Conn.Write(b)
+}
+
+func (c *overlapConn) SetWriteDeadline(deadline time.Time) error {
+	if deadline.IsZero() {
+		atomic.StoreInt32(&c.deadline, 0)
+	} else if !atomic.CompareAndSwapInt32(&c.deadline, 0, 1) {
+		atomic.AddInt32(&c.overlaps, 1)
+	}
+
+	return c.Conn.SetWriteDeadline(deadline)
+}
+
+func TestTCPPacketConn_ConcurrentWriters(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer:   20,
+		WriteTimeout: 5 * time.Second,
+		Logger:       logging.NewDefaultLoggerFactory().NewLogger("ice"),
+	})
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	conn := &overlapConn{Conn: local}
+	assert.NoError(t, packetConn.AddConn(conn, nil))
+	raddr := local.RemoteAddr()
+
+	// Each writer sends a packet in the given number of frames.
+	writers := []struct {
+		frames int
+		write  func(pkt []byte) error
+	}{
+		{1, func(pkt []byte) error {
+			_, err := packetConn.WriteTo(pkt, raddr)
+			return err
+		}},
+		{2, func(pkt []byte) error {
+			_, err := packetConn.WriteBatch([][]byte{pkt, pkt}, raddr)
+			return err
+		}},
+		{1, func(pkt []byte) error {
+			_, err := packetConn.WriteToAll(pkt)
+			return err
+		}},
+		{1, func(pkt []byte) error {
+			_, err := packetConn.WriteToWithDeadline(pkt, raddr, time.Now().Add(5*time.Second))
+			return err
+		}},
+	}
+
+	const packetsPerWriter = 50
+	var expected int
+	var wg sync.WaitGroup
+	for i, writer := range writers {
+		expected += writer.frames * packetsPerWriter
+		pkt := bytes.Repeat([]byte{byte(i)}, 100+i)
+		write := writer.write
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < packetsPerWriter; j++ {
+				assert.NoError(t, write(pkt))
+			}
+		}()
+	}
+
+	// The frames of the writers don't interleave on the stream.
+	buf := make([]byte, receiveMTU)
+	for i := 0; i < expected; i++ {
+		n, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+		require.NoError(t, err)
+		require.Greater(t, n, 0)
+		assert.Equal(t, bytes.Repeat(buf[:1], 100+int(buf[0])), buf[:n])
+	}
+	wg.Wait()
+
+	assert.Zero(t, atomic.LoadInt32(&conn.overlaps))
+	assert.NoError(t, packetConn.Close())
+}
+
+func TestTCPPacketConn_ReadFromOpError(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	laddr := &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 3478}
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer: 20,
+		LocalAddr:  laddr,
+		Logger:     loggerFactory.NewLogger("ice"),
+	})
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	_, err := writeStreamingPacket(remote, []byte("too long"), streamingPacketHeaderLen)
+	assert.NoError(t, err)
+
+	_, _, err = packetConn.ReadFrom(make([]byte, 1))
+	assert.ErrorIs(t, err, io.ErrShortBuffer)
+
+	var opErr *net.OpError
+	if assert.ErrorAs(t, err, &opErr) {
+		assert.Equal(t, "read", opErr.Op)
+		assert.Equal(t, "tcp", opErr.Net)
+		assert.Equal(t, laddr, opErr.Source)
+		assert.Equal(t, "tcp", opErr.Addr.Network())
+		assert.Equal(t, local.RemoteAddr().String(), opErr.Addr.String())
+	}
+
+	assert.NoError(t, packetConn.Close())
+
+	_, _, err = packetConn.ReadFrom(make([]byte, receiveMTU))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	assert.ErrorAs(t, err, &opErr)
+}
+
+func TestTCPPacketConn_ReadRate(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer: 20,
+		ReadRate:   5000,
+		Logger:     loggerFactory.NewLogger("ice"),
+	})
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	// net.Pipe is unbuffered, so the sender is blocked while reading is
+	// throttled.
+	const numPackets = 10
+	go func() {
+		for i := 0; i < numPackets; i++ {
+			if _, err := writeStreamingPacket(remote, make([]byte, 1000), streamingPacketHeaderLen); err != nil {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	buf := make([]byte, receiveMTU)
+	for i := 0; i < numPackets; i++ {
+		_, _, err := packetConn.ReadFrom(buf)
+		assert.NoError(t, err)
+	}
+
+	// The first 5000 bytes are a burst, the 4 packets read after them
+	// wait 200ms each before the next one is read.
+	assert.GreaterOrEqual(t, time.Since(start), 600*time.Millisecond)
+
+	assert.NoError(t, packetConn.Close())
+}
+
+func TestTCPPacketConn_Conn(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	for name, writeBuffer := range map[string]int{
+		"unbuffered": 0,
+		"buffered":   4096,
+	} {
+		writeBuffer := writeBuffer
+		t.Run(name, func(t *testing.T) {
+			packetConn := newTCPPacketConn(tcpPacketParams{
+				ReadBuffer:  20,
+				WriteBuffer: writeBuffer,
+				Logger:      loggerFactory.NewLogger("ice"),
+			})
+
+			local, remote := net.Pipe()
+			defer func() {
+				_ = remote.Close()
+			}()
+			assert.NoError(t, packetConn.AddConn(local, nil))
+
+			conn, ok := packetConn.Conn(local.RemoteAddr())
+			assert.True(t, ok)
+			assert.Equal(t, local, conn, "the raw conn should be returned")
+
+			_, ok = packetConn.Conn(&net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000})
+			assert.False(t, ok)
+
+			assert.NoError(t, packetConn.Close())
+		})
+	}
+}
+
+// failingCloseConn is a net.Conn whose Close closes the underlying conn but
+// returns err.
+type failingCloseConn struct {
+	net.Conn
+	err error
+}
+
+func (c *failingCloseConn) Close() error {
+	_ = c.Conn.Close()
+	return c.err
+}
+
+func TestTCPPacketConn_CloseErrors(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer: 20,
+		Logger:     loggerFactory.NewLogger("ice"),
+	})
+
+	errClose1, errClose2 := errors.New("close 1"), errors.New("close 2")
+	for i, closeErr := range []error{errClose1, errClose2, nil} {
+		local, remote := net.Pipe()
+		defer func() {
+			_ = remote.Close()
+		}()
+
+		conn := &addrConn{Conn: &failingCloseConn{local, closeErr}, remote: &net.TCPAddr{
+			IP:   net.IP{10, 0, 0, 1},
+			Port: 5000 + i,
+		}}
+		assert.NoError(t, packetConn.AddConn(conn, nil))
+	}
+
+	err := packetConn.Close()
+	assert.ErrorIs(t, err, errClose1)
+	assert.ErrorIs(t, err, errClose2)
+	assert.ErrorIs(t, err, errClosingConnection)
+	assert.NotContains(t, err.Error(), "%!w")
+}
+
+func TestTCPPacketConn_ReadFromContext(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer: 20,
+		Logger:     loggerFactory.NewLogger("ice"),
+	})
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	buf := make([]byte, receiveMTU)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err := packetConn.ReadFromContext(ctx, buf)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// The conn is still usable after a cancelled read.
+	go func() {
+		_, err := writeStreamingPacket(remote, []byte("hello"), streamingPacketHeaderLen)
+		assert.NoError(t, err)
+	}()
+
+	n, raddr, err := packetConn.ReadFromContext(context.Background(), buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), buf[:n])
+	assert.Equal(t, local.RemoteAddr().String(), raddr.String())
+
+	// Cancelling a blocked read returns the error of its context as is.
+	ctx, cancel = context.WithCancel(context.Background())
+	readErr := make(chan error)
+	go func() {
+		_, _, err := packetConn.ReadFromContext(ctx, buf)
+		readErr <- err
+	}()
+	cancel()
+	assert.Equal(t, context.Canceled, <-readErr)
+
+	// A read blocked on a context that is never done returns once the conn
+	// is closed.
+	go func() {
+		_, _, err := packetConn.ReadFromContext(context.Background(), buf)
+		readErr <- err
+	}()
+
+	assert.NoError(t, packetConn.Close())
+	assert.ErrorIs(t, <-readErr, io.ErrClosedPipe)
+}
+
+func TestTCPPacketConn_SetReadBufferSize(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer: 2,
+		Logger:     loggerFactory.NewLogger("ice"),
+	})
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	// The third packet is blocked until the queue grows.
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for _, payload := range []string{"one", "two", "three"} {
+			_, err := writeStreamingPacket(remote, []byte(payload), streamingPacketHeaderLen)
+			assert.NoError(t, err)
+		}
+	}()
+
+	<-written
+	assert.Eventually(t, func() bool {
+		length, _ := packetConn.RecvQueueStats()
+		return length == 2
+	}, time.Second, 10*time.Millisecond)
+
+	packetConn.SetReadBufferSize(4)
+	assert.Eventually(t, func() bool {
+		length, capacity := packetConn.RecvQueueStats()
+		return length == 3 && capacity == 4
+	}, time.Second, 10*time.Millisecond)
+
+	// Shrinking below the queued packets keeps them.
+	packetConn.SetReadBufferSize(1)
+	length, capacity := packetConn.RecvQueueStats()
+	assert.Equal(t, 3, length)
+	assert.Equal(t, 3, capacity)
+
+	buf := make([]byte, receiveMTU)
+	for _, expected := range []string{"one", "two", "three"} {
+		n, _, err := packetConn.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(buf[:n]))
+	}
+
+	// A reader blocked on the queue follows it when it is replaced.
+	read := make(chan string)
+	go func() {
+		n, _, err := packetConn.ReadFrom(buf)
+		assert.NoError(t, err)
+		read <- string(buf[:n])
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	packetConn.SetReadBufferSize(8)
+	_, err := writeStreamingPacket(remote, []byte("four"), streamingPacketHeaderLen)
+	assert.NoError(t, err)
+	assert.Equal(t, "four", <-read)
+
+	assert.NoError(t, packetConn.Close())
+}
+
+func TestTCPPacketConn_SetWriteBufferSize(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer:  20,
+		WriteBuffer: 64 * 1024,
+		Logger:      loggerFactory.NewLogger("ice"),
+	})
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	// The peer doesn't read, so writes pile up until the lowered limit.
+	packetConn.SetWriteBufferSize(256)
+
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		_, err = packetConn.WriteTo(make([]byte, 100), local.RemoteAddr())
+	}
+	assert.ErrorIs(t, err, packetio.ErrFull)
+
+	assert.NoError(t, packetConn.Close())
+}
+
+func TestTCPPacketConn_AddrNetwork(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	t.Run("TCP", func(t *testing.T) {
+		laddr := &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 3478}
+		raddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000}
+		packetConn := newTCPPacketConn(tcpPacketParams{
+			ReadBuffer: 20,
+			LocalAddr:  laddr,
+			Logger:     loggerFactory.NewLogger("ice"),
+		})
+
+		local, remote := net.Pipe()
+		defer func() {
+			_ = remote.Close()
+		}()
+		assert.NoError(t, packetConn.AddConn(&addrConn{Conn: local, remote: raddr}, nil))
+
+		_, err := writeStreamingPacket(remote, []byte("hello"), streamingPacketHeaderLen)
+		assert.NoError(t, err)
+
+		// TCP addresses are returned as is, candidates are built from them.
+		n, addr, err := packetConn.ReadFrom(make([]byte, receiveMTU))
+		assert.NoError(t, err)
+		assert.Equal(t, 5, n)
+		assert.Equal(t, raddr, addr)
+		assert.Equal(t, laddr, packetConn.LocalAddr())
+
+		assert.NoError(t, packetConn.Close())
+	})
+
+	t.Run("NonTCP", func(t *testing.T) {
+		laddr := &net.UnixAddr{Name: "/tmp/mux.sock", Net: "unix"}
+		packetConn := newTCPPacketConn(tcpPacketParams{
+			ReadBuffer: 20,
+			LocalAddr:  laddr,
+			Logger:     loggerFactory.NewLogger("ice"),
+		})
+
+		local, remote := net.Pipe()
+		defer func() {
+			_ = remote.Close()
+		}()
+		assert.NoError(t, packetConn.AddConn(local, nil))
+
+		_, err := writeStreamingPacket(remote, []byte("hello"), streamingPacketHeaderLen)
+		assert.NoError(t, err)
+
+		_, addr, err := packetConn.ReadFrom(make([]byte, receiveMTU))
+		assert.NoError(t, err)
+		assert.Equal(t, "tcp", addr.Network())
+		assert.Equal(t, local.RemoteAddr().String(), addr.String())
+		assert.Equal(t, "tcp", packetConn.LocalAddr().Network())
+		assert.Equal(t, laddr.String(), packetConn.LocalAddr().String())
+
+		// The address read from still identifies the conn for writes.
+		go func() {
+			_, err := packetConn.WriteTo([]byte("reply"), addr)
+			assert.NoError(t, err)
+		}()
+
+		buf := make([]byte, receiveMTU)
+		n, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+		assert.NoError(t, err)
+		assert.Equal(t, "reply", string(buf[:n]))
+
+		assert.NoError(t, packetConn.Close())
+	})
+}
+
+func TestTCPPacketConn_KeyFunc(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer: 20,
+		Logger:     loggerFactory.NewLogger("ice"),
+		KeyFunc: func(addr net.Addr) string {
+			return addr.(*net.TCPAddr).IP.String()
+		},
+	})
+
+	clientIP := net.IP{10, 0, 0, 1}
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	assert.NoError(t, packetConn.AddConn(&addrConn{Conn: local, remote: &net.TCPAddr{IP: clientIP, Port: 5000}}, nil))
+
+	// Another source port of the same IP maps to the same key.
+	local2, remote2 := net.Pipe()
+	defer func() {
+		_ = remote2.Close()
+	}()
+	assert.ErrorIs(t, packetConn.AddConn(&addrConn{Conn: local2, remote: &net.TCPAddr{IP: clientIP, Port: 5001}}, nil), errConnectionAddrAlreadyExist)
+
+	go func() {
+		_, err := packetConn.WriteTo([]byte("hello"), &net.TCPAddr{IP: clientIP, Port: 6000})
+		assert.NoError(t, err)
+	}()
+
+	buf := make([]byte, receiveMTU)
+	n, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), buf[:n])
+
+	assert.NoError(t, packetConn.Close())
+}
+
+func TestTCPPacketConn_DuplicatePolicy(t *testing.T) {
+	raddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000}
+
+	// addConns adds two conns from raddr with the given local addresses and
+	// returns them, their remote ends and the error of the second AddConn.
+	addConns := func(t *testing.T, packetConn *tcpPacketConn, local1, local2 net.Addr) ([2]net.Conn, [2]net.Conn, error) {
+		t.Helper()
+
+		var conns, remotes [2]net.Conn
+		for i, local := range []net.Addr{local1, local2} {
+			conn, remote := net.Pipe()
+			t.Cleanup(func() {
+				_ = remote.Close()
+			})
+			conns[i], remotes[i] = &addrConn{Conn: conn, remote: raddr, local: local}, remote
+		}
+
+		assert.NoError(t, packetConn.AddConn(conns[0], nil))
+		return conns, remotes, packetConn.AddConn(conns[1], nil)
+	}
+
+	newPacketConn := func(policy DuplicateConnPolicy) *tcpPacketConn {
+		return newTCPPacketConn(tcpPacketParams{
+			ReadBuffer:      20,
+			Logger:          logging.NewDefaultLoggerFactory().NewLogger("ice"),
+			DuplicatePolicy: policy,
+		})
+	}
+
+	localA := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 443}
+	localB := &net.TCPAddr{IP: net.IP{10, 0, 0, 3}, Port: 443}
+
+	t.Run("KeepExisting", func(t *testing.T) {
+		report := test.CheckRoutines(t)
+		defer report()
+
+		packetConn := newPacketConn(DuplicateConnKeepExisting)
+		conns, _, err := addConns(t, packetConn, localA, localB)
+		assert.ErrorIs(t, err, errConnectionAddrAlreadyExist)
+
+		conn, ok := packetConn.Conn(raddr)
+		assert.True(t, ok)
+		assert.Equal(t, conns[0], conn)
+
+		assert.NoError(t, packetConn.Close())
+	})
+
+	t.Run("PreferNew", func(t *testing.T) {
+		report := test.CheckRoutines(t)
+		defer report()
+
+		packetConn := newPacketConn(DuplicateConnPreferNew)
+		conns, remotes, err := addConns(t, packetConn, localA, localA)
+		assert.NoError(t, err)
+
+		conn, ok := packetConn.Conn(raddr)
+		assert.True(t, ok)
+		assert.Equal(t, conns[1], conn)
+		assert.Len(t, packetConn.RemoteAddrs(), 1)
+
+		// The replaced conn is closed without failing ReadFrom.
+		_, err = remotes[0].Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+
+		go func() {
+			_, err := writeStreamingPacket(remotes[1], []byte("hello"), streamingPacketHeaderLen)
+			assert.NoError(t, err)
+		}()
+
+		buf := make([]byte, receiveMTU)
+		n, _, err := packetConn.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("hello"), buf[:n])
+
+		assert.NoError(t, packetConn.Close())
+	})
+
+	t.Run("PreferNewStalledPeer", func(t *testing.T) {
+		report := test.CheckRoutines(t)
+		defer report()
+
+		packetConn := newTCPPacketConn(tcpPacketParams{
+			ReadBuffer:      20,
+			WriteBuffer:     1024,
+			Logger:          logging.NewDefaultLoggerFactory().NewLogger("ice"),
+			DuplicatePolicy: DuplicateConnPreferNew,
+		})
+
+		conn, remote := net.Pipe()
+		defer func() {
+			_ = remote.Close()
+		}()
+		assert.NoError(t, packetConn.AddConn(&addrConn{Conn: conn, remote: raddr, local: localA}, nil))
+
+		// The peer never reads, closing the conn waits for the packet.
+		_, err := packetConn.WriteTo([]byte("stalled"), raddr)
+		assert.NoError(t, err)
+
+		// Replacing it doesn't wait, the mux adds conns under its lock.
+		conn2, remote2 := net.Pipe()
+		defer func() {
+			_ = remote2.Close()
+		}()
+		start := time.Now()
+		assert.NoError(t, packetConn.AddConn(&addrConn{Conn: conn2, remote: raddr, local: localA}, nil))
+		assert.Less(t, time.Since(start), bufferedConnCloseTimeout/2)
+
+		assert.NoError(t, packetConn.Close())
+	})
+
+	t.Run("KeepBothSameLocalAddr", func(t *testing.T) {
+		report := test.CheckRoutines(t)
+		defer report()
+
+		packetConn := newPacketConn(DuplicateConnKeepBoth)
+		_, _, err := addConns(t, packetConn, localA, localA)
+		assert.ErrorIs(t, err, errConnectionAddrAlreadyExist)
+
+		assert.NoError(t, packetConn.Close())
+	})
+
+	t.Run("KeepBothDifferentLocalAddr", func(t *testing.T) {
+		report := test.CheckRoutines(t)
+		defer report()
+
+		packetConn := newPacketConn(DuplicateConnKeepBoth)
+		conns, remotes, err := addConns(t, packetConn, localA, localB)
+		assert.NoError(t, err)
+
+		// Packets are read from both conns.
+		buf := make([]byte, receiveMTU)
+		for _, remote := range remotes {
+			go func(remote net.Conn) {
+				_, err := writeStreamingPacket(remote, []byte("hello"), streamingPacketHeaderLen)
+				assert.NoError(t, err)
+			}(remote)
+
+			n, _, err := packetConn.ReadFrom(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("hello"), buf[:n])
+		}
+
+		conn, ok := packetConn.Conn(raddr)
+		assert.True(t, ok)
+		assert.Equal(t, conns[0], conn)
+
+		// The second conn takes over once the first is gone.
+		assert.NoError(t, remotes[0].Close())
+		_, _, err = packetConn.ReadFrom(buf)
+		assert.Error(t, err)
+
+		assert.Eventually(t, func() bool {
+			conn, ok := packetConn.Conn(raddr)
+			return ok && conn == conns[1]
+		}, time.Second, 10*time.Millisecond)
+		assert.Len(t, packetConn.RemoteAddrs(), 1)
+
+		assert.NoError(t, packetConn.Close())
+	})
+}
+
+func TestTCPPacketConn_RTTUnsupported(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer: 20,
+		Logger:     logging.NewDefaultLoggerFactory().NewLogger("ice"),
+	})
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	_, err := packetConn.RTT(local.RemoteAddr())
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	assert.NoError(t, packetConn.Close())
+}
+
+func TestTCPPacketConn_ConcurrentReadFrom(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer: 20,
+		Logger:     logging.NewDefaultLoggerFactory().NewLogger("ice"),
+	})
+
+	local, remote := net.Pipe()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	const numPackets, numReaders = 200, 4
+	go func() {
+		for i := 0; i < numPackets; i++ {
+			_, err := writeStreamingPacket(remote, []byte(strconv.Itoa(i)), streamingPacketHeaderLen)
+			assert.NoError(t, err)
+		}
+	}()
+
+	var mu sync.Mutex
+	received := map[string]int{}
+
+	var wg sync.WaitGroup
+	for r := 0; r < numReaders; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, receiveMTU)
+			for {
+				n, _, err := packetConn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+
+				mu.Lock()
+				received[string(buf[:n])]++
+				done := len(received) == numPackets
+				mu.Unlock()
+
+				if done {
+					// Unblocks the other readers.
+					assert.NoError(t, packetConn.Close())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every packet was delivered to exactly one reader.
+	assert.Len(t, received, numPackets)
+	for i := 0; i < numPackets; i++ {
+		assert.Equal(t, 1, received[strconv.Itoa(i)], i)
+	}
+
+	assert.NoError(t, remote.Close())
+}
+
+// tcpPacketConnPeer is the remote end of a conn of a tcpPacketConn.
+type tcpPacketConnPeer struct {
+	conn net.Conn
+	addr net.Addr
+}
+
+func (p *tcpPacketConnPeer) Addr() net.Addr {
+	return p.addr
+}
+
+func (p *tcpPacketConnPeer) Send(pkt []byte) error {
+	return icetest.WritePacket(p.conn, pkt)
+}
+
+func (p *tcpPacketConnPeer) Receive() ([]byte, error) {
+	return icetest.ReadPacket(p.conn)
+}
+
+func (p *tcpPacketConnPeer) Close() error {
+	return p.conn.Close()
+}
+
+func TestTCPPacketConn_Conformance(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	icetest.TestPacketConn(t, func() (net.PacketConn, icetest.PacketConnPeer, error) {
+		packetConn := newTCPPacketConn(tcpPacketParams{
+			ReadBuffer: 20,
+			LocalAddr:  &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 443},
+			Logger:     logging.NewDefaultLoggerFactory().NewLogger("ice"),
+		})
+
+		local, remote := net.Pipe()
+		raddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000}
+		if err := packetConn.AddConn(&addrConn{Conn: local, remote: raddr}, nil); err != nil {
+			return nil, nil, err
+		}
+
+		return packetConn, &tcpPacketConnPeer{conn: remote, addr: raddr}, nil
+	}, icetest.PacketConnOptions{})
+}
+
+func TestTCPPacketConn_WriteBufferNearFull(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	// The callback runs on the goroutine of WriteTo.
+	var nearFull [][2]int
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer:          20,
+		WriteBuffer:         1024,
+		WriteBufferNearFull: 0.5,
+		OnWriteBufferNearFull: func(raddr net.Addr, queued, limit int) {
+			nearFull = append(nearFull, [2]int{queued, limit})
+		},
+		Logger: logging.NewDefaultLoggerFactory().NewLogger("ice"),
+	})
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	// fill writes packets while the peer doesn't read, until the buffer is
+	// signaled nearly full, and returns the bytes written to the peer. The
+	// writes succeed, the signal comes before packets get dropped.
+	const packetLen = 100
+	fill := func() int {
+		calls := len(nearFull)
+		var written int
+		for i := 0; i < 20 && len(nearFull) == calls; i++ {
+			n, err := packetConn.WriteTo(make([]byte, packetLen), local.RemoteAddr())
+			require.NoError(t, err)
+			assert.Equal(t, packetLen, n)
+			written += streamingPacketHeaderLen + packetLen
+		}
+		require.Len(t, nearFull, calls+1)
+		assert.GreaterOrEqual(t, nearFull[calls][0], 512)
+		assert.Equal(t, 1024, nearFull[calls][1])
+		return written
+	}
+
+	written := fill()
+
+	// The buffer is signaled once while it stays nearly full.
+	_, err := packetConn.WriteTo(make([]byte, packetLen), local.RemoteAddr())
+	assert.NoError(t, err)
+	written += streamingPacketHeaderLen + packetLen
+	assert.Len(t, nearFull, 1)
+
+	// Once drained, filling it up again signals it again.
+	_, err = io.ReadFull(remote, make([]byte, written))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		queued, _ := packetConn.WriteBufferStats()
+		return queued == 0
+	}, time.Second, time.Millisecond)
+	fill()
+
+	assert.NoError(t, packetConn.Close())
+}
+
+func TestTCPPacketConn_WriteBufferFull(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer:  20,
+		WriteBuffer: 256,
+		Logger:      logging.NewDefaultLoggerFactory().NewLogger("ice"),
+	})
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	// The peer doesn't read, so packets end up being dropped.
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		_, err = packetConn.WriteTo(make([]byte, 100), local.RemoteAddr())
+	}
+	assert.ErrorIs(t, err, ErrWriteBufferFull)
+	assert.ErrorIs(t, err, packetio.ErrFull)
+
+	// The connection is kept, writes go through again once it drains.
+	go func() {
+		_, _ = io.Copy(io.Discard, remote)
+	}()
+	assert.Eventually(t, func() bool {
+		_, err = packetConn.WriteTo(make([]byte, 100), local.RemoteAddr())
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, packetConn.Close())
+}
+
+func TestTCPPacketConn_WriteBufferBlocking(t *testing.T) {
+	const numPackets = 10
+
+	newPacketConn := func(logger logging.LeveledLogger) (*tcpPacketConn, net.Conn, net.Conn) {
+		packetConn := newTCPPacketConn(tcpPacketParams{
+			ReadBuffer:              20,
+			WriteBuffer:             256,
+			WriteBufferLowWatermark: 128,
+			WriteBufferBlocking:     true,
+			Logger:                  logger,
+		})
+
+		local, remote := net.Pipe()
+		assert.NoError(t, packetConn.AddConn(local, nil))
+		return packetConn, local, remote
+	}
+
+	// writeAll writes the packets until one fails, and reports how many were
+	// written on done.
+	writeAll := func(packetConn *tcpPacketConn, raddr net.Addr, done chan<- int) {
+		for i := 0; i < numPackets; i++ {
+			if _, err := packetConn.WriteTo(make([]byte, 100), raddr); err != nil {
+				done <- i
+				return
+			}
+		}
+		done <- numPackets
+	}
+
+	t.Run("waits for the peer", func(t *testing.T) {
+		report := test.CheckRoutines(t)
+		defer report()
+
+		var logs syncBuffer
+		loggerFactory := &logging.DefaultLoggerFactory{
+			Writer:          &logs,
+			DefaultLogLevel: logging.LogLevelInfo,
+		}
+		packetConn, local, remote := newPacketConn(loggerFactory.NewLogger("ice"))
+
+		// The peer doesn't read, so the writes block rather than drop packets.
+		done := make(chan int, 1)
+		go writeAll(packetConn, local.RemoteAddr(), done)
+
+		select {
+		case n := <-done:
+			assert.Fail(t, "writes should block", "%d packets written", n)
+		case <-time.After(100 * time.Millisecond):
+		}
+		assert.Contains(t, logs.String(), "event=write_buffer_filling")
+
+		for i := 0; i < numPackets; i++ {
+			buf := make([]byte, receiveMTU)
+			n, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+			assert.NoError(t, err)
+			assert.Equal(t, 100, n)
+		}
+		assert.Equal(t, numPackets, <-done)
+		assert.Contains(t, logs.String(), "event=write_buffer_drained")
+
+		assert.NoError(t, packetConn.Close())
+		_ = remote.Close()
+	})
+
+	t.Run("fails once closed", func(t *testing.T) {
+		report := test.CheckRoutines(t)
+		defer report()
+
+		packetConn, local, remote := newPacketConn(logging.NewDefaultLoggerFactory().NewLogger("ice"))
+		defer func() {
+			_ = remote.Close()
+		}()
+
+		done := make(chan int, 1)
+		go writeAll(packetConn, local.RemoteAddr(), done)
+		time.Sleep(50 * time.Millisecond)
+
+		assert.NoError(t, packetConn.Close())
+		assert.Less(t, <-done, numPackets)
+	})
+
+	t.Run("fails for packets larger than the buffer", func(t *testing.T) {
+		report := test.CheckRoutines(t)
+		defer report()
+
+		packetConn, local, remote := newPacketConn(logging.NewDefaultLoggerFactory().NewLogger("ice"))
+		defer func() {
+			_ = remote.Close()
+		}()
+
+		_, err := packetConn.WriteTo(make([]byte, 300), local.RemoteAddr())
+		assert.ErrorIs(t, err, ErrWriteBufferFull)
+
+		assert.NoError(t, packetConn.Close())
+	})
+}
+
+func TestTCPPacketConn_WriteToWithDeadline(t *testing.T) {
+	t.Run("unbuffered", func(t *testing.T) {
+		report := test.CheckRoutines(t)
+		defer report()
+
+		packetConn := newTCPPacketConn(tcpPacketParams{
+			ReadBuffer: 20,
+			Logger:     logging.NewDefaultLoggerFactory().NewLogger("ice"),
+		})
+
+		local, remote := net.Pipe()
+		defer func() {
+			_ = remote.Close()
+		}()
+		assert.NoError(t, packetConn.AddConn(local, nil))
+
+		// A write in time doesn't bound the next ones.
+		go func() {
+			buf := make([]byte, receiveMTU)
+			for i := 0; i < 2; i++ {
+				_, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+				assert.NoError(t, err)
+				time.Sleep(100 * time.Millisecond)
+			}
+		}()
+		_, err := packetConn.WriteToWithDeadline([]byte("urgent"), local.RemoteAddr(), time.Now().Add(50*time.Millisecond))
+		assert.NoError(t, err)
+		_, err = packetConn.WriteTo([]byte("later"), local.RemoteAddr())
+		assert.NoError(t, err)
+
+		// The peer doesn't read anymore, the write times out and its
+		// connection is removed.
+		_, err = packetConn.WriteToWithDeadline([]byte("urgent"), local.RemoteAddr(), time.Now().Add(50*time.Millisecond))
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		assert.Empty(t, packetConn.RemoteAddrs())
+
+		assert.NoError(t, packetConn.Close())
+	})
+
+	t.Run("buffered", func(t *testing.T) {
+		report := test.CheckRoutines(t)
+		defer report()
+
+		packetConn := newTCPPacketConn(tcpPacketParams{
+			ReadBuffer:  20,
+			WriteBuffer: 256,
+			Logger:      logging.NewDefaultLoggerFactory().NewLogger("ice"),
+		})
+
+		local, remote := net.Pipe()
+		defer func() {
+			_ = remote.Close()
+		}()
+		assert.NoError(t, packetConn.AddConn(local, nil))
+
+		var err error
+		for err == nil {
+			_, err = packetConn.WriteTo(make([]byte, 100), local.RemoteAddr())
+		}
+		assert.ErrorIs(t, err, ErrWriteBufferFull)
+
+		// The deadline bounds the wait for room in the full buffer.
+		start := time.Now()
+		_, err = packetConn.WriteToWithDeadline(make([]byte, 100), local.RemoteAddr(), start.Add(50*time.Millisecond))
+		assert.ErrorIs(t, err, ErrWriteBufferFull)
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+		go func() {
+			_, _ = io.Copy(io.Discard, remote)
+		}()
+		_, err = packetConn.WriteToWithDeadline(make([]byte, 100), local.RemoteAddr(), time.Now().Add(time.Second))
+		assert.NoError(t, err)
+
+		assert.NoError(t, packetConn.Close())
+	})
+}
+
+func TestTCPPacketConn_Fragmentation(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	newPacketConn := func() *tcpPacketConn {
+		return newTCPPacketConn(tcpPacketParams{
+			ReadBuffer:         20,
+			Logger:             loggerFactory.NewLogger("ice"),
+			AllowFragmentation: true,
+		})
+	}
+
+	large := make([]byte, 3*receiveMTU)
+	for i := range large {
+		large[i] = byte(i)
+	}
+
+	t.Run("reassembled", func(t *testing.T) {
+		sender, receiver := newPacketConn(), newPacketConn()
+
+		local, remote := net.Pipe()
+		assert.NoError(t, sender.AddConn(local, nil))
+		assert.NoError(t, receiver.AddConn(remote, nil))
+
+		for _, pkt := range [][]byte{large, {fragmentMarker, 1, 2}, []byte("small")} {
+			pkt := pkt
+			go func() {
+				n, err := sender.WriteTo(pkt, local.RemoteAddr())
+				assert.NoError(t, err)
+				assert.Equal(t, len(pkt), n)
+			}()
+
+			buf := make([]byte, len(large))
+			n, _, err := receiver.ReadFrom(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, pkt, buf[:n])
+		}
+
+		assert.NoError(t, sender.Close())
+		assert.NoError(t, receiver.Close())
+	})
+
+	t.Run("write buffer full midway", func(t *testing.T) {
+		sender := newTCPPacketConn(tcpPacketParams{
+			ReadBuffer:         20,
+			WriteBuffer:        receiveMTU + receiveMTU/2,
+			Logger:             loggerFactory.NewLogger("ice"),
+			AllowFragmentation: true,
+		})
+		receiver := newPacketConn()
+
+		local, remote := net.Pipe()
+		assert.NoError(t, sender.AddConn(local, nil))
+
+		// Nothing is read yet, the buffer fills up after the first
+		// fragments.
+		_, err := sender.WriteTo(large, local.RemoteAddr())
+		assert.ErrorIs(t, err, ErrWriteBufferFull)
+
+		assert.NoError(t, receiver.AddConn(remote, nil))
+		assert.NoError(t, sender.Flush(local.RemoteAddr()))
+
+		// The fragments written are dropped, not merged with the next
+		// packet.
+		for _, pkt := range [][]byte{{fragmentMarker, 1, 2}, []byte("small")} {
+			_, err := sender.WriteTo(pkt, local.RemoteAddr())
+			assert.NoError(t, err)
+
+			buf := make([]byte, len(large))
+			n, _, err := receiver.ReadFrom(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, pkt, buf[:n])
+		}
+
+		assert.NoError(t, sender.Close())
+		assert.NoError(t, receiver.Close())
+	})
+
+	t.Run("peer without fragmentation", func(t *testing.T) {
+		sender := newPacketConn()
+
+		local, remote := net.Pipe()
+		assert.NoError(t, sender.AddConn(local, nil))
+
+		go func() {
+			_, err := sender.WriteTo(large, local.RemoteAddr())
+			assert.NoError(t, err)
+		}()
+
+		// The fragments arrive as separate packets that fit the read buffer.
+		buf := make([]byte, receiveMTU)
+		var received int
+		for received < len(large) {
+			n, err := readStreamingPacket(remote, buf, streamingPacketHeaderLen)
+			assert.NoError(t, err)
+			assert.Equal(t, byte(fragmentMarker), buf[0])
+			received += n - fragmentHeaderLen
+		}
+		assert.Equal(t, len(large), received)
+
+		assert.NoError(t, sender.Close())
+		_ = remote.Close()
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		sender := newPacketConn()
+
+		local, remote := net.Pipe()
+		defer func() {
+			_ = remote.Close()
+		}()
+		assert.NoError(t, sender.AddConn(local, nil))
+
+		_, err := sender.WriteTo(make([]byte, maxFragmentedPacketLen+1), local.RemoteAddr())
+		assert.ErrorIs(t, err, errStreamingPacketTooLarge)
+
+		assert.NoError(t, sender.Close())
+	})
+}
+
+func TestTCPPacketConn_AddConnWithLeftover(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer: 20,
+		Logger:     logging.NewDefaultLoggerFactory().NewLogger("ice"),
+	})
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+
+	// The handshake read the first packet, the second one and the start of
+	// the third.
+	var stream []byte
+	for _, pkt := range []string{"second", "third"} {
+		stream = append(stream, byte(len(pkt)>>8), byte(len(pkt)))
+		stream = append(stream, pkt...)
+	}
+	leftover := stream[:streamingPacketHeaderLen+len("second")+3]
+	rest := stream[len(leftover):]
+
+	assert.NoError(t, packetConn.AddConnWithLeftover(local, []byte("first"), leftover))
+
+	go func() {
+		_, err := remote.Write(rest)
+		assert.NoError(t, err)
+	}()
+
+	buf := make([]byte, receiveMTU)
+	for _, pkt := range []string{"first", "second", "third"} {
+		n, _, err := packetConn.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, pkt, string(buf[:n]))
+	}
+
+	assert.NoError(t, packetConn.Close())
+}
+
+func TestTCPPacketConn_ReadFromWholePacket(t *testing.T) {
+	report := test.CheckRoutines(t)
+	defer report()
+
+	packetConn := newTCPPacketConn(tcpPacketParams{
+		ReadBuffer: 20,
+		Logger:     logging.NewDefaultLoggerFactory().NewLogger("ice"),
+	})
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = remote.Close()
+	}()
+	assert.NoError(t, packetConn.AddConn(local, nil))
+
+	go func() {
+		for _, pkt := range []string{"too long", "hello"} {
+			_, err := writeStreamingPacket(remote, []byte(pkt), streamingPacketHeaderLen)
+			assert.NoError(t, err)
+		}
+	}()
+
+	// A packet that doesn't fit is dropped rather than returned in part.
+	_, _, err := packetConn.ReadFrom(make([]byte, 4))
+	assert.ErrorIs(t, err, io.ErrShortBuffer)
+
+	// The packet is copied up to the capacity of the buffer.
+	buf := make([]byte, 0, receiveMTU)
+	n, _, err := packetConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	assert.NoError(t, packetConn.Close())
+}
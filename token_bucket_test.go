@@ -0,0 +1,30 @@
+package ice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket_Allow(t *testing.T) {
+	b := newTokenBucket(10, 2)
+
+	assert.True(t, b.allow(1))
+	assert.True(t, b.allow(1))
+	assert.False(t, b.allow(1), "burst should be exhausted")
+
+	time.Sleep(150 * time.Millisecond)
+	assert.True(t, b.allow(1), "bucket should have been refilled")
+}
+
+func TestTokenBucket_Reserve(t *testing.T) {
+	b := newTokenBucket(10, 2)
+
+	assert.Equal(t, time.Duration(0), b.reserve(2))
+
+	wait := b.reserve(1)
+	assert.InDelta(t, 100*time.Millisecond, wait, float64(10*time.Millisecond), "debt of 1 token should take 100ms to repay")
+
+	assert.False(t, b.allow(1), "bucket in debt should not allow")
+}
@@ -115,7 +115,7 @@ func (c *udpConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 		if c.mux.isXORMappedResponse(msg, udpAddr.String()) {
 			err = c.mux.handleXORMappedResponse(udpAddr, msg)
 			if err != nil {
-				c.logger.Debugf("%w: %v", errGetXorMappedAddrResponse, err)
+				c.logger.Debugf("%v: %v", errGetXorMappedAddrResponse, err)
 				return n, addr, nil
 			}
 			return
@@ -1,8 +1,10 @@
 package ice
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -22,6 +24,75 @@ func (a *atomicError) Load() error {
 	return err.error
 }
 
+// wrappedError is an error wrapping both a sentinel and the error that caused
+// it, so that errors.Is matches either.
+type wrappedError struct {
+	sentinel error
+	cause    error
+}
+
+// wrapError returns cause wrapped in sentinel, reading as "sentinel: cause".
+func wrapError(sentinel, cause error) error {
+	return &wrappedError{sentinel: sentinel, cause: cause}
+}
+
+func (e *wrappedError) Error() string {
+	return e.sentinel.Error() + ": " + e.cause.Error()
+}
+
+func (e *wrappedError) Is(target error) bool {
+	return errors.Is(e.sentinel, target)
+}
+
+func (e *wrappedError) Unwrap() error {
+	return e.cause
+}
+
+// joinedErrors is a list of errors reported together, errors.Is and
+// errors.As match any of them.
+type joinedErrors []error
+
+// joinErrors returns the non-nil errors of errs joined together, nil if there
+// are none.
+func joinErrors(errs ...error) error {
+	var joined joinedErrors
+	for _, err := range errs {
+		if err != nil {
+			joined = append(joined, err)
+		}
+	}
+	if len(joined) == 0 {
+		return nil
+	}
+	return joined
+}
+
+func (e joinedErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e joinedErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e joinedErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
 // The conditions of invalidation written below are defined in
 // https://tools.ietf.org/html/rfc8445#section-5.1.1.1
 func isSupportedIPv6(ip net.IP) bool {